@@ -0,0 +1,142 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*Aggregate is a function summarizing a field over a bucket of time*/
+type Aggregate string
+
+const (
+	AggMin   Aggregate = "min"   //smallest value
+	AggMax   Aggregate = "max"   //largest value
+	AggMean  Aggregate = "mean"  //average of numeric values
+	AggCount Aggregate = "count" //number of non null values
+	AggLast  Aggregate = "last"  //most recent non null value
+)
+
+/*ErrInvalidQuery is matched by errors.Is when a query cannot be carried out as asked*/
+var ErrInvalidQuery = fmt.Errorf("Invalid query")
+
+/*ParseAggregate converts a name such as "mean" into an Aggregate*/
+func ParseAggregate(s string) (Aggregate, error) {
+	switch agg := Aggregate(strings.ToLower(s)); agg {
+	case AggMin, AggMax, AggMean, AggCount, AggLast:
+		return agg, nil
+	}
+	return "", fmt.Errorf("%w: unknown aggregate %q, must be min, max, mean, count or last", ErrInvalidQuery, s)
+}
+
+/*Accepts returns true if the aggregate can summarize a field of mode.  Means need
+numbers, and not every database can take the min or max of a bool.*/
+func (a Aggregate) Accepts(mode FieldMode) bool {
+	switch a {
+	case AggMean:
+		return mode == ModeInt || mode == ModeFloat
+	case AggMin, AggMax:
+		return mode == ModeInt || mode == ModeFloat || mode == ModeString
+	case AggCount, AggLast:
+		return mode == ModeBool || mode == ModeInt || mode == ModeFloat || mode == ModeString
+	}
+	return false
+}
+
+/*Mode returns the mode of the aggregate of a field of mode*/
+func (a Aggregate) Mode(mode FieldMode) FieldMode {
+	switch a {
+	case AggMean:
+		return ModeFloat
+	case AggCount:
+		return ModeInt
+	}
+	return mode
+}
+
+/*sql returns the SQL aggregate function applied to column*/
+func (a Aggregate) sql(column string) string {
+	switch a {
+	case AggMin:
+		return "MIN(" + column + ")"
+	case AggMax:
+		return "MAX(" + column + ")"
+	case AggMean:
+		return "AVG(" + column + ")"
+	}
+	return "COUNT(" + column + ")"
+}
+
+/*AggregateQuery summarizes the rows a Query selects over buckets of time.  Buckets
+are aligned to multiples of Bucket since the Unix epoch, and Limit applies to the
+number of buckets rather than rows.*/
+type AggregateQuery struct {
+	Query
+	Bucket    time.Duration //width of each bucket, at least a second
+	Functions []Aggregate   //applied to every field
+}
+
+/*Bucket is the summary of the rows falling within a bucket of time*/
+type Bucket struct {
+	Start time.Time                          `json:"start"`
+	Data  map[Alphabetic]map[Aggregate]Field `json:"data"` //field -> aggregate -> value
+}
+
+/*SqlAggregate forms a SQL SELECT statement for the query in the given dialect, along
+with the values matching its placeholders.  It selects the start of the bucket in Unix
+seconds, followed by each of Functions applied to the first field, then the second,
+and so on.  Fields and Functions must not be empty.*/
+func (q AggregateQuery) SqlAggregate(dialect string) (r string, args []interface{}, err error) {
+	sqld, err := LookupDialect(dialect)
+	if err != nil {
+		return "", nil, err
+	}
+	width := int64(q.Bucket / time.Second)
+	if !q.Table.Valid() || len(q.Fields) == 0 || len(q.Functions) == 0 || width < 1 {
+		return "", nil, fmt.Errorf("Cannot form SqlAggregate")
+	}
+	for _, field := range q.Fields {
+		if !field.Valid() {
+			return "", nil, fmt.Errorf("Invalid field %q", field)
+		}
+	}
+
+	//the bucket is worked out in a derived table so it can be grouped and correlated on
+	inner := func(alias string) string {
+		columns := []string{sqld.Bucket(sqld.Quote(createdColumn), width) + " AS bucket", sqld.Quote(createdColumn), sqld.Quote("rowid")}
+		for _, field := range q.Fields {
+			columns = append(columns, sqld.Quote(string(field)))
+		}
+		where, whereArgs := q.where(sqld, len(args))
+		args = append(args, whereArgs...)
+		return fmt.Sprintf(`(SELECT %s FROM %s%s) %s`, strings.Join(columns, ", "), sqld.Quote(string(q.Table)), where, alias)
+	}
+
+	columns := []string{"b.bucket"}
+	for _, field := range q.Fields {
+		column := "b." + sqld.Quote(string(field))
+		for _, agg := range q.Functions {
+			if agg != AggLast {
+				columns = append(columns, agg.sql(column))
+				continue
+			}
+			last := "l." + sqld.Quote(string(field))
+			columns = append(columns, fmt.Sprintf(`(SELECT %s FROM %s WHERE l.bucket = b.bucket AND %s IS NOT NULL ORDER BY l.%s DESC, l.%s DESC LIMIT 1)`,
+				last, inner("l"), last, sqld.Quote(createdColumn), sqld.Quote("rowid")))
+		}
+	}
+	//the outer table's placeholders come after those of any 'last' subqueries
+	r = fmt.Sprintf(`SELECT %s FROM %s GROUP BY b.bucket ORDER BY b.bucket`, strings.Join(columns, ", "), inner("b"))
+	if q.Limit > 0 {
+		r += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	return r + ";", args, nil
+}
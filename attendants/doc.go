@@ -19,5 +19,8 @@ Sub-package http provide a HTTP server that listens on a particular port
 and optionally requires a username/password via Basic Auth before forwarding
 data on.  Likewise, udp performs a similar service, but over UDP spockets.  It
 is planned to also have a ZMQv4 setup
+
+Sub-package mqtt subscribes to topics on a MQTT broker, and stores what is
+published to them.
 */
 package attendants
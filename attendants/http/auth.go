@@ -0,0 +1,151 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package http
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*credentials verifies a username and password*/
+type credentials interface {
+	check(user, pass string) bool
+}
+
+/*equal compares a and b in constant time, regardless of their lengths*/
+func equal(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+/*scheme returns the "$id$" or "{ID}" prefix naming the hash scheme of an htpasswd
+entry, or "" for a plaintext entry*/
+func scheme(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$"):
+		if i := strings.IndexByte(hash[1:], '$'); i >= 0 {
+			return hash[:i+2]
+		}
+	case strings.HasPrefix(hash, "{"):
+		if i := strings.IndexByte(hash, '}'); i >= 0 {
+			return hash[:i+1]
+		}
+	}
+	return ""
+}
+
+/*supported reports whether verify understands the scheme of hash*/
+func supported(hash string) bool {
+	switch scheme(hash) {
+	case "", "$2a$", "$2b$", "$2y$", "{SHA}":
+		return true
+	}
+	return false
+}
+
+/*verify checks pass against an htpasswd style hash: bcrypt ($2a$, $2b$ or $2y$),
+SHA1 ({SHA}) or, with no scheme prefix at all, plaintext.  Any other scheme
+($apr1$, {SSHA}, crypt's $1$ and so on) never matches*/
+func verify(hash, pass string) bool {
+	switch scheme(hash) {
+	case "$2a$", "$2b$", "$2y$":
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case "{SHA}":
+		return equal(hash, SHA1HashedPassword(pass))
+	case "":
+		return equal(hash, pass)
+	}
+	equal(hash, pass) //spend similar time on unsupported schemes
+	return false
+}
+
+/*single is a lone username and password*/
+type single struct {
+	user, pass string
+}
+
+func (s single) check(user, pass string) bool {
+	userOk, passOk := equal(s.user, user), equal(s.pass, pass)
+	return userOk && passOk
+}
+
+/*htpasswd checks against an htpasswd style file of "user:hash" lines, reloading
+it whenever it changes on disk*/
+type htpasswd struct {
+	path    string
+	logger  *log.Logger
+	mu      sync.Mutex
+	users   map[string]string //user -> hash
+	modtime time.Time
+	size    int64
+}
+
+/*newHtpasswd loads the file at path*/
+func newHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path, logger: log.New(os.Stdout, "[http] ", 0)}
+	return h, h.reload()
+}
+
+/*reload reads the file in again if it has changed since it was last read*/
+func (h *htpasswd) reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && info.ModTime().Equal(h.modtime) && info.Size() == h.size {
+		return nil
+	}
+
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			users[line[:i]] = line[i+1:]
+			if !supported(line[i+1:]) {
+				h.logger.Printf("%s: user %q uses the unsupported %s hash scheme and cannot log in", h.path, line[:i], scheme(line[i+1:]))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.users, h.modtime, h.size = users, info.ModTime(), info.Size()
+	return nil
+}
+
+func (h *htpasswd) check(user, pass string) bool {
+	h.reload() //on failure keep using what was last loaded
+	h.mu.Lock()
+	hash, ok := h.users[user]
+	h.mu.Unlock()
+	if !ok {
+		equal(user, pass) //spend similar time on unknown users
+		return false
+	}
+	return verify(hash, pass)
+}
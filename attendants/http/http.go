@@ -9,6 +9,11 @@ This file is part of the HomeHub project
 package http
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
@@ -19,12 +24,17 @@ import (
 	"github.com/tylerb/graceful"
 	"github.com/urfave/negroni"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/metrics"
 )
 
 //SHA1HashedPassword computes and returns a SHA1 hashed password string that can be used in HTTP Auth routines
@@ -43,42 +53,120 @@ type logger struct {
 func (l *logger) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	start := time.Now()
 	next(rw, r)
+	from := r.Host
+	if device := certDevice(r); device != "" {
+		from = fmt.Sprintf("%s (%s)", r.Host, device)
+	}
 	if res, ok := rw.(negroni.ResponseWriter); ok {
-		l.logger.Printf("%s %v from %v [%v %s] in %v", r.Method, r.URL.Path, r.Host, res.Status(), http.StatusText(res.Status()), time.Since(start))
+		l.logger.Printf("%s %v from %v [%v %s] in %v", r.Method, r.URL.Path, from, res.Status(), http.StatusText(res.Status()), time.Since(start))
 		return
 	}
-	l.logger.Printf("%s %v from %v in %v", r.Method, r.URL.Path, r.Host, time.Since(start))
+	l.logger.Printf("%s %v from %v in %v", r.Method, r.URL.Path, from, time.Since(start))
 
 }
 
 var _ = fmt.Println
 
 /*HTTPd is a HTTP based object that listens for incoming JSON messages
-via PUT or POST on / at the listening address.*/
+via PUT or POST on / at the listening address.  The body may be a single
+Datam, or a homehub.DatamBatch as a JSON array or newline delimited JSON.
+If the backend is a homehub.Reader, stored data can be read back via GET
+on /tables, /tables/{table} and /tables/{table}/rows, and summarized on
+/tables/{table}/aggregate if it is also a homehub.Aggregator.  If given a
+homehub.Hub, what is published to it is streamed live from /stream as
+Server-Sent Events and from /stream/ws over a WebSocket.  What has been
+received is counted, and served as JSON from GET /stats, while GET /metrics
+serves everything in metrics.Registry to Prometheus.  InfluxDB line protocol
+is accepted on POST /write, as InfluxDB itself would.*/
 type HTTPd struct {
 	httpd   *graceful.Server //stoppable server
 	mux     *mux.Router      //http router
 	negroni *negroni.Negroni //middelware
 	// regFxn, storeFxn homehub.RegStore //callback fxns
-	user    string           //http info
-	pass    string           //password
+	creds   credentials      //nil if no Basic Auth users
+	keys    homehub.KeyStore //nil if no bearer tokens
+	certs   *certs           //nil if serving plain HTTP
+	device  string           //field to tag with the certificate's device, if any
+	hup     chan os.Signal   //SIGHUP reloads certs
+	hub     *homehub.Hub     //nil if not streaming
+	done    chan struct{}    //closed by Stop, ending streams
+	maxBody int64            //largest request body accepted
 	stopper stoppable.Halter //atomic halter
 	backend homehub.Backend  //storage backend
-	stats   map[homehub.Alphabetic]int
+	stats   *homehub.Stats   //what has been received
 	logger  *logger
 }
 
+/*Config holds the settings for a HTTPd*/
+type Config struct {
+	Listen   string //listen address, eg ":8080"
+	User     string //Basic Auth username.  Empty string means disable
+	Password string //Basic Auth password
+	Htpasswd string //htpasswd style file of users; used in place of User and Password
+
+	Keys  homehub.KeyStore //if set, per-device bearer tokens are also accepted
+	Hub   *homehub.Hub     //if set, what is published to it is streamed from /stream and /stream/ws
+	Stats *homehub.Stats   //if set, counts are kept here, where other attendants may add theirs
+
+	MaxBody int64 //largest request body accepted, both as sent and decompressed.  0 means DefaultMaxBody
+
+	CertFile string //PEM certificate to serve HTTPS with.  Empty string means plain HTTP
+	KeyFile  string //PEM private key matching CertFile
+	ClientCA string //PEM CAs for client certificates.  A verified certificate's common name is the device
+
+	DeviceField homehub.Alphabetic //if set, what a client certificate sends carries its device in a string field of this name
+}
+
+/*DefaultMaxBody is the largest request body accepted unless Config.MaxBody says otherwise*/
+const DefaultMaxBody = 10 << 20
+
 /*Attendant returns a homehub.Attendant and a nil error*/
 func Attendant(listen, user, password string) (homehub.Attendant, error) {
 	return new(listen, user, password)
 }
 
+/*AttendantConfig returns a homehub.Attendant configured by cfg, and a nil error*/
+func AttendantConfig(cfg Config) (homehub.Attendant, error) {
+	return newConfig(cfg)
+}
+
 /*Use sets the backend*/
 func (h *HTTPd) Use(backend homehub.Backend) {
 	h.backend = backend
 }
 
 func new(listen, user, password string) (*HTTPd, error) {
+	return newConfig(Config{Listen: listen, User: user, Password: password})
+}
+
+func newConfig(cfg Config) (*HTTPd, error) {
+	var creds credentials
+	switch {
+	case cfg.Htpasswd != "":
+		file, err := newHtpasswd(cfg.Htpasswd)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load htpasswd file")
+		}
+		creds = file
+	case cfg.User != "" && cfg.Password != "":
+		creds = single{user: cfg.User, pass: cfg.Password}
+	}
+
+	var tlsCerts *certs
+	switch {
+	case cfg.CertFile != "" || cfg.KeyFile != "":
+		c, err := newCerts(cfg.CertFile, cfg.KeyFile, cfg.ClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load certificates")
+		}
+		tlsCerts = c
+	case cfg.ClientCA != "":
+		return nil, errors.New("Client certificates require a server certificate and key")
+	}
+	if cfg.DeviceField != "" && !cfg.DeviceField.Valid() {
+		return nil, fmt.Errorf("Unusable device field name %q", cfg.DeviceField)
+	}
+
 	err := make(chan error)
 	defer close(err)
 	recovery := negroni.NewRecovery()
@@ -93,34 +181,79 @@ func new(listen, user, password string) (*HTTPd, error) {
 		httpd: &graceful.Server{
 			Timeout: 100 * time.Millisecond, //no timeout, which has its own set of issues
 			Server: &http.Server{
-				Addr:           listen,
-				Handler:        neg,
+				Addr:           cfg.Listen,
 				ReadTimeout:    1 * time.Second,
 				WriteTimeout:   1 * time.Second,
 				MaxHeaderBytes: 1024 * 1024 * 1024 * 10, //10meg
 			},
 		},
-		user:  user,
-		pass:  SHA1HashedPassword(password),
-		stats: map[homehub.Alphabetic]int{},
+		creds:   creds,
+		keys:    cfg.Keys,
+		certs:   tlsCerts,
+		device:  string(cfg.DeviceField),
+		hup:     make(chan os.Signal, 1),
+		hub:     cfg.Hub,
+		done:    make(chan struct{}),
+		maxBody: cfg.MaxBody,
+		stats:   cfg.Stats,
+	}
+	if h.maxBody <= 0 {
+		h.maxBody = DefaultMaxBody
+	}
+	if h.stats == nil {
+		h.stats = homehub.NewStats()
 	}
 	h.mux.HandleFunc("/", h.put).Methods("PUT")
 	h.mux.HandleFunc("/", h.post).Methods("POST")
-	h.mux.HandleFunc("/", h.get).Methods("GET") //Version info eventually?
-	if password != "" && h.user != "" {
-		h.logger.logger.Printf("Using Password %s:%s\n", h.user, h.pass)
+	h.mux.HandleFunc("/", h.statistics).Methods("GET") //Version info eventually?
+	h.mux.HandleFunc("/stats", h.statistics).Methods("GET")
+	h.mux.Handle("/metrics", metrics.Handler()).Methods("GET")
+	h.mux.HandleFunc("/write", h.write).Methods("POST")
+	h.mux.HandleFunc("/ping", h.ping).Methods("GET", "HEAD")
+	h.mux.HandleFunc("/tables", h.tables).Methods("GET")
+	h.mux.HandleFunc("/tables/{table}", h.schema).Methods("GET")
+	h.mux.HandleFunc("/tables/{table}/rows", h.rows).Methods("GET")
+	h.mux.HandleFunc("/tables/{table}/aggregate", h.aggregate).Methods("GET")
+	h.mux.HandleFunc("/stream", h.stream).Methods("GET")
+	h.mux.HandleFunc("/stream/ws", h.websocket).Methods("GET")
+	h.negroni.UseFunc(h.measure)
+	if h.creds != nil || h.keys != nil || cfg.ClientCA != "" {
 		h.negroni.UseFunc(h.auth)
 	}
 	h.negroni.UseHandler(h.mux)
+	h.httpd.Server.Handler = http.HandlerFunc(h.serveHTTP) //in front of all middleware
+
+	if h.certs != nil {
+		signal.Notify(h.hup, syscall.SIGHUP)
+		go h.reload()
+	}
 
 	go h.monitor(err)
 	return h, <-err
 }
 
+/*reload reloads the certificates on every SIGHUP until Stop is called*/
+func (h *HTTPd) reload() {
+	for range h.hup {
+		if err := h.certs.reload(); err != nil {
+			h.logger.logger.Printf("Unable to reload certificates, keeping the old ones: %v", err)
+			continue
+		}
+		h.logger.logger.Printf("Reloaded certificates")
+	}
+}
+
 /*monitor starts the HTTP server and attempts to keep it going*/
 func (h *HTTPd) monitor(startup chan error) {
 	ecc := make(chan error)
-	go func() { ecc <- h.httpd.ListenAndServe(); close(ecc) }() //start daemon
+	go func() { //start daemon
+		if h.certs != nil {
+			ecc <- h.httpd.ListenAndServeTLSConfig(h.certs.config())
+		} else {
+			ecc <- h.httpd.ListenAndServe()
+		}
+		close(ecc)
+	}()
 
 	select {
 	case <-time.After(100 * time.Millisecond):
@@ -134,6 +267,11 @@ func (h *HTTPd) monitor(startup chan error) {
 func (h *HTTPd) Stop() {
 	defer h.stopper.Die()
 	if h.stopper.Alive() {
+		close(h.done)
+		if h.certs != nil {
+			signal.Stop(h.hup)
+			close(h.hup)
+		}
 		c := h.httpd.StopChan()
 		go func() { h.httpd.Stop(100 * time.Millisecond) }()
 		<-c
@@ -141,61 +279,335 @@ func (h *HTTPd) Stop() {
 	return
 }
 
-/*fill in with basic authentication validator*/
+/*auth is a client certificate, bearer token and basic authentication validator.
+Requests from a device with an API key carry the homehub.APIKey in their context.
+A verified client certificate alone grants full access unless API keys are in use,
+in which case the device named by the certificate needs a key.*/
 func (h *HTTPd) auth(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	if _, _, ok := r.BasicAuth(); ok {
+	if device := certDevice(r); device != "" {
+		if h.keys == nil {
+			next(w, r)
+			return
+		}
+		key, err := h.keys.DeviceKey(device)
+		if err == nil {
+			next(w, r.WithContext(context.WithValue(r.Context(), keyContext, key)))
+			return
+		}
+		h.logger.logger.Printf("Rejected certificate for %q from %v: %v", device, r.RemoteAddr, err)
+	}
+
+	if token := bearer(r); token != "" && h.keys != nil {
+		key, err := h.keys.LookupKey(token)
+		if err == nil {
+			next(w, r.WithContext(context.WithValue(r.Context(), keyContext, key)))
+			return
+		}
+		h.logger.logger.Printf("Rejected API key from %v: %v", r.RemoteAddr, err)
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if ok && h.creds != nil && h.creds.check(user, pass) {
 		next(w, r)
 		return
 	}
+	if ok {
+		h.logger.logger.Printf("Failed login for %q from %v", user, r.RemoteAddr)
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="homehub"`)
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
+type contextKey int
+
+/*keyContext is the request context key of the homehub.APIKey used*/
+const keyContext contextKey = iota
+
+/*bearer returns the bearer token of the request, if any*/
+func bearer(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+var errForbidden = errors.New("API key does not permit this operation on this table")
+
+/*permit returns errForbidden if the request was made with an API key that
+does not allow perm on table*/
+func permit(r *http.Request, perm homehub.Permission, table homehub.Alphabetic) error {
+	if key, ok := r.Context().Value(keyContext).(homehub.APIKey); ok && !key.Allows(table, perm) {
+		return errForbidden
+	}
+	return nil
+}
+
 var errHTTP = errors.New("Invalid HTTP data")
-var errNotValid = errors.New("Invalid JSON Structure")
+var errTooLarge = errors.New("Request body too large")
+var errEncoding = errors.New("Unsupported Content-Encoding, must be gzip, deflate or identity")
+var errNotValid = homehub.ErrInvalid
+
+/*batchRegStore either registers or stores a whole DatamBatch with a backend*/
+type batchRegStore func(homehub.Backend, homehub.DatamBatch) []error
+
+/*batchResult is the per entry outcome of a batch returned to the client*/
+type batchResult struct {
+	Index    int                         `json:"index"`
+	Table    homehub.Alphabetic          `json:"table,omitempty"`
+	Ok       bool                        `json:"ok"`
+	Error    string                      `json:"error,omitempty"`
+	Problems []homehub.ValidationProblem `json:"problems,omitempty"`
+}
+
+/*errorResponse is returned to the client when a request fails*/
+type errorResponse struct {
+	Error    string                      `json:"error"`
+	Problems []homehub.ValidationProblem `json:"problems,omitempty"`
+}
+
+/*problems returns the validation problems behind err, if any*/
+func problems(err error) []homehub.ValidationProblem {
+	verr := &homehub.ValidationError{}
+	if errors.As(err, &verr) {
+		return verr.Problems
+	}
+	return nil
+}
+
+/*fail reports err back to the client as JSON*/
+func (h *HTTPd) fail(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error(), Problems: problems(err)})
+}
+
+/*readCapped reads all of r, or errTooLarge if there is more than max bytes*/
+func readCapped(r io.Reader, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
+
+/*body reads in the request body, which may be chunked, and decompresses it if it
+has a gzip or deflate Content-Encoding.  Both the body as sent and as decompressed
+are limited to maxBody bytes.*/
+func (h *HTTPd) body(r *http.Request) ([]byte, error) {
+	if r.ContentLength > h.maxBody {
+		return nil, errTooLarge
+	}
+	raw, err := readCapped(r.Body, h.maxBody)
+	switch {
+	case err == errTooLarge:
+		return nil, err
+	case err != nil, r.ContentLength >= 0 && int64(len(raw)) != r.ContentLength:
+		return nil, errHTTP
+	}
+
+	var decoded io.Reader
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return raw, nil
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(bytes.NewReader(raw))
+	case "deflate":
+		//properly zlib wrapped, but some clients send a bare deflate stream
+		if decoded, err = zlib.NewReader(bytes.NewReader(raw)); err != nil {
+			decoded, err = flate.NewReader(bytes.NewReader(raw)), nil
+		}
+	default:
+		return nil, errEncoding
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errHTTP, err)
+	}
+	data, err := readCapped(decoded, h.maxBody)
+	switch {
+	case err == errTooLarge:
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("%w: %v", errHTTP, err)
+	}
+	return data, nil
+}
 
 /*handleJSON breaks up json data*/
 func (h *HTTPd) handleJSON(r *http.Request, fxn homehub.RegStore) error {
-	data := make([]byte, r.ContentLength)
-	if n, err := r.Body.Read(data); int64(n) != r.ContentLength || (err != nil && err != io.EOF) {
-		return errHTTP
+	data, err := h.body(r)
+	if err != nil {
+		return err
+	}
+	return h.handleDatam(data, fxn)
+}
+
+/*record counts a datam of size bytes received for table, where err is what became
+of it and rejected says whether err was the client's doing rather than the backend's*/
+func (h *HTTPd) record(table homehub.Alphabetic, err error, rejected bool, size int) {
+	outcome := homehub.StatAccepted
+	switch {
+	case err != nil && rejected:
+		outcome = homehub.StatRejected
+	case err != nil:
+		outcome = homehub.StatFailed
+	}
+	if !table.Valid() {
+		table = ""
 	}
-	m := homehub.Datam{}
+	h.stats.Record("http", table, outcome, size)
+}
 
-	if err := json.Unmarshal(data, &m); err != nil {
+/*handleDatam decodes a single datam and passes it on to fxn*/
+func (h *HTTPd) handleDatam(data []byte, fxn homehub.RegStore) error {
+	m, err := homehub.DecodeDatam(data)
+	if err != nil {
+		h.record(m.Table, err, true, len(data))
 		return err
 	}
+	e := fxn(m)
+	h.record(m.Table, e, e == errForbidden, len(data))
+	return e
+}
+
+/*handleBatch decodes a batch, passes the valid and permitted entries to fxn,
+and reports back on how each entry fared*/
+func (h *HTTPd) handleBatch(w http.ResponseWriter, data []byte, permitted func(homehub.Alphabetic) error, fxn batchRegStore) {
+	batch, errs, err := homehub.DecodeBatch(data)
+	if err != nil {
+		h.record("", err, true, len(data))
+		h.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	valid, index, rejected := homehub.DatamBatch{}, []int{}, make([]bool, len(batch))
+	for i, datam := range batch {
+		if errs[i] == nil {
+			errs[i] = permitted(datam.Table)
+		}
+		if errs[i] == nil {
+			valid, index = append(valid, datam), append(index, i)
+			continue
+		}
+		rejected[i] = true
+	}
+	if len(valid) > 0 {
+		for j, e := range fxn(h.backend, valid) {
+			errs[index[j]] = e
+		}
+	}
 
-	if m.Valid() {
-    e := fxn(m)
-    if e == nil {
-      h.stats[m.Table]++
-    }
-		return e
+	code, results := http.StatusOK, make([]batchResult, len(batch))
+	for i, datam := range batch {
+		h.record(datam.Table, errs[i], rejected[i], homehub.Share(len(data), len(batch), i))
+		results[i] = batchResult{Index: i, Table: datam.Table, Ok: errs[i] == nil}
+		if errs[i] != nil {
+			code, results[i].Error, results[i].Problems = http.StatusBadRequest, errs[i].Error(), problems(errs[i])
+		}
 	}
-	return errNotValid
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(results)
+}
 
+/*ingest reads the body of a request sending data, counting it as rejected if it
+cannot be read*/
+func (h *HTTPd) ingest(r *http.Request) ([]byte, error) {
+	data, err := h.body(r)
+	if err != nil {
+		size := int(r.ContentLength)
+		if size < 0 {
+			size = 0
+		}
+		h.record("", err, true, size)
+	}
+	return data, err
 }
 
-/*put handles incoming data formats to register*/
-func (h *HTTPd) put(w http.ResponseWriter, r *http.Request) {
-	if err := h.handleJSON(r, h.backend.Register); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+/*status returns the status code reporting an error from handle*/
+func status(err error) int {
+	switch {
+	case err == errForbidden:
+		return http.StatusForbidden
+	case err == errTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case err == errEncoding:
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+/*tag sets the device field of datam to the device named by the request's client
+certificate, replacing whatever the device sent in it.  datam is left alone if no
+device field is configured or there is no certificate.*/
+func (h *HTTPd) tag(r *http.Request, datam homehub.Datam) homehub.Datam {
+	device := certDevice(r)
+	if h.device == "" || device == "" {
+		return datam
+	}
+	if datam.Data == nil {
+		datam.Data = map[homehub.Alphabetic]homehub.Field{}
+	}
+	datam.Data[homehub.Alphabetic(h.device)], _ = homehub.NewField(homehub.ModeString, device)
+	return datam
+}
+
+/*handle accepts either a single datam or a batch of them, provided the
+request is permitted to perform perm on their tables*/
+func (h *HTTPd) handle(w http.ResponseWriter, r *http.Request, perm homehub.Permission, fxn homehub.RegStore, batchFxn batchRegStore) {
+	permitted := func(table homehub.Alphabetic) error { return permit(r, perm, table) }
+	data, err := h.ingest(r)
+	if err == nil && homehub.IsBatch(data) {
+		h.handleBatch(w, data, permitted, func(be homehub.Backend, batch homehub.DatamBatch) []error {
+			for i := range batch {
+				batch[i] = h.tag(r, batch[i])
+			}
+			return batchFxn(be, batch)
+		})
+		return
+	}
+	if err == nil {
+		err = h.handleDatam(data, func(datam homehub.Datam) error {
+			if err := permitted(datam.Table); err != nil {
+				return err
+			}
+			return fxn(h.tag(r, datam))
+		})
+	}
+	if err != nil {
+		h.fail(w, status(err), err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+/*put handles incoming data formats to register*/
+func (h *HTTPd) put(w http.ResponseWriter, r *http.Request) {
+	h.handle(w, r, homehub.PermRegister, h.backend.Register, homehub.RegisterBatch)
+}
+
 /*post handles 'inserting' actual data*/
 func (h *HTTPd) post(w http.ResponseWriter, r *http.Request) {
-	if err := h.handleJSON(r, h.backend.Store); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
+	h.handle(w, r, homehub.PermStore, h.backend.Store, homehub.StoreBatch)
 }
 
-/*get handles returning some stats*/
-func (h *HTTPd) get(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(200)
-	fmt.Fprintf(w, "Stats: %v", h.stats)
+/*statistics handles GET /stats, replying with what has been received by table
+and by attendant, leaving out tables the request may not read*/
+func (h *HTTPd) statistics(w http.ResponseWriter, r *http.Request) {
+	snap := h.stats.Snapshot()
+	for table := range snap.Tables {
+		if permit(r, 0, table) != nil {
+			delete(snap.Tables, table)
+		}
+	}
+	for _, as := range snap.Attendants {
+		for table := range as.Tables {
+			if permit(r, 0, table) != nil {
+				delete(as.Tables, table)
+			}
+		}
+	}
+	h.reply(w, snap)
 }
@@ -9,11 +9,34 @@ This file is part of the HomeHub project
 package http
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/npotts/homehub"
 )
@@ -83,13 +106,66 @@ func TestHTTP_Auth(t *testing.T) {
 
 	w = httptest.NewRecorder()
 	req, _ := http.NewRequest("PUT", fmt.Sprintf("http://%s/", listen), strings.NewReader(""))
-	req.SetBasicAuth(h.user, h.pass)
+	req.SetBasicAuth(user, "wrong")
+	h.auth(w, req, next)
+	if w.Code != http.StatusUnauthorized || accessed {
+		t.Errorf("Should reject a bad password: [%d] next() called: %v ", w.Code, accessed)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("http://%s/", listen), strings.NewReader(""))
+	req.SetBasicAuth(user, password)
 	h.auth(w, req, next)
 	if !accessed {
 		t.Errorf("Did not call next function")
 	}
 }
 
+func TestHTTP_Htpasswd(t *testing.T) {
+	bcrypted, _ := bcrypt.GenerateFromPassword([]byte("bpass"), bcrypt.MinCost)
+	file, e := ioutil.TempFile("", "htpasswd")
+	if e != nil {
+		t.Fatalf("Unable to create htpasswd: %v", e)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprintf(file, "# comment\nbuser:%s\nsuser:%s\npuser:ppass\n", bcrypted, SHA1HashedPassword("spass"))
+	fmt.Fprintf(file, "auser:$apr1$salt$hash\nxuser:{SSHA}hash\ncuser:$1$salt$hash\n")
+	file.Close()
+
+	creds, e := newHtpasswd(file.Name())
+	if e != nil {
+		t.Fatalf("Unable to load htpasswd: %v", e)
+	}
+	checks := map[[2]string]bool{
+		{"buser", "bpass"}:           true,
+		{"suser", "spass"}:           true,
+		{"puser", "ppass"}:           true,
+		{"buser", "spass"}:           false,
+		{"suser", "wrong"}:           false,
+		{"puser", ""}:                false,
+		{"nouser", "ppass"}:          false,
+		{"auser", "$apr1$salt$hash"}: false,
+		{"xuser", "{SSHA}hash"}:      false,
+		{"cuser", "$1$salt$hash"}:    false,
+	}
+	for c, ok := range checks {
+		if creds.check(c[0], c[1]) != ok {
+			t.Errorf("With %v, expected %v", c, ok)
+		}
+	}
+
+	//rewrite the file and make sure it is picked up
+	ioutil.WriteFile(file.Name(), []byte("newuser:newpass\n"), 0600)
+	os.Chtimes(file.Name(), time.Now(), time.Now().Add(time.Minute))
+	if !creds.check("newuser", "newpass") || creds.check("puser", "ppass") {
+		t.Errorf("Did not reload the htpasswd file")
+	}
+
+	if _, e := newConfig(Config{Listen: listen, Htpasswd: "/does/not/exist"}); e == nil {
+		t.Errorf("Should fail with a missing htpasswd file")
+	}
+}
+
 func TestHTTP_handleJSON(t *testing.T) {
 	h, e := getter()
 	if e != nil {
@@ -117,7 +193,7 @@ func TestHTTP_handleJSON(t *testing.T) {
 	reqForX := func(x x) *http.Request {
 		called = false
 		r, _ := http.NewRequest(x.method, fmt.Sprintf("http://%s%s", listen, x.route), strings.NewReader(x.json))
-		r.SetBasicAuth(h.user, h.pass)
+		r.SetBasicAuth(user, password)
 		if x.length > 0 {
 			r.ContentLength = x.length
 		}
@@ -133,11 +209,91 @@ func TestHTTP_handleJSON(t *testing.T) {
 
 	for i, x := range tests {
 		t.Logf("Running check #%d", i)
-		if e := h.handleJSON(reqForX(x), callback); e != x.err {
+		if e := h.handleJSON(reqForX(x), callback); (e == nil) != (x.err == nil) || (e != nil && !errors.Is(e, x.err)) {
 			t.Logf(" Got:%v", e)
 			t.Logf("Want:%v", x.err)
 			t.Errorf("Errored out")
 		}
+		if called != (x.err == nil) {
+			t.Errorf("Callback called: %v", called)
+		}
+	}
+}
+
+func TestHTTP_body(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+	h.maxBody = 1024
+
+	payload := `{"table":"table", "data": {"field": 1.0}}`
+	compress := func(encoding, s string) string {
+		buf := &bytes.Buffer{}
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(buf)
+		case "deflate":
+			w = zlib.NewWriter(buf)
+		case "raw":
+			w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+		}
+		io.WriteString(w, s)
+		w.Close()
+		return buf.String()
+	}
+
+	type x struct {
+		encoding string
+		body     string
+		chunked  bool
+		err      error
+	}
+	tests := []x{
+		x{body: payload},
+		x{body: payload, chunked: true},
+		x{encoding: "identity", body: payload},
+		x{encoding: "gzip", body: compress("gzip", payload)},
+		x{encoding: "x-gzip", body: compress("gzip", payload), chunked: true},
+		x{encoding: "deflate", body: compress("deflate", payload)},
+		x{encoding: "deflate", body: compress("raw", payload)},
+		x{encoding: "br", body: payload, err: errEncoding},
+		x{encoding: "gzip", body: payload, err: errHTTP},
+		x{body: strings.Repeat(" ", 1025) + payload, err: errTooLarge},
+		x{body: strings.Repeat(" ", 1025) + payload, chunked: true, err: errTooLarge},
+		x{encoding: "gzip", body: compress("gzip", strings.Repeat(" ", 4096)+payload), err: errTooLarge},
+	}
+	for i, x := range tests {
+		r, _ := http.NewRequest("PUT", fmt.Sprintf("http://%s/", listen), strings.NewReader(x.body))
+		if x.chunked {
+			r.ContentLength = -1
+		}
+		if x.encoding != "" {
+			r.Header.Set("Content-Encoding", x.encoding)
+		}
+		data, e := h.body(r)
+		if (e == nil) != (x.err == nil) || (e != nil && !errors.Is(e, x.err)) {
+			t.Errorf("#%d: got %v, wanted %v", i, e, x.err)
+			continue
+		}
+		if e == nil && string(data) != payload {
+			t.Errorf("#%d: got body %q", i, data)
+		}
+	}
+
+	//and the status codes they lead to
+	codes := map[string]int{"gzip": http.StatusOK, "br": http.StatusUnsupportedMediaType, "": http.StatusRequestEntityTooLarge}
+	for encoding, code := range codes {
+		body := map[string]string{"gzip": compress("gzip", payload), "br": payload, "": strings.Repeat(" ", 2048) + payload}[encoding]
+		r, _ := http.NewRequest("PUT", fmt.Sprintf("http://%s/", listen), strings.NewReader(body))
+		r.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		h.handle(w, r, homehub.PermStore, func(homehub.Datam) error { return nil }, nil)
+		if w.Code != code {
+			t.Errorf("With Content-Encoding %q, got %d, wanted %d", encoding, w.Code, code)
+		}
 	}
 }
 
@@ -159,8 +315,8 @@ func TestHTTP_putpost(t *testing.T) {
 			t.Error(e)
 			t.FailNow()
 		}
-		put.SetBasicAuth(h.user, h.pass)
-		post.SetBasicAuth(h.user, h.pass)
+		put.SetBasicAuth(user, password)
+		post.SetBasicAuth(user, password)
 		return
 	}
 	process := func(body string, code int) {
@@ -178,5 +334,691 @@ func TestHTTP_putpost(t *testing.T) {
 
 	process(good, 200)
 	process(bad, http.StatusBadRequest)
+	process(`[`+good+`,`+good+`]`, 200)
+	process(good+"\n"+good+"\n", 200)
+	process(`[`+good+`, {"table":"table", "data": {"field": [1]}}]`, http.StatusBadRequest)
 	// <-time.After(200 * time.Second)
 }
+
+func TestHTTP_handleBatch(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+
+	stored := homehub.DatamBatch{}
+	batchFxn := func(be homehub.Backend, batch homehub.DatamBatch) []error {
+		stored = append(stored, batch...)
+		return make([]error, len(batch))
+	}
+
+	w := httptest.NewRecorder()
+	h.handleBatch(w, []byte(`[{"table":"a", "data": {"field": 1.0}}, {"table":"b c", "data": {}}, {"table":"d", "data": {"field": 2}}]`), func(homehub.Alphabetic) error { return nil }, batchFxn)
+	if w.Code != http.StatusBadRequest || len(stored) != 2 {
+		t.Errorf("Expected partial failure: %d, stored %d", w.Code, len(stored))
+	}
+	results := []batchResult{}
+	if e := json.Unmarshal(w.Body.Bytes(), &results); e != nil || len(results) != 3 {
+		t.Fatalf("Unable to decode results: %v: %s", e, w.Body.String())
+	}
+	if !results[0].Ok || results[1].Ok || results[1].Error == "" || !results[2].Ok || results[2].Table != "d" {
+		t.Errorf("Per entry results do not match: %+v", results)
+	}
+	if len(results[1].Problems) != 1 || results[1].Problems[0].Table != "b c" {
+		t.Errorf("Expected the bad table name to be reported: %+v", results[1])
+	}
+}
+
+func TestHTTP_validationErrors(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/", listen), strings.NewReader(`{"table":"table", "data": {"good": 1, "bad field": 2, "also_bad": 3}}`))
+	h.post(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad request: %d", w.Code)
+	}
+	resp := errorResponse{}
+	if e := json.Unmarshal(w.Body.Bytes(), &resp); e != nil {
+		t.Fatalf("Unable to decode response %q: %v", w.Body.String(), e)
+	}
+	if resp.Error == "" || len(resp.Problems) != 2 || resp.Problems[0].Field != "also_bad" || resp.Problems[1].Field != "bad field" {
+		t.Errorf("Response does not list each bad field: %+v", resp)
+	}
+
+	//a value that cannot be converted is listed alongside the other problems
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", fmt.Sprintf("http://%s/", listen), strings.NewReader(`{"table":"t","data":{"bad name":1,"x":[1]}}`))
+	h.post(w, r)
+	resp = errorResponse{}
+	if e := json.Unmarshal(w.Body.Bytes(), &resp); e != nil || w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad request, got %d %q: %v", w.Code, w.Body.String(), e)
+	}
+	if len(resp.Problems) != 2 || resp.Problems[0].Field != "bad name" || resp.Problems[1].Field != "x" || !strings.Contains(resp.Error, `"x"`) {
+		t.Errorf("Response does not list the unconvertible field: %+v", resp)
+	}
+}
+
+type fakeKeys map[string]homehub.APIKey
+
+func (f fakeKeys) CreateKey(key homehub.APIKey) (string, error) { return "", nil }
+func (f fakeKeys) LookupKey(token string) (homehub.APIKey, error) {
+	if key, ok := f[token]; ok {
+		return key, nil
+	}
+	return homehub.APIKey{}, homehub.ErrUnknownKey
+}
+func (f fakeKeys) DeviceKey(device string) (homehub.APIKey, error) {
+	for _, key := range f {
+		if key.Device == device {
+			return key, nil
+		}
+	}
+	return homehub.APIKey{}, homehub.ErrUnknownKey
+}
+func (f fakeKeys) RevokeKey(device string) error       { return nil }
+func (f fakeKeys) ListKeys() ([]homehub.APIKey, error) { return nil, nil }
+
+func TestHTTP_APIKeys(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+	h.keys = fakeKeys{
+		"garage": {Device: "garage", Tables: []string{"garage*"}, Perms: homehub.PermStore},
+		"attic":  {Device: "attic", Tables: []string{"attic"}, Perms: homehub.PermBoth},
+	}
+
+	do := func(method, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		h.negroni.ServeHTTP(w, r)
+		return w
+	}
+	garage, attic := `{"table":"garageA", "data": {"temp": 1.0}}`, `{"table":"attic", "data": {"temp": 1.0}}`
+
+	checks := []struct {
+		method, token, body string
+		code                int
+	}{
+		{"POST", "garage", garage, http.StatusOK},
+		{"PUT", "garage", garage, http.StatusForbidden},
+		{"POST", "garage", attic, http.StatusForbidden},
+		{"PUT", "attic", attic, http.StatusOK},
+		{"POST", "nope", attic, http.StatusUnauthorized},
+		{"POST", "garage", `[` + garage + `,` + attic + `]`, http.StatusBadRequest},
+	}
+	for _, c := range checks {
+		if w := do(c.method, c.token, c.body); w.Code != c.code {
+			t.Errorf("%s %s with %q: expected %d, got %d: %s", c.method, c.body, c.token, c.code, w.Code, w.Body.String())
+		}
+	}
+
+	results := []batchResult{}
+	json.NewDecoder(do("POST", "garage", `[`+garage+`,`+attic+`]`).Body).Decode(&results)
+	if len(results) != 2 || !results[0].Ok || results[1].Ok {
+		t.Errorf("Only the forbidden batch entry should fail: %+v", results)
+	}
+}
+
+/*pemCert issues a certificate for cn signed by parent (self signed if nil),
+writing the certificate and key to files in dir*/
+func pemCert(t *testing.T, dir, name, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if e != nil {
+		t.Fatalf("Unable to create certificate: %v", e)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestHTTP_TLS(t *testing.T) {
+	dir, e := ioutil.TempDir("", "certs")
+	if e != nil {
+		t.Fatalf("Unable to create temp dir: %v", e)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := pemCert(t, dir, "ca", "homehub CA", nil, nil)
+	pemCert(t, dir, "server", "localhost", ca, caKey)
+	garage, _ := pemCert(t, dir, "garage", "garage", ca, caKey)
+	pemCert(t, dir, "rogue", "garage", nil, nil)
+
+	if _, e := newConfig(Config{Listen: listen, ClientCA: filepath.Join(dir, "ca.crt")}); e == nil {
+		t.Errorf("Should not accept a client CA without a server certificate")
+	}
+	h, e := newConfig(Config{
+		Listen:   listen,
+		User:     user,
+		Password: password,
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		ClientCA: filepath.Join(dir, "ca.crt"),
+	})
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+	h.Use(faker)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := func(name string) *http.Client {
+		cfg := &tls.Config{RootCAs: roots}
+		if name != "" {
+			cert, e := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+			if e != nil {
+				t.Fatalf("Unable to load client certificate: %v", e)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+	}
+	url := fmt.Sprintf("https://localhost%s/", listen)
+	post := func(c *http.Client, basic bool) int {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(`{"table":"garage", "data": {"temp": 1.0}}`))
+		if basic {
+			req.SetBasicAuth(user, password)
+		}
+		r, e := c.Do(req)
+		if e != nil {
+			return 0
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	if code := post(client("garage"), false); code != http.StatusOK {
+		t.Errorf("Client certificate should be accepted: %d", code)
+	}
+	if code := post(client(""), false); code != http.StatusUnauthorized {
+		t.Errorf("No credentials should be rejected: %d", code)
+	}
+	if code := post(client(""), true); code != http.StatusOK {
+		t.Errorf("Basic Auth should still work over TLS: %d", code)
+	}
+	if code := post(client("rogue"), false); code == http.StatusOK {
+		t.Errorf("Certificate from an unknown CA should be rejected")
+	}
+
+	h.keys = fakeKeys{"token": {Device: "garage", Tables: []string{"attic"}, Perms: homehub.PermStore}}
+	if code := post(client("garage"), false); code != http.StatusForbidden {
+		t.Errorf("Device key should limit what the certificate allows: %d", code)
+	}
+	h.keys = nil
+
+	//what a certificate sends can be tagged with its device
+	if _, e := newConfig(Config{Listen: listen, DeviceField: "bad field"}); e == nil {
+		t.Errorf("Should not accept an invalid device field")
+	}
+	req := httptest.NewRequest("POST", url, nil)
+	datam := homehub.Datam{Table: "garage", Data: map[homehub.Alphabetic]homehub.Field{}}
+	if tagged := h.tag(req, datam); len(tagged.Data) != 0 {
+		t.Errorf("Should not tag unless asked to: %+v", tagged)
+	}
+	h.device = "device"
+	if tagged := h.tag(req, datam); len(tagged.Data) != 0 {
+		t.Errorf("Should not tag without a certificate: %+v", tagged)
+	}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{garage}}}
+	if tagged := h.tag(req, homehub.Datam{Table: "garage"}); tagged.Data["device"].Value != "garage" {
+		t.Errorf("Should tag with the certificate's device: %+v", tagged)
+	}
+	h.device = ""
+
+	//issue a new server certificate and make sure SIGHUP picks it up
+	renewed, _ := pemCert(t, dir, "server", "localhost", ca, caKey)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	for i := 0; i < 50; i++ {
+		conn, e := tls.Dial("tcp", "localhost"+listen, &tls.Config{RootCAs: roots})
+		if e == nil {
+			serial := conn.ConnectionState().PeerCertificates[0].SerialNumber
+			conn.Close()
+			if serial.Cmp(renewed.SerialNumber) == 0 {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Did not reload the server certificate on SIGHUP")
+}
+
+type fakeReader struct {
+	fake
+	query homehub.Query
+}
+
+func (f *fakeReader) Tables() ([]homehub.Alphabetic, error) {
+	return []homehub.Alphabetic{"attic", "garage"}, nil
+}
+func (f *fakeReader) Schema(table homehub.Alphabetic) ([]homehub.Column, error) {
+	if table != "attic" {
+		return nil, homehub.ErrUnknownTable
+	}
+	return []homehub.Column{{Name: "rowid", Mode: homehub.ModePrimaryKey}, {Name: "temp", Mode: homehub.ModeFloat}}, nil
+}
+func (f *fakeReader) Rows(q homehub.Query) ([]homehub.Datam, error) {
+	f.query = q
+	if q.Table != "attic" {
+		return nil, homehub.ErrUnknownTable
+	}
+	if len(q.Fields) > 0 && q.Fields[0] != "temp" {
+		return nil, homehub.ErrUnknownField
+	}
+	return []homehub.Datam{homehub.GoodSample}, nil
+}
+
+func TestHTTP_read(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			r.SetBasicAuth(user, password)
+		}
+		h.negroni.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("/tables", ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("Backend without a Reader should not be readable: %d", w.Code)
+	}
+
+	rd := &fakeReader{}
+	h.Use(rd)
+	defer h.Use(faker)
+	checks := map[string]int{
+		"/tables":                           http.StatusOK,
+		"/tables/attic":                     http.StatusOK,
+		"/tables/nothere":                   http.StatusNotFound,
+		"/tables/bad_name":                  http.StatusNotFound,
+		"/tables/attic/rows":                http.StatusOK,
+		"/tables/attic/rows?fields=nope":    http.StatusBadRequest,
+		"/tables/attic/rows?from=yesterday": http.StatusBadRequest,
+		"/tables/attic/rows?limit=-1":       http.StatusBadRequest,
+	}
+	for path, code := range checks {
+		if w := get(path, ""); w.Code != code {
+			t.Errorf("GET %s: expected %d, got %d: %s", path, code, w.Code, w.Body.String())
+		}
+	}
+	get("/tables/attic/rows?from=1451606400&limit=5", "")
+	if rd.query.Limit != 5 || !rd.query.From.Equal(time.Unix(1451606400, 0)) || !rd.query.To.IsZero() {
+		t.Errorf("Query not formed from parameters: %+v", rd.query)
+	}
+	get("/tables/attic/rows?fields=temp,humidity&to=2016-01-01T00:00:00Z", "")
+	if rd.query.Limit != defaultLimit || len(rd.query.Fields) != 2 || rd.query.Fields[1] != "humidity" || rd.query.To.IsZero() {
+		t.Errorf("Query not formed from parameters: %+v", rd.query)
+	}
+
+	rows := []homehub.Datam{}
+	if e := json.NewDecoder(get("/tables/attic/rows", "").Body).Decode(&rows); e != nil || len(rows) != 1 || rows[0].Table != "test" {
+		t.Errorf("Unexpected rows: %v %v", rows, e)
+	}
+	schema := tableSchema{}
+	if e := json.NewDecoder(get("/tables/attic", "").Body).Decode(&schema); e != nil || len(schema.Columns) != 2 || schema.Table != "attic" {
+		t.Errorf("Unexpected schema: %+v %v", schema, e)
+	}
+
+	h.keys = fakeKeys{"garage": {Device: "garage", Tables: []string{"garage*"}, Perms: homehub.PermStore}}
+	defer func() { h.keys = nil }()
+	tables := []homehub.Alphabetic{}
+	if e := json.NewDecoder(get("/tables", "garage").Body).Decode(&tables); e != nil || len(tables) != 1 || tables[0] != "garage" {
+		t.Errorf("API key should only list its own tables: %v %v", tables, e)
+	}
+	if w := get("/tables/attic/rows", "garage"); w.Code != http.StatusForbidden {
+		t.Errorf("API key should not read other tables: %d", w.Code)
+	}
+}
+
+func (f *fakeReader) Aggregate(q homehub.AggregateQuery) ([]homehub.Bucket, error) {
+	f.query = q.Query
+	if len(q.Functions) == 0 || q.Bucket < time.Second {
+		return nil, homehub.ErrInvalidQuery
+	}
+	return []homehub.Bucket{{Start: time.Unix(0, 0), Data: map[homehub.Alphabetic]map[homehub.Aggregate]homehub.Field{}}}, nil
+}
+
+func TestHTTP_aggregate(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+	h.Use(&fakeReader{})
+	defer h.Use(faker)
+
+	checks := map[string]int{
+		"/tables/attic/aggregate?bucket=1h":                        http.StatusOK,
+		"/tables/attic/aggregate?bucket=1h&functions=min,max,last": http.StatusOK,
+		"/tables/attic/aggregate?bucket=1h&functions=median":       http.StatusBadRequest,
+		"/tables/attic/aggregate?bucket=10ms":                      http.StatusBadRequest,
+		"/tables/attic/aggregate":                                  http.StatusBadRequest,
+		"/tables/attic/aggregate?bucket=1h&from=yesterday":         http.StatusBadRequest,
+		"/tables/bad_name/aggregate?bucket=1h":                     http.StatusNotFound,
+	}
+	for path, code := range checks {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.SetBasicAuth(user, password)
+		h.negroni.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("GET %s: expected %d, got %d: %s", path, code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHTTP_stream(t *testing.T) {
+	hub := homehub.NewHub()
+	h, e := newConfig(Config{Listen: listen, User: user, Password: password, Hub: hub})
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			h.Stop()
+		}
+	}()
+	h.Use(homehub.Publishing(faker, hub))
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost%s/stream?tables=table", listen), nil)
+	req.SetBasicAuth(user, password)
+	resp, e := http.DefaultClient.Do(req)
+	if e != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unable to stream: %v %v", resp, e)
+	}
+	defer resp.Body.Close()
+
+	header := http.Header{}
+	req.SetBasicAuth(user, password)
+	header.Set("Authorization", req.Header.Get("Authorization"))
+	ws, _, e := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost%s/stream/ws", listen), header)
+	if e != nil {
+		t.Fatalf("Unable to open websocket: %v", e)
+	}
+	defer ws.Close()
+
+	//outlast the server's read and write timeouts before anything is stored
+	time.Sleep(1500 * time.Millisecond)
+	for _, body := range []string{`{"table":"other", "data": {"field": 1}}`, `{"table":"table", "data": {"field": 2}}`} {
+		post := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		post.SetBasicAuth(user, password)
+		h.negroni.ServeHTTP(httptest.NewRecorder(), post)
+	}
+
+	events := make(chan string)
+	go func() {
+		buf := make([]byte, 4096)
+		n, _ := resp.Body.Read(buf)
+		events <- string(buf[:n])
+	}()
+	select {
+	case event := <-events:
+		if !strings.HasPrefix(event, "event: datam\ndata: ") || !strings.Contains(event, `"table":"table"`) || strings.Contains(event, "other") {
+			t.Errorf("Unexpected event: %q", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("No event streamed")
+	}
+
+	tables := []string{}
+	for i := 0; i < 2; i++ {
+		datam := homehub.Datam{}
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if e := ws.ReadJSON(&datam); e != nil {
+			t.Fatalf("Unable to read websocket: %v", e)
+		}
+		tables = append(tables, string(datam.Table))
+	}
+	if strings.Join(tables, ",") != "other,table" {
+		t.Errorf("Websocket without tables should see everything: %v", tables)
+	}
+
+	h.Stop()
+	stopped = true
+	if _, _, e := ws.ReadMessage(); !websocket.IsCloseError(e, websocket.CloseGoingAway) {
+		t.Errorf("Stop should close the websocket: %v", e)
+	}
+
+	h2, _ := getter()
+	defer h2.Stop()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/stream", nil)
+	r.SetBasicAuth(user, password)
+	h2.negroni.ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Streaming without a hub should not be implemented: %d", w.Code)
+	}
+}
+
+type broken struct{ fake }
+
+func (broken) Store(datam homehub.Datam) error {
+	return errors.New("disk full")
+}
+
+func TestHTTP_stats(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			r.SetBasicAuth(user, password)
+		}
+		h.negroni.ServeHTTP(w, r)
+		return w
+	}
+	good, garage := `{"table":"attic", "data": {"temp": 1.0}}`, `{"table":"garage", "data": {"temp": 1.0}}`
+
+	//hammer it from many clients at once, as the race detector will notice
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 25; j++ {
+				do("POST", "/", good, "")
+				do("POST", "/", `{not json}`, "")
+				do("POST", "/", "["+good+","+`{"table":"attic", "data": {"temp": [1]}}`+"]", "")
+				do("GET", "/stats", "", "")
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	h.Use(broken{})
+	do("POST", "/", garage, "")
+	h.Use(faker)
+
+	snap := homehub.StatsSnapshot{}
+	w := do("GET", "/stats", "", "")
+	if e := json.NewDecoder(w.Body).Decode(&snap); e != nil || w.Code != http.StatusOK {
+		t.Fatalf("Unable to decode stats: %d %v", w.Code, e)
+	}
+	attic, web := snap.Tables["attic"], snap.Attendants["http"]
+	//invalid batch entries are left as the zero Datam, so they are not counted against attic
+	if attic.Accepted != 400 || attic.Rejected != 0 || attic.Failed != 0 || attic.Bytes == 0 || attic.LastSeen.IsZero() {
+		t.Errorf("attic is wrong: %+v", attic)
+	}
+	if snap.Tables["garage"].Failed != 1 {
+		t.Errorf("garage should have failed: %+v", snap.Tables["garage"])
+	}
+	if web.Accepted != 400 || web.Rejected != 400 || web.Failed != 1 || len(web.Tables) != 2 {
+		t.Errorf("http is wrong: %+v", web)
+	}
+
+	//devices only see the tables they may use
+	h.keys = fakeKeys{"garage": {Device: "garage", Tables: []string{"garage*"}, Perms: homehub.PermStore}}
+	defer func() { h.keys = nil }()
+	snap = homehub.StatsSnapshot{}
+	json.NewDecoder(do("GET", "/stats", "", "garage").Body).Decode(&snap)
+	if _, ok := snap.Tables["attic"]; ok || len(snap.Tables) != 1 || len(snap.Attendants["http"].Tables) != 1 {
+		t.Errorf("Should only see garage: %+v", snap)
+	}
+}
+
+func TestHTTP_metrics(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.SetBasicAuth(user, password)
+		h.negroni.ServeHTTP(w, r)
+		return w
+	}
+	get("/tables/metrics_attic/rows")
+	get("/no/such/route")
+	body := get("/metrics").Body.String()
+	for _, want := range []string{
+		`homehub_http_requests_total{code="501",method="GET",route="/tables/{table}/rows"}`,
+		`homehub_http_requests_total{code="404",method="GET",route="unmatched"}`,
+		`homehub_http_request_duration_seconds_count{method="GET",route="/tables/{table}/rows"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Missing %s in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "metrics_attic") {
+		t.Errorf("Paths should not be used as labels")
+	}
+}
+
+type recorder struct {
+	fake
+	registered, stored []homehub.Datam
+	refuse             homehub.Alphabetic //table whose stores fail
+}
+
+func (r *recorder) Register(datam homehub.Datam) error {
+	r.registered = append(r.registered, datam)
+	return nil
+}
+func (r *recorder) Store(datam homehub.Datam) error {
+	if datam.Table == r.refuse {
+		return fmt.Errorf("refused")
+	}
+	r.stored = append(r.stored, datam)
+	return nil
+}
+
+func TestHTTP_write(t *testing.T) {
+	h, e := getter()
+	if e != nil {
+		t.Fatalf("Unable to start: %v", e)
+	}
+	defer h.Stop()
+	rec := &recorder{}
+	h.Use(rec)
+	defer h.Use(faker)
+
+	post := func(path, body, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			r.SetBasicAuth(user, password)
+		}
+		h.negroni.ServeHTTP(w, r)
+		return w
+	}
+
+	lines := "weather,location=attic temperature=82 1465839830\nweather humidity=71i 1465839840\ncpu_load value=0.5\n"
+	if w := post("/write?db=telegraf&precision=s", lines, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(rec.registered) != 2 || len(rec.stored) != 3 {
+		t.Fatalf("Should register each table once and store every line: %d %d", len(rec.registered), len(rec.stored))
+	}
+	if weather := rec.registered[0]; weather.Table != "weather" || len(weather.Data) != 3 {
+		t.Errorf("Should register weather with every field: %+v", weather)
+	}
+	if rec.registered[1].Table != "cpuLoad" || !rec.stored[1].Timestamp.Equal(time.Unix(1465839840, 0)) {
+		t.Errorf("Unexpected: %+v %+v", rec.registered[1], rec.stored[1])
+	}
+
+	//partial writes store what they can
+	rec.stored = nil
+	w := post("/write", "weather temperature=1\nweather temperature=hot\n", "")
+	resp := errorResponse{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusBadRequest || len(rec.stored) != 1 || !strings.HasPrefix(resp.Error, "partial write: unable to parse line 2") || !strings.HasSuffix(resp.Error, "dropped=1") {
+		t.Errorf("Unexpected partial write: %d %d %+v", w.Code, len(rec.stored), resp)
+	}
+	rec.stored, rec.registered, rec.refuse = nil, nil, "garage"
+	w = post("/write", "garage temperature=1\nweather temperature=1i\nweather temperature=1.5\n", "")
+	if w.Code != http.StatusInternalServerError || len(rec.stored) != 2 {
+		t.Errorf("Should store the lines that can be, line by line: %d %d", w.Code, len(rec.stored))
+	}
+	if weather := rec.registered[1]; weather.Data["temperature"].Mode() != homehub.ModeFloat {
+		t.Errorf("Should widen an int field to float when registering: %+v", weather)
+	}
+	rec.refuse = ""
+	if w := post("/write?precision=fortnight", "weather temperature=1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Should reject an unknown precision: %d", w.Code)
+	}
+
+	//devices need to be able to register and store
+	h.keys = fakeKeys{
+		"garage": {Device: "garage", Tables: []string{"garage*"}, Perms: homehub.PermStore},
+		"attic":  {Device: "attic", Tables: []string{"attic"}, Perms: homehub.PermBoth},
+	}
+	defer func() { h.keys = nil }()
+	if w := post("/write", "garage temperature=1", "garage"); w.Code != http.StatusForbidden {
+		t.Errorf("Should not be able to register: %d", w.Code)
+	}
+	if w := post("/write", "attic temperature=1", "attic"); w.Code != http.StatusNoContent {
+		t.Errorf("Should be able to write: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("HEAD", "/ping", nil)
+	r.SetBasicAuth(user, password)
+	h.negroni.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Influxdb-Version") == "" {
+		t.Errorf("Bad ping: %d %v", w.Code, w.Header())
+	}
+}
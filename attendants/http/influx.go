@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/npotts/homehub"
+)
+
+/*ping handles GET and HEAD /ping, which InfluxDB clients use to check the server is up*/
+func (h *HTTPd) ping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Influxdb-Version", "homehub")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*write handles POST /write?precision=, accepting InfluxDB line protocol so tools such
+as Telegraf can send to homehub unchanged.  Each table is registered with every field
+its lines hold before the lines are stored, so the request needs both permissions.
+Lines are stored one at a time so, as with InfluxDB, lines that can be stored are
+stored even if others cannot.  The db and rp parameters are ignored.*/
+func (h *HTTPd) write(w http.ResponseWriter, r *http.Request) {
+	data, err := h.ingest(r)
+	if err != nil {
+		h.fail(w, status(err), err)
+		return
+	}
+	batch, errs, err := homehub.DecodeLineProtocol(data, r.URL.Query().Get("precision"))
+	if err != nil {
+		h.record("", err, true, len(data))
+		h.fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	//register each table once, with every field seen for it, widening ints to floats
+	rejected, tables, order := make([]bool, len(batch)), map[homehub.Alphabetic]homehub.Datam{}, []homehub.Alphabetic{}
+	for i, datam := range batch {
+		if errs[i] == nil {
+			errs[i] = permit(r, homehub.PermBoth, datam.Table)
+		}
+		if errs[i] != nil {
+			rejected[i] = true
+			continue
+		}
+		datam = h.tag(r, datam)
+		batch[i] = datam
+		merged, ok := tables[datam.Table]
+		if !ok {
+			merged = homehub.Datam{Table: datam.Table, Data: map[homehub.Alphabetic]homehub.Field{}}
+			order = append(order, datam.Table)
+		}
+		for name, field := range datam.Data {
+			seen, ok := merged.Data[name]
+			if !ok || seen.Mode() == homehub.ModeNull || (seen.Mode() == homehub.ModeInt && field.Mode() == homehub.ModeFloat) {
+				merged.Data[name] = field
+			}
+		}
+		tables[datam.Table] = merged
+	}
+	registered := map[homehub.Alphabetic]error{}
+	for _, table := range order {
+		registered[table] = h.backend.Register(tables[table])
+	}
+
+	for i, datam := range batch {
+		if errs[i] == nil {
+			errs[i] = registered[datam.Table]
+		}
+		if errs[i] == nil {
+			errs[i] = h.backend.Store(datam)
+		}
+	}
+
+	var first error
+	code, dropped := http.StatusNoContent, 0
+	for i, datam := range batch {
+		h.record(datam.Table, errs[i], rejected[i], homehub.Share(len(data), len(batch), i))
+		if errs[i] == nil {
+			continue
+		}
+		if dropped++; first == nil {
+			first, code = errs[i], http.StatusInternalServerError
+			if rejected[i] {
+				code = status(errs[i])
+			}
+		}
+	}
+	if first != nil {
+		h.fail(w, code, fmt.Errorf("partial write: %v dropped=%d", first, dropped))
+		return
+	}
+	w.WriteHeader(code)
+}
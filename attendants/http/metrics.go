@@ -0,0 +1,45 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+
+	"github.com/npotts/homehub/metrics"
+)
+
+/*route returns the template of the route r matches, such as "/tables/{table}/rows",
+so metrics are not labelled by every path a client comes up with*/
+func (h *HTTPd) route(r *http.Request) string {
+	match := mux.RouteMatch{}
+	if !h.mux.Match(r, &match) || match.Route == nil {
+		return "unmatched"
+	}
+	if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+		return tmpl
+	}
+	return "unmatched"
+}
+
+/*measure is middleware counting and timing every request by route*/
+func (h *HTTPd) measure(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start, route := time.Now(), h.route(r)
+	next(w, r)
+	code := 0
+	if res, ok := w.(negroni.ResponseWriter); ok {
+		code = res.Status()
+	}
+	metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(code)).Inc()
+	metrics.HTTPDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/npotts/homehub"
+)
+
+/*defaultLimit is the most rows returned when the client does not ask for a limit*/
+const defaultLimit = 1000
+
+var errNoReader = errors.New("Backend cannot read back data")
+var errNoAggregator = errors.New("Backend cannot aggregate data")
+
+/*tableSchema is returned for GET /tables/{table}*/
+type tableSchema struct {
+	Table   homehub.Alphabetic `json:"table"`
+	Columns []homehub.Column   `json:"columns"`
+}
+
+/*reply sends v to the client as JSON*/
+func (h *HTTPd) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+/*failRead reports an error from a homehub.Reader with a fitting status code*/
+func (h *HTTPd) failRead(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, homehub.ErrUnknownTable):
+		h.fail(w, http.StatusNotFound, err)
+	case errors.Is(err, homehub.ErrUnknownField), errors.Is(err, homehub.ErrInvalidQuery):
+		h.fail(w, http.StatusBadRequest, err)
+	case err == errForbidden:
+		h.fail(w, http.StatusForbidden, err)
+	case err == errNoReader, err == errNoAggregator, err == errNoHub:
+		h.fail(w, http.StatusNotImplemented, err)
+	default:
+		h.fail(w, http.StatusInternalServerError, err)
+	}
+}
+
+/*reader returns the backend as a homehub.Reader, and the table named in the
+path (if any) provided the request may read it*/
+func (h *HTTPd) reader(r *http.Request) (homehub.Reader, homehub.Alphabetic, error) {
+	var rd homehub.Reader
+	if !homehub.As(h.backend, &rd) {
+		return nil, "", errNoReader
+	}
+	table := homehub.Alphabetic(mux.Vars(r)["table"])
+	if table != "" {
+		if !table.Valid() {
+			return nil, "", homehub.ErrUnknownTable
+		}
+		if err := permit(r, 0, table); err != nil {
+			return nil, "", err
+		}
+	}
+	return rd, table, nil
+}
+
+/*tables handles GET /tables, listing the tables the request may read*/
+func (h *HTTPd) tables(w http.ResponseWriter, r *http.Request) {
+	rd, _, err := h.reader(r)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	all, err := rd.Tables()
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	tables := []homehub.Alphabetic{}
+	for _, table := range all {
+		if permit(r, 0, table) == nil {
+			tables = append(tables, table)
+		}
+	}
+	h.reply(w, tables)
+}
+
+/*schema handles GET /tables/{table}*/
+func (h *HTTPd) schema(w http.ResponseWriter, r *http.Request) {
+	rd, table, err := h.reader(r)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	columns, err := rd.Schema(table)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	h.reply(w, tableSchema{Table: table, Columns: columns})
+}
+
+/*query forms a homehub.Query from the from, to, fields and limit parameters*/
+func query(r *http.Request, table homehub.Alphabetic) (homehub.Query, error) {
+	q, params := homehub.Query{Table: table, Limit: defaultLimit}, r.URL.Query()
+	if from := params.Get("from"); from != "" {
+		t, err := homehub.ParseTimestamp(from)
+		if err != nil {
+			return q, errors.Wrap(err, "from")
+		}
+		q.From = t.Time
+	}
+	if to := params.Get("to"); to != "" {
+		t, err := homehub.ParseTimestamp(to)
+		if err != nil {
+			return q, errors.Wrap(err, "to")
+		}
+		q.To = t.Time
+	}
+	if fields := params.Get("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			q.Fields = append(q.Fields, homehub.Alphabetic(strings.TrimSpace(field)))
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("limit must be a positive number, not %q", limit)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+/*rows handles GET /tables/{table}/rows?from=&to=&fields=&limit=*/
+func (h *HTTPd) rows(w http.ResponseWriter, r *http.Request) {
+	rd, table, err := h.reader(r)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	q, err := query(r, table)
+	if err != nil {
+		h.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	data, err := rd.Rows(q)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	h.reply(w, data)
+}
+
+/*aggregateQuery forms a homehub.AggregateQuery from the bucket and functions
+parameters, on top of those read by query*/
+func aggregateQuery(r *http.Request, table homehub.Alphabetic) (homehub.AggregateQuery, error) {
+	q, err := query(r, table)
+	agg := homehub.AggregateQuery{Query: q}
+	if err != nil {
+		return agg, err
+	}
+	params := r.URL.Query()
+	if agg.Bucket, err = time.ParseDuration(params.Get("bucket")); err != nil || agg.Bucket < time.Second {
+		return agg, fmt.Errorf("bucket must be a duration of at least 1s, such as 15m or 1h, not %q", params.Get("bucket"))
+	}
+	functions := params.Get("functions")
+	if functions == "" {
+		functions = "mean"
+	}
+	for _, name := range strings.Split(functions, ",") {
+		fxn, err := homehub.ParseAggregate(strings.TrimSpace(name))
+		if err != nil {
+			return agg, err
+		}
+		agg.Functions = append(agg.Functions, fxn)
+	}
+	return agg, nil
+}
+
+/*aggregate handles GET /tables/{table}/aggregate?bucket=&functions=&from=&to=&fields=&limit=*/
+func (h *HTTPd) aggregate(w http.ResponseWriter, r *http.Request) {
+	_, table, err := h.reader(r)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	var ag homehub.Aggregator
+	if !homehub.As(h.backend, &ag) {
+		h.failRead(w, errNoAggregator)
+		return
+	}
+	q, err := aggregateQuery(r, table)
+	if err != nil {
+		h.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	buckets, err := ag.Aggregate(q)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	h.reply(w, buckets)
+}
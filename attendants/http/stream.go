@@ -0,0 +1,194 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/npotts/homehub"
+)
+
+const (
+	streamBuffer = 64               //Datam a client may fall behind by before the oldest are dropped
+	streamWrite  = 10 * time.Second //longest a client may take to accept a single write
+	streamPong   = 60 * time.Second //longest a websocket client may go without answering a ping
+)
+
+/*streamPing is how often an idle stream is pinged to keep it, and any proxies, alive*/
+var streamPing = 15 * time.Second
+
+var errNoHub = errors.New("Streaming is not enabled")
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+/*writerContext is the request context key of the http.ResponseWriter the server
+handed in, before any middleware wrapped it*/
+const writerContext contextKey = keyContext + 1
+
+/*serveHTTP passes requests on to the middleware, remembering the server's own
+ResponseWriter so long lived requests can adjust their deadlines*/
+func (h *HTTPd) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	h.negroni.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), writerContext, w)))
+}
+
+/*writeDeadline sets the deadline for the next write to the client, and clears the
+read deadline, as the server's timeouts are too short for a stream*/
+func writeDeadline(r *http.Request) {
+	if w, ok := r.Context().Value(writerContext).(http.ResponseWriter); ok {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Now().Add(streamWrite))
+	}
+}
+
+/*subscribe subscribes to the tables named by the tables parameter (or every table
+if there are none), provided the request may read them*/
+func (h *HTTPd) subscribe(r *http.Request) (*homehub.Subscription, error) {
+	if h.hub == nil {
+		return nil, errNoHub
+	}
+	tables := []homehub.Alphabetic{}
+	if names := r.URL.Query().Get("tables"); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			table := homehub.Alphabetic(strings.TrimSpace(name))
+			if !table.Valid() {
+				return nil, homehub.ErrUnknownTable
+			}
+			if err := permit(r, 0, table); err != nil {
+				return nil, err
+			}
+			tables = append(tables, table)
+		}
+	}
+	return h.hub.Subscribe(streamBuffer, tables...), nil
+}
+
+/*stream handles GET /stream?tables=, sending each Datam as it is stored as a
+Server-Sent Event*/
+func (h *HTTPd) stream(w http.ResponseWriter, r *http.Request) {
+	sub, err := h.subscribe(r)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	defer sub.Close()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.fail(w, http.StatusInternalServerError, errors.New("Streaming is not supported"))
+		return
+	}
+
+	writeDeadline(r)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case datam, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if permit(r, 0, datam.Table) != nil {
+				continue
+			}
+			raw, err := json.Marshal(datam)
+			if err != nil {
+				continue
+			}
+			writeDeadline(r)
+			if _, err := fmt.Fprintf(w, "event: datam\ndata: %s\n\n", raw); err != nil {
+				return
+			}
+		case <-ping.C:
+			writeDeadline(r)
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+/*websocket handles GET /stream/ws?tables=, sending each Datam as it is stored as
+a JSON text message*/
+func (h *HTTPd) websocket(w http.ResponseWriter, r *http.Request) {
+	sub, err := h.subscribe(r)
+	if err != nil {
+		h.failRead(w, err)
+		return
+	}
+	defer sub.Close()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return //Upgrade has already told the client
+	}
+	defer conn.Close()
+
+	//clients have nothing to say, but must be read from to see pongs and closes
+	conn.SetReadLimit(1024)
+	conn.SetReadDeadline(time.Now().Add(streamPong))
+	conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(streamPong)) })
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	bye := func() {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "homehub is stopping")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(streamWrite))
+	}
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case datam, ok := <-sub.C:
+			if !ok {
+				bye()
+				return
+			}
+			if permit(r, 0, datam.Table) != nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWrite))
+			if err := conn.WriteJSON(datam); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWrite)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-h.done:
+			bye()
+			return
+		}
+	}
+}
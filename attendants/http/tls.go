@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+/*certs holds the server certificate and, optionally, the CAs that client
+certificates must chain to.  Both can be reloaded from disk while serving.*/
+type certs struct {
+	certFile, keyFile, clientCA string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	clients *x509.CertPool //nil unless clientCA is set
+}
+
+/*newCerts loads the certificate, key and client CA files*/
+func newCerts(certFile, keyFile, clientCA string) (*certs, error) {
+	c := &certs{certFile: certFile, keyFile: keyFile, clientCA: clientCA}
+	return c, c.reload()
+}
+
+/*reload reads in the files again.  On error the previously loaded certificates are kept.*/
+func (c *certs) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	var clients *x509.CertPool
+	if c.clientCA != "" {
+		pem, err := ioutil.ReadFile(c.clientCA)
+		if err != nil {
+			return err
+		}
+		clients = x509.NewCertPool()
+		if !clients.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", c.clientCA)
+		}
+	}
+	c.mu.Lock()
+	c.cert, c.clients = &cert, clients
+	c.mu.Unlock()
+	return nil
+}
+
+/*config returns the tls.Config to serve with.  Each handshake picks up the
+most recently loaded certificates.*/
+func (c *certs) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if c.clients != nil {
+				//clients without a certificate may still use a password or API key
+				cfg.ClientAuth, cfg.ClientCAs = tls.VerifyClientCertIfGiven, c.clients
+			}
+			return cfg, nil
+		},
+	}
+}
+
+/*certDevice returns the device named by the common name of a verified client
+certificate, or an empty string if the request did not present one*/
+func certDevice(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -6,24 +6,36 @@ See the LICENSE file at github.com/npotts/homehub/LICENSE
 This file is part of the HomeHub project
 */
 
-/*Package mango holds various wrappers around various protocols
-in order to expose easier access to storage mechanisms.
+/*Package mango provides attendants that accept data over mangos (nanomsg)
+sockets, on tcp:// or ipc:// addresses.
 
-Mostly attendants monitor some sort of input from remote clients and
-via callbacks, send data to some sort of backend, which would be SQL,
-NOSQL, binary blobs, or whatever else is desired.
+Rep is a REP socket.  Each request is a JSON Datam, optionally preceded by a
+verb and a space:
 
-Built Ins
+	register {"table":"attic","data":{"temp":0.0}}
+	store {"table":"attic","data":{"temp":21.5}}
+	{"table":"attic","data":{"temp":21.5}}
 
-Sub-package http provide a HTTP server that listens on a particular port
-and optionally requires a username/password via Basic Auth before forwarding
-data on.  Likewise, udp performs a similar service, but over UDP spockets.  It
-is planned to also have a ZMQv4 setup
-*/
+"register" only registers the Datam and "store" only stores it, while a
+request without a verb does both.  The reply is "ok", or "error: " followed
+by what went wrong.
+
+Pull and Sub accept the same messages without replying, for producers that
+would rather not wait and can tolerate loss.  Pull is the far end of a PUSH
+pipeline.  Sub takes messages from PUB sockets, each starting with the table
+it is for as its topic, so that only the tables asked for are received:
+
+	attic store {"table":"attic","data":{"temp":21.5}}
+
+All of them listen on their url, for producers to dial.*/
 package mango
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/rep"
 	"github.com/go-mangos/mangos/transport/ipc"
@@ -31,32 +43,90 @@ import (
 	"github.com/npotts/go-patterns/stoppable"
 
 	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/metrics"
 )
 
+/*attendant is what the mangos attendants share: a socket whose messages are
+decoded and handed on to a backend*/
+type attendant struct {
+	kind  string //type of socket, eg "rep"
+	sock  mangos.Socket
+	stpr  stoppable.Halter
+	stats *homehub.Stats
+	done  chan struct{} //closed once the socket's loop has exited
+
+	mu sync.RWMutex
+	be homehub.Backend
+}
+
+/*newAttendant opens a socket with newSocket, listening on url*/
+func newAttendant(kind string, newSocket func() (mangos.Socket, error), url string, stats *homehub.Stats) (a *attendant, err error) {
+	if stats == nil {
+		stats = homehub.NewStats()
+	}
+	a = &attendant{kind: kind, stpr: stoppable.NewStopable(), stats: stats, done: make(chan struct{})}
+	if a.sock, err = listen(newSocket, url); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
 /*Rep listens for incoming data feeds over mango sockets*/
 type Rep struct {
-	sock mangos.Socket
-	be   homehub.Backend
-	stpr stoppable.Halter
+	*attendant
+}
+
+/*Attendant returns a homehub.Attendant listening on url, or a non-nil error*/
+func Attendant(url string) (homehub.Attendant, error) {
+	return New(url)
 }
 
 /*New returns a initialzied and running Rep*/
 func New(url string) (r *Rep, err error) {
-	r = &Rep{stpr: stoppable.NewStopable()}
-	if r.sock, err = rep.NewSocket(); err != nil {
+	return NewStats(url, nil)
+}
+
+/*NewStats is like New, but keeps counts in stats, where other attendants may add
+theirs.  A nil stats is the same as New.*/
+func NewStats(url string, stats *homehub.Stats) (*Rep, error) {
+	a, err := newAttendant("rep", rep.NewSocket, url, stats)
+	if err != nil {
 		return nil, err
 	}
-	r.sock.AddTransport(ipc.NewTransport())
-	r.sock.AddTransport(tcp.NewTransport())
+	go a.serve(a.sock.Send, false)
+	return &Rep{a}, nil
+}
 
-	if err = r.sock.Listen(url); err != nil {
+/*listen opens a socket with newSocket, able to use the tcp and ipc transports, and
+listens on url*/
+func listen(newSocket func() (mangos.Socket, error), url string) (mangos.Socket, error) {
+	sock, err := newSocket()
+	if err != nil {
+		return nil, err
+	}
+	sock.AddTransport(ipc.NewTransport())
+	sock.AddTransport(tcp.NewTransport())
+	if err = sock.Listen(url); err != nil {
+		sock.Close()
 		return nil, err
 	}
+	return sock, nil
+}
+
+/*Use sets the backend*/
+func (a *attendant) Use(be homehub.Backend) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.be = be
+}
 
-	cerr := make(chan error)
-	defer close(cerr)
-	go r.monitor(cerr)
-	return r, <-cerr
+/*Stop closes the socket and waits for any message being handled to finish*/
+func (a *attendant) Stop() {
+	defer a.stpr.Die()
+	if a.stpr.Alive() {
+		a.sock.Close()
+		<-a.done
+	}
 }
 
 /*Error is the string sent if an error was encountered*/
@@ -65,32 +135,117 @@ var Error = []byte("error")
 /*Ok is the 'ok' response if successful*/
 var Ok = []byte("ok")
 
-func (r *Rep) monitor(cerr chan error) {
-	cerr <- nil
-	for r.stpr.Alive() {
-		msg, err := r.sock.Recv()
-		if err != nil {
-			r.sock.Send(Error)
-			continue
-		}
-
-		datam := homehub.Datam{}
-		json.Unmarshal(msg, &datam)
+/*reply forms an Error response carrying the detail of err, eg "error: Invalid JSON Structure: field ..."*/
+func reply(err error) []byte {
+	return append(append([]byte{}, Error...), ": "+err.Error()...)
+}
 
-		if !datam.Valid() {
-			r.sock.Send(Error)
-			continue
+/*verbs are the operations a request may ask for*/
+var verbs = map[string]func(homehub.Backend, homehub.Datam) error{
+	"register": func(be homehub.Backend, datam homehub.Datam) error { return be.Register(datam) },
+	"store":    func(be homehub.Backend, datam homehub.Datam) error { return be.Store(datam) },
+	"": func(be homehub.Backend, datam homehub.Datam) error {
+		if err := be.Register(datam); err != nil {
+			return err
 		}
+		return be.Store(datam)
+	},
+}
 
-		if r.be.Register(datam) != nil {
-			r.sock.Send(Error)
-			continue
+/*decode splits msg into its verb, if any, and the Datam following it*/
+func decode(msg []byte) (string, homehub.Datam, error) {
+	verb := ""
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] != '{' {
+		i := bytes.IndexAny(msg, " \t\r\n")
+		if i < 0 {
+			i = len(msg)
 		}
+		verb, msg = string(msg[:i]), msg[i:]
+		if _, ok := verbs[verb]; !ok || verb == "" {
+			return verb, homehub.Datam{}, fmt.Errorf("Unknown verb %q, must be register or store", verb)
+		}
+	}
+	datam, err := homehub.DecodeDatam(msg)
+	if err != nil && !errors.Is(err, homehub.ErrInvalid) {
+		return verb, datam, fmt.Errorf("Invalid JSON: %v", err)
+	}
+	return verb, datam, err
+}
+
+/*record counts a message of size bytes for table, in metrics and stats*/
+func (a *attendant) record(table homehub.Alphabetic, outcome homehub.Outcome, result string, size int) {
+	if !table.Valid() {
+		table = ""
+	}
+	metrics.MangosMessages.WithLabelValues(a.kind, result).Inc()
+	a.stats.Record("mangos/"+a.kind, table, outcome, size)
+}
+
+/*handle carries out the request in msg, returning the reply.  If topic is not
+empty, the Datam must be for that table.*/
+func (a *attendant) handle(msg []byte, topic homehub.Alphabetic) []byte {
+	verb, datam, err := decode(msg)
+	if err == nil && topic != "" && datam.Table != topic {
+		err = fmt.Errorf("Table %q does not match the topic %q", datam.Table, topic)
+	}
+	if err != nil {
+		a.record(datam.Table, homehub.StatRejected, "invalid", len(msg))
+		return reply(err)
+	}
+
+	a.mu.RLock()
+	be := a.be
+	a.mu.RUnlock()
+	if be == nil {
+		err = fmt.Errorf("No backend in use")
+	} else {
+		err = verbs[verb](be, datam)
+	}
+	if err != nil {
+		a.record(datam.Table, homehub.StatFailed, "backend_error", len(msg))
+		return reply(err)
+	}
+	a.record(datam.Table, homehub.StatAccepted, "ok", len(msg))
+	return Ok
+}
+
+/*topic splits msg into the topic, its first word, and the rest*/
+func topic(msg []byte) (homehub.Alphabetic, []byte) {
+	msg = bytes.TrimLeft(msg, " \t\r\n")
+	i := bytes.IndexAny(msg, " \t\r\n")
+	if i < 0 {
+		return homehub.Alphabetic(msg), nil
+	}
+	return homehub.Alphabetic(msg[:i]), msg[i:]
+}
 
-		if r.be.Store(datam) == nil {
-			r.sock.Send(Ok)
-			continue
+/*serve handles messages until the socket is closed, passing each reply to respond
+if it is not nil.  If topics is true, each message starts with a topic naming the
+table it is for.*/
+func (a *attendant) serve(respond func([]byte) error, topics bool) {
+	defer close(a.done)
+	for {
+		msg, err := a.sock.Recv()
+		if err == mangos.ErrClosed || a.stpr.Dead() {
+			return
+		}
+		if err != nil {
+			metrics.MangosMessages.WithLabelValues(a.kind, "recv_error").Inc()
+			continue //there is nothing to reply to
+		}
+		var table homehub.Alphabetic
+		if topics {
+			var rest []byte
+			if table, rest = topic(msg); !table.Valid() {
+				a.record("", homehub.StatRejected, "invalid", len(msg))
+				continue
+			}
+			msg = rest
+		}
+		reply := a.handle(msg, table)
+		if respond != nil {
+			respond(reply)
 		}
-		r.sock.Send(Error)
 	}
 }
@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package mango
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/backendtest"
+)
+
+/*url returns an ipc:// address in a temporary directory*/
+func url(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mangos")
+	if err != nil {
+		t.Fatalf("Unable to make a directory: %v", err)
+	}
+	return "ipc://" + filepath.Join(dir, "sock"), func() { os.RemoveAll(dir) }
+}
+
+func TestRep_handle(t *testing.T) {
+	u, cleanup := url(t)
+	defer cleanup()
+	r, err := New(u)
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer r.Stop()
+
+	good := `{"table":"attic", "data": {"temp": 21.5}}`
+	if got := string(r.handle([]byte(good), "")); !strings.HasPrefix(got, "error: No backend") {
+		t.Errorf("Should fail without a backend: %s", got)
+	}
+	mem := &backendtest.Memory{}
+	r.Use(mem)
+
+	tests := map[string]string{
+		good:                                     "ok",
+		"register " + good:                       "ok",
+		"store\t" + good:                         "ok",
+		"delete " + good:                         `error: Unknown verb "delete"`,
+		"store {not json}":                       "error: Invalid JSON:",
+		`{"table":"attic", "data": {"od": [1]}}`: "error: Invalid JSON Structure",
+		`{"table":"bad name", "data": {"x": 1}}`: "error: ",
+		`{"table":"full", "data": {"temp": 1}}`:  "error: disk full",
+	}
+	for msg, want := range tests {
+		if got := string(r.handle([]byte(msg), "")); !strings.HasPrefix(got, want) {
+			t.Errorf("%s: got %q, wanted %q", msg, got, want)
+		}
+	}
+	if registered, stored := mem.Counts(); registered != 2 || stored != 2 {
+		t.Errorf("Verbs not respected: %d registered, %d stored", registered, stored)
+	}
+	snap := r.stats.Snapshot()
+	if a := snap.Attendants["mangos/rep"]; a.Accepted != 3 || a.Rejected != 4 || a.Failed != 2 {
+		t.Errorf("Unexpected stats: %+v", a)
+	}
+
+	//topics must match the table
+	if got := string(r.handle([]byte(good), "garage")); !strings.HasPrefix(got, "error: Table") {
+		t.Errorf("Should not accept a Datam for another topic: %s", got)
+	}
+	if got := string(r.handle([]byte(good), "attic")); got != "ok" {
+		t.Errorf("Should accept a Datam for its topic: %s", got)
+	}
+}
+
+func Test_topic(t *testing.T) {
+	tests := map[string][2]string{
+		`attic store {"table":"attic"}`: {"attic", ` store {"table":"attic"}`},
+		` attic {}`:                     {"attic", ` {}`},
+		`attic`:                         {"attic", ``},
+		`{"table":"attic"}`:             {`{"table":"attic"}`, ``},
+	}
+	for msg, want := range tests {
+		table, rest := topic([]byte(msg))
+		if string(table) != want[0] || string(rest) != want[1] {
+			t.Errorf("%s: got %q %q", msg, table, rest)
+		}
+	}
+}
+
+func TestRep_lifecycle(t *testing.T) {
+	u, cleanup := url(t)
+	defer cleanup()
+	a, err := Attendant(u)
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	a.Use(&backendtest.Memory{})
+	a.Stop()
+	a.Stop()
+
+	for _, start := range []func() (homehub.Attendant, error){
+		func() (homehub.Attendant, error) { return NewPull(u, nil) },
+		func() (homehub.Attendant, error) { return NewSub(u, nil) },
+		func() (homehub.Attendant, error) { return NewSub(u, homehub.NewStats(), "attic", "garage") },
+	} {
+		a, err := start()
+		if err != nil {
+			t.Fatalf("Unable to start: %v", err)
+		}
+		a.Use(&backendtest.Memory{})
+		a.Stop()
+	}
+
+	if _, err := New("nonsense://"); err == nil {
+		t.Errorf("Should not listen on a bad url")
+	}
+}
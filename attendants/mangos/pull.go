@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package mango
+
+import (
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/protocol/pull"
+	"github.com/go-mangos/mangos/protocol/sub"
+
+	"github.com/npotts/homehub"
+)
+
+/*Pull receives data pushed to it over a PULL socket, without replying*/
+type Pull struct {
+	*attendant
+}
+
+/*NewPull returns a running Pull listening on url.  Counts are kept in stats, or
+its own if stats is nil.*/
+func NewPull(url string, stats *homehub.Stats) (*Pull, error) {
+	a, err := newAttendant("pull", pull.NewSocket, url, stats)
+	if err != nil {
+		return nil, err
+	}
+	go a.serve(nil, false)
+	return &Pull{a}, nil
+}
+
+/*Sub receives data published to it over a SUB socket, without replying.  Each
+message starts with the table it is for as its topic.*/
+type Sub struct {
+	*attendant
+}
+
+/*NewSub returns a running Sub listening on url, receiving only the given tables,
+or every table if none are given.  Counts are kept in stats, or its own if stats
+is nil.*/
+func NewSub(url string, stats *homehub.Stats, tables ...homehub.Alphabetic) (*Sub, error) {
+	a, err := newAttendant("sub", sub.NewSocket, url, stats)
+	if err != nil {
+		return nil, err
+	}
+	topics := [][]byte{{}}
+	if len(tables) > 0 {
+		topics = nil
+		for _, table := range tables {
+			//the space keeps eg "attic" from matching "attic2"
+			topics = append(topics, []byte(string(table)+" "))
+		}
+	}
+	for _, t := range topics {
+		if err := a.sock.SetOption(mangos.OptionSubscribe, t); err != nil {
+			a.sock.Close()
+			return nil, err
+		}
+	}
+	go a.serve(nil, true)
+	return &Sub{a}, nil
+}
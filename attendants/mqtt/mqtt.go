@@ -0,0 +1,228 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package mqtt provides an attendant that subscribes to topics on a MQTT broker, so
+that devices such as Tasmota or zigbee2mqtt gear can feed homehub unchanged.
+
+Each message becomes a Datam.  Its table comes from the topic, either the whole of
+it or the levels picked out by a template such as "{2}", where {1} is the first
+level.  Either way the name is made Alphabetic, so "tele/living-room/SENSOR" with
+the template "{2}" is stored in "livingRoom".
+
+A payload holding a JSON object has a field for each member, with nested objects
+flattened ({"ENERGY":{"Power":5}} becomes ENERGYPower), while arrays and nulls are
+skipped.  A bare number, such as "21.5", becomes a single field named value.  Numbers
+are always stored as floats, as sensors rarely say "21.0" when they mean it.
+
+Retained messages are ignored, as they would be stored again on every reconnect.*/
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/npotts/go-patterns/stoppable"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/mqttclient"
+)
+
+var errNoTopics = errors.New("No topics to subscribe to")
+
+/*Config holds the settings for a MQTT attendant*/
+type Config struct {
+	Broker   string         //broker url, eg "tcp://localhost:1883"
+	ClientID string         //if empty, a random one is used
+	Username string         //if set, used to log in to the broker
+	Password string         //password for Username
+	Topics   []string       //topic filters to subscribe to, eg "tele/+/SENSOR"
+	Table    string         //table name template, eg "{2}".  Empty means the whole topic
+	QoS      byte           //quality of service to subscribe with
+	Stats    *homehub.Stats //if set, counts are kept here, where other attendants may add theirs
+}
+
+/*MQTT subscribes to topics on a broker, and forwards the messages published to them
+to a backend.  It reconnects, and subscribes again, whenever the connection is lost.*/
+type MQTT struct {
+	client  paho.Client
+	topics  map[string]byte
+	table   string
+	stats   *homehub.Stats
+	stopper stoppable.Halter
+
+	registrar homehub.Registrar
+}
+
+/*AttendantConfig returns a homehub.Attendant configured by cfg, or a non-nil error*/
+func AttendantConfig(cfg Config) (homehub.Attendant, error) {
+	return New(cfg)
+}
+
+/*New returns a MQTT attendant configured by cfg, or a non-nil error.  It connects in
+the background, retrying until the broker can be reached.*/
+func New(cfg Config) (*MQTT, error) {
+	opts, err := mqttclient.Options(cfg.Broker, cfg.ClientID, cfg.Username, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Topics) == 0 {
+		return nil, errNoTopics
+	}
+	m := &MQTT{
+		topics:  map[string]byte{},
+		table:   cfg.Table,
+		stats:   cfg.Stats,
+		stopper: stoppable.NewStopable(),
+	}
+	for _, topic := range cfg.Topics {
+		m.topics[topic] = cfg.QoS
+	}
+	if m.stats == nil {
+		m.stats = homehub.NewStats()
+	}
+	m.client = paho.NewClient(opts.SetOnConnectHandler(m.subscribe))
+	m.client.Connect()
+	return m, nil
+}
+
+/*subscribe subscribes to the topics, each time a connection is made*/
+func (m *MQTT) subscribe(client paho.Client) {
+	client.SubscribeMultiple(m.topics, m.message)
+}
+
+/*Use sets the backend*/
+func (m *MQTT) Use(backend homehub.Backend) {
+	m.registrar.Use(backend)
+}
+
+/*Stop disconnects from the broker, or stops trying to connect to it*/
+func (m *MQTT) Stop() {
+	defer m.stopper.Die()
+	if m.stopper.Alive() {
+		m.client.Disconnect(250)
+	}
+}
+
+/*level matches a topic level in a table template*/
+var level = regexp.MustCompile(`\{([0-9]+)\}`)
+
+/*tableFor returns the table a message on topic is for*/
+func (m *MQTT) tableFor(topic string) homehub.Alphabetic {
+	if m.table == "" {
+		return homehub.MakeAlphabetic(topic)
+	}
+	levels := strings.Split(topic, "/")
+	return homehub.MakeAlphabetic(level.ReplaceAllStringFunc(m.table, func(ref string) string {
+		i, _ := strconv.Atoi(ref[1 : len(ref)-1])
+		if i < 1 || i > len(levels) {
+			return ""
+		}
+		return levels[i-1]
+	}))
+}
+
+/*fields decodes payload, a JSON object or a bare number*/
+func fields(payload []byte) (map[homehub.Alphabetic]homehub.Field, error) {
+	payload = bytes.TrimSpace(payload)
+	data := map[homehub.Alphabetic]homehub.Field{}
+	if len(payload) > 0 && payload[0] == '{' {
+		if err := flatten("", payload, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	if _, err := strconv.ParseFloat(string(payload), 64); err != nil {
+		return nil, fmt.Errorf("Payload is neither a JSON object nor a number")
+	}
+	field := homehub.Field{}
+	if err := field.UnmarshalJSON(payload); err != nil {
+		return nil, err
+	}
+	data["value"], _ = homehub.NewField(homehub.ModeFloat, field.Value)
+	return data, nil
+}
+
+/*flatten adds the members of the JSON object in raw to data, with their names
+prefixed by prefix*/
+func flatten(prefix string, raw []byte, data map[homehub.Alphabetic]homehub.Field) error {
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return fmt.Errorf("Invalid JSON: %v", err)
+	}
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := bytes.TrimSpace(members[key])
+		if len(value) == 0 || value[0] == '[' {
+			continue
+		}
+		if value[0] == '{' {
+			if err := flatten(prefix+key+"_", value, data); err != nil {
+				return err
+			}
+			continue
+		}
+		field := homehub.Field{}
+		if err := field.UnmarshalJSON(value); err != nil {
+			return err
+		}
+		switch field.Mode() {
+		case homehub.ModeNull:
+			continue
+		case homehub.ModeInt:
+			field, _ = homehub.NewField(homehub.ModeFloat, field.Value)
+		}
+		name := homehub.MakeAlphabetic(prefix + key)
+		if _, ok := data[name]; ok {
+			return fmt.Errorf("%q and another member are both named %q", prefix+key, name)
+		}
+		data[name] = field
+	}
+	return nil
+}
+
+/*decode forms the Datam a message on topic carrying payload holds*/
+func (m *MQTT) decode(topic string, payload []byte) (homehub.Datam, error) {
+	datam := homehub.Datam{Table: m.tableFor(topic)}
+	var err error
+	if datam.Data, err = fields(payload); err != nil {
+		return datam, err
+	}
+	return datam, datam.Validate()
+}
+
+/*message handles a message published to one of the topics*/
+func (m *MQTT) message(_ paho.Client, msg paho.Message) {
+	if msg.Retained() {
+		return
+	}
+	datam, err := m.decode(msg.Topic(), msg.Payload())
+	if err != nil {
+		table := datam.Table
+		if !table.Valid() {
+			table = ""
+		}
+		m.stats.Record("mqtt", table, homehub.StatRejected, len(msg.Payload()))
+		return
+	}
+	outcome := homehub.StatAccepted
+	if m.registrar.Store(datam) != nil {
+		outcome = homehub.StatFailed
+	}
+	m.stats.Record("mqtt", datam.Table, outcome, len(msg.Payload()))
+}
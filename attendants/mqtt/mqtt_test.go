@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/backendtest"
+	"github.com/npotts/homehub/internal/mqtttest"
+)
+
+/*wait waits up to a few seconds for cond to become true*/
+func wait(t *testing.T, what string, cond func() bool) {
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestMQTT_tableFor(t *testing.T) {
+	tests := map[string]map[string]homehub.Alphabetic{
+		"": {
+			"attic":                   "attic",
+			"tele/living-room/SENSOR": "teleLivingRoomSENSOR",
+		},
+		"{2}": {
+			"tele/living-room/SENSOR": "livingRoom",
+			"tele":                    "",
+		},
+		"zigbee_{2}_{1}": {
+			"home/porch": "zigbeePorchHome",
+		},
+	}
+	for template, topics := range tests {
+		m := &MQTT{table: template}
+		for topic, want := range topics {
+			if got := m.tableFor(topic); got != want {
+				t.Errorf("%q %q: got %q, wanted %q", template, topic, got, want)
+			}
+		}
+	}
+}
+
+func Test_fields(t *testing.T) {
+	data, err := fields([]byte(`{"Time":"2024-01-02T03:04:05","ENERGY":{"Power":5,"Total":1.5},"Ids":[1,2],"Off":null,"On":true}`))
+	if err != nil {
+		t.Fatalf("Unable to decode: %v", err)
+	}
+	want := map[homehub.Alphabetic]homehub.FieldMode{
+		"Time":        homehub.ModeString,
+		"ENERGYPower": homehub.ModeFloat,
+		"ENERGYTotal": homehub.ModeFloat,
+		"On":          homehub.ModeBool,
+	}
+	if len(data) != len(want) {
+		t.Errorf("Unexpected fields: %v", data)
+	}
+	for name, mode := range want {
+		if data[name].Mode() != mode {
+			t.Errorf("%s: got %v, wanted %v", name, data[name].Mode(), mode)
+		}
+	}
+
+	if data, err := fields([]byte(" 21 ")); err != nil || data["value"].Mode() != homehub.ModeFloat || data["value"].Value != 21.0 {
+		t.Errorf("Bare numbers should be a float value field: %v %v", data, err)
+	}
+	for _, bad := range []string{"", "ON", "[1,2]", `{"a":1`, `{"a_b":1,"aB":2}`} {
+		if _, err := fields([]byte(bad)); err == nil {
+			t.Errorf("%q: should not decode", bad)
+		}
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Unable to start a broker: %v", err)
+	}
+	defer broker.Close()
+
+	if _, err := New(Config{Broker: "localhost:1883", Topics: []string{"#"}}); err == nil {
+		t.Errorf("Should require a broker url")
+	}
+	if _, err := New(Config{Broker: broker.URL()}); err == nil {
+		t.Errorf("Should require topics")
+	}
+
+	//retained messages are sent on subscribing, and ignored
+	broker.Publish("sensors/porch/temp", []byte("19"), true)
+	m, err := New(Config{Broker: broker.URL(), Topics: []string{"tele/+/SENSOR", "sensors/#"}, Table: "{2}"})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer m.Stop()
+	var _ homehub.Attendant = m
+	mem := &backendtest.Memory{}
+	m.Use(mem)
+	wait(t, "subscriptions", func() bool { return broker.Subscriptions() == 2 })
+
+	broker.Publish("tele/attic/SENSOR", []byte(`{"Temperature":21.5,"Humidity":40}`), false)
+	broker.Publish("tele/attic/SENSOR", []byte(`{"Temperature":21,"Humidity":41}`), false)
+	broker.Publish("sensors/garage/temp", []byte("12.5"), false)
+	broker.Publish("tele/attic/SENSOR", []byte("ON"), false)
+	broker.Publish("tele/full/SENSOR", []byte("1"), false)
+	broker.Publish("elsewhere/attic", []byte("1"), false)
+	wait(t, "messages", func() bool {
+		c := m.stats.Snapshot().Attendants["mqtt"]
+		return c.Accepted+c.Rejected+c.Failed == 5
+	})
+	if reg, stored := mem.Counts(); reg != 2 || stored != 3 {
+		t.Errorf("Should register each set of fields once, and store all: %d %d", reg, stored)
+	}
+	snap := m.stats.Snapshot()
+	if snap.Tables["attic"].Accepted != 2 || snap.Tables["attic"].Rejected != 1 || snap.Tables["full"].Failed != 1 || snap.Tables["garage"].Accepted != 1 {
+		t.Errorf("Unexpected stats: %+v", snap.Tables)
+	}
+
+	//the retained message is sent again on resubscribing
+	broker.Drop()
+	wait(t, "resubscribing", func() bool { return broker.Subscriptions() == 4 })
+	broker.Publish("sensors/garage/temp", []byte("13"), false)
+	wait(t, "messages after reconnecting", func() bool {
+		return m.stats.Snapshot().Tables["garage"].Accepted == 2
+	})
+	if _, stored := mem.Counts(); stored != 4 {
+		t.Errorf("Retained messages should not be stored: %d", stored)
+	}
+
+	m.Stop()
+	m.Stop()
+}
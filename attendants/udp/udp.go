@@ -0,0 +1,195 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package udp provides an attendant that accepts data in UDP datagrams.  Each
+datagram holds one JSON Datam, or a homehub.DatamBatch as a JSON array or newline
+delimited JSON, and nothing is sent back.  It suits small devices that would
+rather fire off a packet than hold a conversation.
+
+If a secret is configured, each datagram must start with the hex encoded
+HMAC-SHA256 of the JSON that follows it, keyed by the secret, and a newline:
+
+	4f1c...9a2e
+	{"table":"attic","data":{"temp":21.5}}
+
+Datagrams that fail the check are dropped.*/
+package udp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+
+	"github.com/npotts/go-patterns/stoppable"
+
+	"github.com/npotts/homehub"
+)
+
+/*maxDatagram is the largest UDP payload possible*/
+const maxDatagram = 65535
+
+var errSignature = errors.New("Missing or invalid HMAC")
+
+/*Config holds the settings for a UDP attendant*/
+type Config struct {
+	Listen string         //listen address, eg ":8081"
+	Secret string         //if set, datagrams must carry a HMAC-SHA256 keyed by it
+	Stats  *homehub.Stats //if set, counts are kept here, where other attendants may add theirs
+}
+
+/*UDP listens for datagrams and forwards what they hold to a backend.  Tables are
+registered the first time they arrive with a given set of fields, and each Datam
+is then stored.*/
+type UDP struct {
+	conn    *net.UDPConn
+	secret  []byte
+	stats   *homehub.Stats
+	stopper stoppable.Halter
+	done    chan struct{} //closed once the listener has exited
+
+	registrar homehub.Registrar
+}
+
+/*Attendant returns a homehub.Attendant listening on listen, or a non-nil error*/
+func Attendant(listen string) (homehub.Attendant, error) {
+	return New(Config{Listen: listen})
+}
+
+/*AttendantConfig returns a homehub.Attendant configured by cfg, or a non-nil error*/
+func AttendantConfig(cfg Config) (homehub.Attendant, error) {
+	return New(cfg)
+}
+
+/*New returns a running UDP attendant configured by cfg, or a non-nil error*/
+func New(cfg Config) (*UDP, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	u := &UDP{
+		conn:    conn,
+		stats:   cfg.Stats,
+		stopper: stoppable.NewStopable(),
+		done:    make(chan struct{}),
+	}
+	if cfg.Secret != "" {
+		u.secret = []byte(cfg.Secret)
+	}
+	if u.stats == nil {
+		u.stats = homehub.NewStats()
+	}
+	go u.listen()
+	return u, nil
+}
+
+/*Addr returns the address being listened on*/
+func (u *UDP) Addr() net.Addr {
+	return u.conn.LocalAddr()
+}
+
+/*Use sets the backend*/
+func (u *UDP) Use(backend homehub.Backend) {
+	u.registrar.Use(backend)
+}
+
+/*Stop closes the socket and waits for the listener to exit*/
+func (u *UDP) Stop() {
+	defer u.stopper.Die()
+	if u.stopper.Alive() {
+		u.conn.Close()
+		<-u.done
+	}
+}
+
+/*listen handles datagrams until the socket is closed*/
+func (u *UDP) listen() {
+	defer close(u.done)
+	buf := make([]byte, maxDatagram)
+	for {
+		n, _, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if u.stopper.Alive() && !errors.Is(err, net.ErrClosed) {
+				continue
+			}
+			return
+		}
+		u.handle(buf[:n])
+	}
+}
+
+/*Sign returns datagram carrying payload, signed with secret as a UDP attendant expects*/
+func Sign(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return append([]byte(hex.EncodeToString(mac.Sum(nil))+"\n"), payload...)
+}
+
+/*verify checks the HMAC at the start of datagram, if a secret is configured, and
+returns the payload following it*/
+func (u *UDP) verify(datagram []byte) ([]byte, error) {
+	if u.secret == nil {
+		return datagram, nil
+	}
+	i := bytes.IndexByte(datagram, '\n')
+	if i < 0 {
+		return nil, errSignature
+	}
+	sum, err := hex.DecodeString(string(bytes.TrimSpace(datagram[:i])))
+	if err != nil {
+		return nil, errSignature
+	}
+	payload := datagram[i+1:]
+	mac := hmac.New(sha256.New, u.secret)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, errSignature
+	}
+	return payload, nil
+}
+
+/*handle decodes and stores a single datagram*/
+func (u *UDP) handle(datagram []byte) {
+	payload, err := u.verify(datagram)
+	if err != nil {
+		u.stats.Record("udp", "", homehub.StatRejected, len(datagram))
+		return
+	}
+	batch, errs := homehub.DatamBatch{{}}, []error{nil}
+	if homehub.IsBatch(payload) {
+		if batch, errs, err = homehub.DecodeBatch(payload); err != nil {
+			u.stats.Record("udp", "", homehub.StatRejected, len(datagram))
+			return
+		}
+	} else {
+		batch[0], errs[0] = homehub.DecodeDatam(payload)
+	}
+
+	for i, datam := range batch {
+		size := homehub.Share(len(datagram), len(batch), i)
+		if errs[i] != nil {
+			table := datam.Table
+			if !table.Valid() {
+				table = ""
+			}
+			u.stats.Record("udp", table, homehub.StatRejected, size)
+			continue
+		}
+		outcome := homehub.StatAccepted
+		if u.registrar.Store(datam) != nil {
+			outcome = homehub.StatFailed
+		}
+		u.stats.Record("udp", datam.Table, outcome, size)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/backendtest"
+)
+
+/*send sends each datagram to u, then waits until the stats show them all handled.
+Every datagram is recorded with all its bytes, however many Datam it holds, so
+they are all handled once the bytes recorded have grown by as many as were sent.*/
+func send(t *testing.T, u *UDP, datagrams ...string) {
+	conn, err := net.Dial("udp", u.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+	want := u.stats.Snapshot().Total.Bytes
+	for _, d := range datagrams {
+		conn.Write([]byte(d))
+		want += uint64(len(d))
+	}
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		if u.stats.Snapshot().Total.Bytes == want {
+			return
+		}
+	}
+	t.Fatalf("Datagrams never arrived: %d of %d bytes", u.stats.Snapshot().Total.Bytes, want)
+}
+
+func TestUDP(t *testing.T) {
+	u, err := New(Config{Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer u.Stop()
+	var _ homehub.Attendant = u
+	mem := &backendtest.Memory{}
+	u.Use(mem)
+
+	good := `{"table":"attic", "data": {"temp": 21.5}}`
+	send(t, u, good, good, "["+good+","+`{"table":"attic", "data": {"temp": 1, "humidity": 2}}`+"]", `{not json}`)
+	reg, stored := mem.Counts()
+	if reg != 2 || stored != 4 {
+		t.Errorf("Should register each set of fields once, and store all: %d %d", reg, stored)
+	}
+	snap := u.stats.Snapshot()
+	if attic := snap.Tables["attic"]; attic.Accepted != 4 || snap.Attendants["udp"].Rejected != 1 {
+		t.Errorf("Unexpected stats: %+v", snap)
+	}
+
+	mem.Fail(true)
+	send(t, u, good)
+	if snap := u.stats.Snapshot(); snap.Tables["attic"].Failed != 1 {
+		t.Errorf("Should count failures: %+v", snap.Tables["attic"])
+	}
+
+	u.Stop()
+	u.Stop()
+	if _, err := net.ListenPacket("udp", u.Addr().String()); err != nil {
+		t.Errorf("Socket should be closed: %v", err)
+	}
+}
+
+func TestUDP_Secret(t *testing.T) {
+	u, err := New(Config{Listen: "127.0.0.1:0", Secret: "sekrit"})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer u.Stop()
+	mem := &backendtest.Memory{}
+	u.Use(mem)
+
+	good := []byte(`{"table":"attic", "data": {"temp": 21.5}}`)
+	send(t, u, string(good), string(Sign("wrong", good)), "zz\n"+string(good), string(Sign("sekrit", good)))
+	if _, stored := mem.Counts(); stored != 1 {
+		t.Errorf("Only the signed datagram should be stored: %d", stored)
+	}
+	if snap := u.stats.Snapshot(); snap.Attendants["udp"].Rejected != 3 {
+		t.Errorf("Should reject unsigned datagrams: %+v", snap.Attendants["udp"])
+	}
+
+	if _, err := New(Config{Listen: "not an address"}); err == nil {
+		t.Errorf("Should not listen on a bad address")
+	}
+}
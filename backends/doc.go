@@ -10,6 +10,16 @@ This file is part of the HomeHub project
 
 sql contains a SQL implementation SQL capable of using sqlite, postgres, and potentially mysql RMDBS
 
+mangos wraps another backend, publishing everything it stores on a mangos PUB socket
+
+mqtt wraps another backend, publishing everything it stores to a MQTT broker
+
+multi forwards to several backends, such as a database and its archive
+
+router sends each table to one of several backends, chosen by the table's name
+
+spool wraps another backend, logging to disk first so nothing is lost while it is away
+
 one could conceive of backends for CSV, NOSQL, HDF, etc
 */
 package backends
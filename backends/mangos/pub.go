@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package mangopub provides backends that pass data on over mangos (nanomsg) sockets.
+
+Publisher wraps another homehub.Backend, and publishes every Datam it stores on a
+PUB socket as the table, a space and the Datam as JSON:
+
+	attic {"table":"attic","data":{"temp":21.5}}
+
+Subscribers can filter on the table by subscribing to eg "attic ", including the
+space.  This is also what the mangos Sub attendant takes, so one hub can feed another.*/
+package mangopub
+
+import (
+	"encoding/json"
+
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/protocol/pub"
+	"github.com/go-mangos/mangos/transport/ipc"
+	"github.com/go-mangos/mangos/transport/tcp"
+
+	"github.com/npotts/homehub"
+)
+
+/*Publisher is a homehub.Backend that publishes what the Backend it wraps stores*/
+type Publisher struct {
+	homehub.Backend
+	sock mangos.Socket
+}
+
+/*New returns be wrapped in a Publisher listening on url, such as "tcp://*:8083",
+for subscribers to dial, or a non-nil error.  If be is a homehub.BatchBackend,
+so is what is returned.*/
+func New(be homehub.Backend, url string) (homehub.Backend, error) {
+	sock, err := pub.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	sock.AddTransport(ipc.NewTransport())
+	sock.AddTransport(tcp.NewTransport())
+	if err = sock.Listen(url); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return wrap(be, sock), nil
+}
+
+/*wrap wraps be in a Publisher sending on sock*/
+func wrap(be homehub.Backend, sock mangos.Socket) homehub.Backend {
+	p := Publisher{Backend: be, sock: sock}
+	if _, ok := be.(homehub.BatchBackend); ok {
+		return &BatchPublisher{p}
+	}
+	return &p
+}
+
+/*publish sends datam to any subscribers.  PUB sockets drop what subscribers are
+not ready for rather than block, so this never holds up storing.*/
+func (p *Publisher) publish(datam homehub.Datam) {
+	raw, err := json.Marshal(datam)
+	if err != nil {
+		return
+	}
+	p.sock.Send(append([]byte(string(datam.Table)+" "), raw...))
+}
+
+/*Store conforms to the homehub.Backend interface*/
+func (p *Publisher) Store(datam homehub.Datam) error {
+	if err := p.Backend.Store(datam); err != nil {
+		return err
+	}
+	p.publish(datam)
+	return nil
+}
+
+/*Stop closes the socket, then stops the wrapped Backend*/
+func (p *Publisher) Stop() {
+	p.sock.Close()
+	p.Backend.Stop()
+}
+
+/*Unwrap conforms to the homehub.Wrapper interface*/
+func (p *Publisher) Unwrap() homehub.Backend {
+	return p.Backend
+}
+
+/*BatchPublisher is a Publisher around a homehub.BatchBackend*/
+type BatchPublisher struct {
+	Publisher
+}
+
+/*StoreBatch conforms to the homehub.BatchBackend interface*/
+func (p *BatchPublisher) StoreBatch(batch homehub.DatamBatch) error {
+	if err := p.Backend.(homehub.BatchBackend).StoreBatch(batch); err != nil {
+		return err
+	}
+	for _, datam := range batch {
+		p.publish(datam)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package mangopub
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-mangos/mangos"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/backendtest"
+)
+
+/*socket records what is sent on it*/
+type socket struct {
+	mangos.Socket
+	sent   []string
+	closed bool
+}
+
+func (s *socket) Send(msg []byte) error {
+	s.sent = append(s.sent, string(msg))
+	return nil
+}
+func (s *socket) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestPublisher(t *testing.T) {
+	attic, full := homehub.GoodSample, homehub.GoodSample
+	attic.Table, full.Table = "attic", "full"
+
+	sock, mem := &socket{}, &backendtest.Memory{}
+	be := wrap(mem, sock)
+	if _, ok := be.(homehub.BatchBackend); ok {
+		t.Errorf("Should not be a BatchBackend unless what it wraps is")
+	}
+	if be.Store(attic) != nil || be.Store(full) == nil {
+		t.Errorf("Should pass on what the wrapped backend returns")
+	}
+	if len(sock.sent) != 1 || !strings.HasPrefix(sock.sent[0], "attic {") {
+		t.Fatalf("Should publish only what was stored, after its table: %q", sock.sent)
+	}
+	got := homehub.Datam{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(sock.sent[0], "attic ")), &got); err != nil || got.Table != "attic" {
+		t.Errorf("Should publish the Datam as JSON: %v %+v", err, got)
+	}
+	if w, ok := be.(homehub.Wrapper); !ok || w.Unwrap() != mem {
+		t.Errorf("Should unwrap to the wrapped backend")
+	}
+	be.Stop()
+	if !sock.closed || mem.Stopped() != 1 {
+		t.Errorf("Should close the socket and stop the wrapped backend")
+	}
+
+	sock, bmem := &socket{}, &backendtest.Batch{}
+	bb, ok := wrap(bmem, sock).(homehub.BatchBackend)
+	if !ok {
+		t.Fatalf("Should be a BatchBackend if what it wraps is")
+	}
+	if bb.StoreBatch(homehub.DatamBatch{attic, full}) == nil || len(sock.sent) != 0 {
+		t.Errorf("Should publish nothing from a batch that failed: %q", sock.sent)
+	}
+	if bb.StoreBatch(homehub.DatamBatch{attic, attic}) != nil || len(sock.sent) != 2 {
+		t.Errorf("Should publish every Datam of a batch: %q", sock.sent)
+	}
+
+	if _, err := New(mem, "nonsense://"); err == nil {
+		t.Errorf("Should not listen on a bad url")
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package mqttpub provides a backend that passes data on to a MQTT broker, for the
+likes of Home Assistant to pick up.
+
+Publisher wraps another homehub.Backend, and publishes every Datam it stores as JSON
+to a topic formed from a template, where {table} is replaced by the Datam's table:
+
+	homehub/attic {"table":"attic","data":{"temp":21.5}}
+
+When tables are registered, what is known of each is published, retained, to the
+same topic with "/schema" appended, whenever a field is added:
+
+	homehub/attic/schema {"table":"attic","fields":{"temp":"float"}}
+
+If a discovery prefix is configured, each field is also announced using Home
+Assistant's MQTT discovery, as a sensor (or a binary_sensor for bools) grouped in a
+device per table.
+
+Messages are queued, so the broker being away does not hold up storing.  Up to a
+configured number are kept for when it returns, after which the oldest are dropped.*/
+package mqttpub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/mqttclient"
+	"github.com/npotts/homehub/internal/queue"
+)
+
+/*DefaultTopic is the topic template used if none is configured*/
+const DefaultTopic = "homehub/{table}"
+
+/*DefaultBuffer is how many messages are queued if no size is configured*/
+const DefaultBuffer = 1000
+
+/*publishTimeout is how long the broker has to accept each message*/
+const publishTimeout = 10 * time.Second
+
+/*flushTimeout is how long the broker has, when stopping, to accept everything queued*/
+const flushTimeout = 10 * time.Second
+
+/*retryInterval is how often delivery is retried while the broker is away*/
+const retryInterval = 500 * time.Millisecond
+
+/*Config holds the settings for a Publisher*/
+type Config struct {
+	Broker    string //broker url, eg "tcp://localhost:1883"
+	ClientID  string //if empty, a random one is used
+	Username  string //if set, used to log in to the broker
+	Password  string //password for Username
+	Topic     string //topic template, where {table} is replaced by the table.  Defaults to DefaultTopic
+	QoS       byte   //quality of service to publish with: 0, 1 or 2
+	Discovery string //Home Assistant discovery prefix, usually "homeassistant".  Empty means none
+	Buffer    int    //messages queued while the broker is away.  Defaults to DefaultBuffer
+}
+
+/*message is queued to be published*/
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+/*Publisher is a homehub.Backend that publishes what the Backend it wraps stores*/
+type Publisher struct {
+	homehub.Backend
+	client    paho.Client
+	topic     string
+	qos       byte
+	discovery string
+	queue     chan message
+	dropped   uint64
+	stop      chan struct{}
+	done      chan struct{} //closed once the sender has exited
+	held      *message      //what the sender was still retrying when stopped
+	once      sync.Once
+
+	mu     sync.Mutex
+	fields map[homehub.Alphabetic]map[homehub.Alphabetic]homehub.FieldMode //what has been announced of each table
+}
+
+/*New returns be wrapped in a Publisher configured by cfg, or a non-nil error.  If be
+is a homehub.BatchBackend, so is what is returned.  It connects in the background,
+retrying until the broker can be reached.*/
+func New(be homehub.Backend, cfg Config) (homehub.Backend, error) {
+	opts, err := mqttclient.Options(cfg.Broker, cfg.ClientID, cfg.Username, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.QoS > 2 {
+		return nil, fmt.Errorf("QoS must be 0, 1 or 2, not %d", cfg.QoS)
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultTopic
+	}
+	if !strings.Contains(cfg.Topic, "{table}") {
+		return nil, fmt.Errorf("Topic %q does not hold {table}", cfg.Topic)
+	}
+	if cfg.Buffer < 1 {
+		cfg.Buffer = DefaultBuffer
+	}
+	p := &Publisher{
+		Backend:   be,
+		topic:     cfg.Topic,
+		qos:       cfg.QoS,
+		discovery: cfg.Discovery,
+		queue:     make(chan message, cfg.Buffer),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		fields:    map[homehub.Alphabetic]map[homehub.Alphabetic]homehub.FieldMode{},
+	}
+	p.client = paho.NewClient(opts)
+	p.client.Connect()
+
+	if _, ok := be.(homehub.BatchBackend); ok {
+		go p.send()
+		return &BatchPublisher{p}, nil
+	}
+	go p.send()
+	return p, nil
+}
+
+/*Dropped returns how many messages were dropped, because the queue was full or the
+broker did not take them before stopping*/
+func (p *Publisher) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+/*enqueue queues msg without blocking, dropping the oldest queued message if full*/
+func (p *Publisher) enqueue(msg message) {
+	if dropped := queue.Offer(p.queue, msg); dropped > 0 {
+		atomic.AddUint64(&p.dropped, dropped)
+	}
+}
+
+/*publish sends msg to the broker, returning true once it has been accepted within timeout*/
+func (p *Publisher) publish(msg message, timeout time.Duration) bool {
+	if !p.client.IsConnectionOpen() || timeout <= 0 {
+		return false
+	}
+	t := p.client.Publish(msg.topic, p.qos, msg.retain, msg.payload)
+	return t.WaitTimeout(timeout) && t.Error() == nil
+}
+
+/*send publishes queued messages until stopped, retrying each until the broker accepts it*/
+func (p *Publisher) send() {
+	defer close(p.done)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case msg := <-p.queue:
+			for !p.publish(msg, publishTimeout) {
+				select {
+				case <-p.stop:
+					p.held = &msg
+					return
+				case <-time.After(retryInterval):
+				}
+			}
+		}
+	}
+}
+
+/*topicFor returns the topic Datam for table are published to*/
+func (p *Publisher) topicFor(table homehub.Alphabetic) string {
+	return strings.Replace(p.topic, "{table}", string(table), -1)
+}
+
+/*Store conforms to the homehub.Backend interface*/
+func (p *Publisher) Store(datam homehub.Datam) error {
+	if err := p.Backend.Store(datam); err != nil {
+		return err
+	}
+	p.queueDatam(datam)
+	return nil
+}
+
+/*queueDatam queues datam to be published*/
+func (p *Publisher) queueDatam(datam homehub.Datam) {
+	raw, err := json.Marshal(datam)
+	if err != nil {
+		return
+	}
+	p.enqueue(message{topic: p.topicFor(datam.Table), payload: raw})
+}
+
+/*Register conforms to the homehub.Backend interface.  Once the wrapped Backend has
+registered datam, any fields not seen before are announced.*/
+func (p *Publisher) Register(datam homehub.Datam) error {
+	if err := p.Backend.Register(datam); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known, ok := p.fields[datam.Table]
+	if !ok {
+		known = map[homehub.Alphabetic]homehub.FieldMode{}
+		p.fields[datam.Table] = known
+	}
+	added := []homehub.Alphabetic{}
+	for name, field := range datam.Data {
+		if mode, ok := known[name]; !ok || mode != field.Mode() {
+			known[name] = field.Mode()
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if raw, err := json.Marshal(schema{Table: datam.Table, Fields: known}); err == nil {
+		p.enqueue(message{topic: p.topicFor(datam.Table) + "/schema", payload: raw, retain: true})
+	}
+	if p.discovery != "" {
+		for _, name := range added {
+			p.announce(datam.Table, name, known[name])
+		}
+	}
+	return nil
+}
+
+/*schema is published to describe a table*/
+type schema struct {
+	Table  homehub.Alphabetic                       `json:"table"`
+	Fields map[homehub.Alphabetic]homehub.FieldMode `json:"fields"`
+}
+
+/*discovery is a Home Assistant MQTT discovery config*/
+type discovery struct {
+	Name          string `json:"name"`
+	UniqueID      string `json:"unique_id"`
+	StateTopic    string `json:"state_topic"`
+	ValueTemplate string `json:"value_template"`
+	Device        struct {
+		Identifiers []string `json:"identifiers"`
+		Name        string   `json:"name"`
+	} `json:"device"`
+}
+
+/*announce queues the Home Assistant discovery config for a field of table*/
+func (p *Publisher) announce(table, name homehub.Alphabetic, mode homehub.FieldMode) {
+	id := fmt.Sprintf("homehub_%s_%s", table, name)
+	cfg := discovery{
+		Name:          string(name),
+		UniqueID:      id,
+		StateTopic:    p.topicFor(table),
+		ValueTemplate: fmt.Sprintf("{{ value_json.data.%s }}", name),
+	}
+	cfg.Device.Identifiers, cfg.Device.Name = []string{"homehub_" + string(table)}, string(table)
+	component := "sensor"
+	if mode == homehub.ModeBool {
+		component = "binary_sensor"
+		cfg.ValueTemplate = fmt.Sprintf("{{ 'ON' if value_json.data.%s else 'OFF' }}", name)
+	}
+	if raw, err := json.Marshal(cfg); err == nil {
+		p.enqueue(message{topic: fmt.Sprintf("%s/%s/%s/config", p.discovery, component, id), payload: raw, retain: true})
+	}
+}
+
+/*Stop publishes what is queued if the broker takes it within flushTimeout, counting
+the rest as dropped, disconnects, then stops the wrapped Backend*/
+func (p *Publisher) Stop() {
+	p.once.Do(func() {
+		close(p.stop)
+		<-p.done
+		deadline := time.Now().Add(flushTimeout)
+		flush := func(msg message) {
+			if !p.publish(msg, time.Until(deadline)) {
+				atomic.AddUint64(&p.dropped, 1)
+			}
+		}
+		if p.held != nil {
+			flush(*p.held)
+		}
+		for flushed := false; !flushed; {
+			select {
+			case msg := <-p.queue:
+				flush(msg)
+			default:
+				flushed = true
+			}
+		}
+		p.client.Disconnect(250)
+		p.Backend.Stop()
+	})
+}
+
+/*Unwrap conforms to the homehub.Wrapper interface*/
+func (p *Publisher) Unwrap() homehub.Backend {
+	return p.Backend
+}
+
+/*BatchPublisher is a Publisher around a homehub.BatchBackend*/
+type BatchPublisher struct {
+	*Publisher
+}
+
+/*StoreBatch conforms to the homehub.BatchBackend interface*/
+func (p *BatchPublisher) StoreBatch(batch homehub.DatamBatch) error {
+	if err := p.Backend.(homehub.BatchBackend).StoreBatch(batch); err != nil {
+		return err
+	}
+	for _, datam := range batch {
+		p.queueDatam(datam)
+	}
+	return nil
+}
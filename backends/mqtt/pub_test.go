@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package mqttpub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/backendtest"
+	"github.com/npotts/homehub/internal/mqtttest"
+)
+
+/*receive returns the next n messages sent to c, or fails the test*/
+func receive(t *testing.T, c <-chan mqtttest.Message, n int) []mqtttest.Message {
+	msgs := []mqtttest.Message{}
+	timeout := time.After(5 * time.Second)
+	for len(msgs) < n {
+		select {
+		case msg := <-c:
+			msgs = append(msgs, msg)
+		case <-timeout:
+			t.Fatalf("Timed out with %d of %d messages", len(msgs), n)
+		}
+	}
+	return msgs
+}
+
+func datam(table homehub.Alphabetic, data string) homehub.Datam {
+	d := homehub.Datam{Table: table}
+	json.Unmarshal([]byte(data), &d.Data)
+	return d
+}
+
+func TestPublisher(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Unable to start a broker: %v", err)
+	}
+	defer broker.Close()
+	for _, cfg := range []Config{
+		{Broker: "localhost:1883"},
+		{Broker: broker.URL(), QoS: 3},
+		{Broker: broker.URL(), Topic: "homehub"},
+	} {
+		if _, err := New(&backendtest.Memory{}, cfg); err == nil {
+			t.Errorf("%+v: should not be accepted", cfg)
+		}
+	}
+
+	mem := &backendtest.Memory{}
+	be, err := New(mem, Config{Broker: broker.URL(), Topic: "hh/{table}/state", QoS: 1, Discovery: "homeassistant"})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	if _, ok := be.(homehub.BatchBackend); ok {
+		t.Errorf("Should not be a BatchBackend unless what it wraps is")
+	}
+	if w, ok := be.(homehub.Wrapper); !ok || w.Unwrap() != mem {
+		t.Errorf("Should unwrap to the wrapped backend")
+	}
+	states, schemas, configs := broker.Watch("hh/+/state", 10), broker.Watch("hh/+/state/schema", 10), broker.Watch("homeassistant/#", 10)
+
+	attic := datam("attic", `{"temp": 21.5, "open": false}`)
+	if be.Register(attic) != nil || be.Register(datam("full", `{"temp": 1}`)) == nil {
+		t.Errorf("Should pass on what the wrapped backend returns")
+	}
+	be.Register(attic)
+	be.Register(datam("attic", `{"humidity": 40.0}`))
+	if be.Store(attic) != nil || be.Store(datam("full", `{"temp": 1}`)) == nil {
+		t.Errorf("Should pass on what the wrapped backend returns")
+	}
+
+	msg := receive(t, states, 1)[0]
+	got := homehub.Datam{}
+	if err := json.Unmarshal(msg.Payload, &got); err != nil || msg.Topic != "hh/attic/state" || msg.Retain || got.Table != "attic" {
+		t.Errorf("Should publish the Datam as JSON: %v %+v", err, msg)
+	}
+	receive(t, schemas, 2)
+	raw, _ := broker.Retained("hh/attic/state/schema")
+	s := schema{}
+	if err := json.Unmarshal(raw, &s); err != nil || len(s.Fields) != 3 || s.Fields["open"] != homehub.ModeBool {
+		t.Errorf("Should retain every field of the table: %v %s", err, raw)
+	}
+	receive(t, configs, 3)
+	raw, _ = broker.Retained("homeassistant/binary_sensor/homehub_attic_open/config")
+	cfg := discovery{}
+	if err := json.Unmarshal(raw, &cfg); err != nil || cfg.StateTopic != "hh/attic/state" || cfg.Device.Name != "attic" {
+		t.Errorf("Should announce fields to Home Assistant: %v %s", err, raw)
+	}
+	if _, ok := broker.Retained("homeassistant/sensor/homehub_attic_humidity/config"); !ok {
+		t.Errorf("Should announce fields registered later")
+	}
+	select {
+	case msg := <-schemas:
+		t.Errorf("Should only announce new fields: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	be.Stop()
+	be.Stop()
+	if mem.Stopped() != 1 {
+		t.Errorf("Should stop the wrapped backend")
+	}
+}
+
+func TestPublisher_offline(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Unable to start a broker: %v", err)
+	}
+	url, addr := broker.URL(), broker.Addr()
+	broker.Close()
+
+	mem := &backendtest.Batch{}
+	be, err := New(mem, Config{Broker: url, Buffer: 2})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer be.Stop()
+	bb, ok := be.(homehub.BatchBackend)
+	if !ok {
+		t.Fatalf("Should be a BatchBackend if what it wraps is")
+	}
+	attic := datam("attic", `{"temp": 21.5}`)
+	if bb.StoreBatch(homehub.DatamBatch{attic, attic, attic, attic}) != nil || bb.StoreBatch(homehub.DatamBatch{attic, datam("full", `{"temp": 1}`)}) == nil {
+		t.Errorf("Should pass on what the wrapped backend returns")
+	}
+
+	broker, err = mqtttest.Listen(addr)
+	if err != nil {
+		t.Fatalf("Unable to restart the broker: %v", err)
+	}
+	defer broker.Close()
+	states := broker.Watch("#", 10)
+	dropped := int(be.(*BatchPublisher).Dropped())
+	if dropped < 1 {
+		t.Errorf("Should drop what does not fit in the queue")
+	}
+	receive(t, states, 4-dropped)
+}
+
+func TestPublisher_stop(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Unable to start a broker: %v", err)
+	}
+	url := broker.URL()
+	broker.Close()
+
+	be, err := New(&backendtest.Memory{}, Config{Broker: url, Buffer: 10})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	attic := datam("attic", `{"temp": 21.5}`)
+	for i := 0; i < 3; i++ {
+		be.Store(attic)
+	}
+	time.Sleep(50 * time.Millisecond) //let the sender take one to retry
+
+	start := time.Now()
+	be.Stop()
+	if elapsed := time.Since(start); elapsed > flushTimeout {
+		t.Errorf("Should give up flushing after %v: took %v", flushTimeout, elapsed)
+	}
+	if dropped := be.(*Publisher).Dropped(); dropped != 3 {
+		t.Errorf("Should count everything left unpublished as dropped, including what was being retried: %d", dropped)
+	}
+}
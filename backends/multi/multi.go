@@ -0,0 +1,203 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package multi provides a backend that fans out to several others, so that one
+attendant can, say, archive to sqlite while also feeding postgres.
+
+Every Register and Store is forwarded to each child in turn, and the Mode decides
+which failures are returned.  Errors name the child they came from.  Nothing is
+undone when a child fails, so in All mode some children may hold what another
+refused.*/
+package multi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/npotts/homehub"
+)
+
+/*Mode decides when forwarding to the children has failed*/
+type Mode int
+
+const (
+	//All fails if any child fails
+	All Mode = iota
+	//BestEffort fails only if every child fails
+	BestEffort
+	//Primary fails if the first child fails, in which case the rest are not tried.
+	//Failures of the rest are not returned.
+	Primary
+)
+
+var modeNames = map[Mode]string{
+	All:        "all",
+	BestEffort: "best-effort",
+	Primary:    "primary",
+}
+
+/*String conforms to the fmt.Stringer interface*/
+func (m Mode) String() string {
+	if name, ok := modeNames[m]; ok {
+		return name
+	}
+	return "invalid"
+}
+
+/*ParseMode returns the Mode named by name, one of "all", "best-effort" or "primary"*/
+func ParseMode(name string) (Mode, error) {
+	for mode, n := range modeNames {
+		if n == name {
+			return mode, nil
+		}
+	}
+	return All, fmt.Errorf("Unknown mode %q, must be all, best-effort or primary", name)
+}
+
+/*Child is a backend to forward to, and the name its errors are reported under*/
+type Child struct {
+	Name    string
+	Backend homehub.Backend
+}
+
+/*ChildError is the error a child returned*/
+type ChildError struct {
+	Child string
+	Err   error
+}
+
+/*Error conforms to the error interface*/
+func (e *ChildError) Error() string {
+	return e.Child + ": " + e.Err.Error()
+}
+
+/*Unwrap returns the child's error, for errors.Is and errors.As*/
+func (e *ChildError) Unwrap() error {
+	return e.Err
+}
+
+/*Errors holds the error of every child that failed, in the order they were tried*/
+type Errors []*ChildError
+
+/*Error conforms to the error interface*/
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+/*Unwrap returns each child's error, for errors.Is and errors.As*/
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+/*Config holds the settings for a Multi*/
+type Config struct {
+	Mode     Mode
+	Children []Child                       //the first is the primary
+	OnError  func(child string, err error) //if set, told of every failure, including those not returned
+}
+
+/*Multi is a homehub.Backend that forwards to each of its children*/
+type Multi struct {
+	mode     Mode
+	children []Child
+	onError  func(string, error)
+	once     sync.Once
+}
+
+/*New returns a Multi configured by cfg, or a non-nil error.  If every child is a
+homehub.BatchBackend, so is what is returned.*/
+func New(cfg Config) (homehub.Backend, error) {
+	if _, ok := modeNames[cfg.Mode]; !ok {
+		return nil, fmt.Errorf("Unknown mode %d", cfg.Mode)
+	}
+	if len(cfg.Children) == 0 {
+		return nil, errors.New("No children to forward to")
+	}
+	names, batch := map[string]bool{}, true
+	for _, child := range cfg.Children {
+		if child.Backend == nil || names[child.Name] {
+			return nil, fmt.Errorf("Child %q is missing or not uniquely named", child.Name)
+		}
+		names[child.Name] = true
+		_, ok := child.Backend.(homehub.BatchBackend)
+		batch = batch && ok
+	}
+	m := &Multi{mode: cfg.Mode, children: cfg.Children, onError: cfg.OnError}
+	if batch {
+		return &BatchMulti{m}, nil
+	}
+	return m, nil
+}
+
+/*forward calls call with each child, returning what the mode says has failed*/
+func (m *Multi) forward(call func(homehub.Backend) error) error {
+	var errs Errors
+	for i, child := range m.children {
+		err := call(child.Backend)
+		if err == nil {
+			continue
+		}
+		errs = append(errs, &ChildError{Child: child.Name, Err: err})
+		if m.onError != nil {
+			m.onError(child.Name, err)
+		}
+		if i == 0 && m.mode == Primary {
+			return errs
+		}
+	}
+	if len(errs) == 0 || m.mode == Primary || (m.mode == BestEffort && len(errs) < len(m.children)) {
+		return nil
+	}
+	return errs
+}
+
+/*Register conforms to the homehub.Backend interface*/
+func (m *Multi) Register(datam homehub.Datam) error {
+	return m.forward(func(be homehub.Backend) error { return be.Register(datam) })
+}
+
+/*Store conforms to the homehub.Backend interface*/
+func (m *Multi) Store(datam homehub.Datam) error {
+	return m.forward(func(be homehub.Backend) error { return be.Store(datam) })
+}
+
+/*Stop stops every child*/
+func (m *Multi) Stop() {
+	m.once.Do(func() {
+		for _, child := range m.children {
+			child.Backend.Stop()
+		}
+	})
+}
+
+/*Unwrap conforms to the homehub.Wrapper interface, returning the first child so that
+reads are served by it*/
+func (m *Multi) Unwrap() homehub.Backend {
+	return m.children[0].Backend
+}
+
+/*BatchMulti is a Multi whose children are all homehub.BatchBackends*/
+type BatchMulti struct {
+	*Multi
+}
+
+/*StoreBatch conforms to the homehub.BatchBackend interface.  Each child stores all of
+batch or none of it.*/
+func (m *BatchMulti) StoreBatch(batch homehub.DatamBatch) error {
+	return m.forward(func(be homehub.Backend) error { return be.(homehub.BatchBackend).StoreBatch(batch) })
+}
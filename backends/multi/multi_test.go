@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package multi
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/backendtest"
+)
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range []Mode{All, BestEffort, Primary} {
+		if got, err := ParseMode(mode.String()); err != nil || got != mode {
+			t.Errorf("%v: got %v %v", mode, got, err)
+		}
+	}
+	if _, err := ParseMode("some"); err == nil {
+		t.Errorf("Should not parse unknown modes")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{Mode: Mode(7), Children: []Child{{"a", &backendtest.Memory{}}}},
+		{Children: []Child{{"a", &backendtest.Memory{}}, {"a", &backendtest.Memory{}}}},
+		{Children: []Child{{"a", nil}}},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%+v: should not be accepted", cfg)
+		}
+	}
+
+	//which children fail, and whether each mode should then fail
+	tests := []struct {
+		fail                     [3]bool
+		all, bestEffort, primary bool
+	}{
+		{[3]bool{}, false, false, false},
+		{[3]bool{false, true, false}, true, false, false},
+		{[3]bool{true, false, false}, true, false, true},
+		{[3]bool{true, true, true}, true, true, true},
+	}
+	for _, test := range tests {
+		for mode, want := range map[Mode]bool{All: test.all, BestEffort: test.bestEffort, Primary: test.primary} {
+			mems, children, reported := [3]*backendtest.Memory{}, []Child{}, []string{}
+			for i, name := range []string{"sqlite", "postgres", "archive"} {
+				mems[i] = &backendtest.Memory{}
+				mems[i].Fail(test.fail[i])
+				children = append(children, Child{name, mems[i]})
+			}
+			be, err := New(Config{Mode: mode, Children: children, OnError: func(child string, err error) { reported = append(reported, child) }})
+			if err != nil {
+				t.Fatalf("Unable to create: %v", err)
+			}
+			if _, ok := be.(homehub.BatchBackend); ok {
+				t.Errorf("Should not be a BatchBackend unless every child is")
+			}
+
+			err = be.Store(homehub.GoodSample)
+			if (err != nil) != want {
+				t.Errorf("%v %v: got %v", mode, test.fail, err)
+			}
+			if mode == Primary && test.fail[0] && (len(mems[1].Stored()) != 0 || len(reported) != 1) {
+				t.Errorf("Should not try the rest if the primary fails")
+			}
+			if err != nil && !errors.Is(err, backendtest.ErrFull) {
+				t.Errorf("Should unwrap to what the children returned: %v", err)
+			}
+			if test.fail[1] && mode != Primary && err != nil && !strings.Contains(err.Error(), "postgres: disk full") {
+				t.Errorf("Should name the children that failed: %v", err)
+			}
+			if err := be.Register(homehub.GoodSample); (err != nil) != want {
+				t.Errorf("%v %v: Register got %v", mode, test.fail, err)
+			}
+		}
+	}
+
+	mem, bmem := &backendtest.Memory{}, &backendtest.Batch{}
+	be, _ := New(Config{Children: []Child{{"a", bmem}, {"b", mem}}})
+	if w, ok := be.(homehub.Wrapper); !ok || w.Unwrap() != bmem {
+		t.Errorf("Should unwrap to the first child")
+	}
+	be.Stop()
+	be.Stop()
+	if mem.Stopped() != 1 || bmem.Stopped() != 1 {
+		t.Errorf("Should stop every child once: %d %d", mem.Stopped(), bmem.Stopped())
+	}
+
+	bmem2 := &backendtest.Batch{}
+	bmem2.Fail(true)
+	be, _ = New(Config{Mode: BestEffort, Children: []Child{{"a", bmem}, {"b", bmem2}}})
+	bb, ok := be.(homehub.BatchBackend)
+	if !ok {
+		t.Fatalf("Should be a BatchBackend if every child is")
+	}
+	if err := bb.StoreBatch(homehub.DatamBatch{homehub.GoodSample, homehub.GoodSample}); err != nil || len(bmem.Stored()) != 2 {
+		t.Errorf("Should store the batch with each child: %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package router provides a backend that sends each table to one of several named
+backends, so that eg garage sensors and energy meters can live in different
+databases.
+
+Routes are tried in order, and the first whose pattern matches the table wins.  A
+pattern is a glob, such as "garage*", or a regular expression between slashes, such
+as "/^energy[A-Z]/".  Tables no route matches go to the default backend, if there
+is one, and are refused otherwise.
+
+Routes are written as pattern=backend, and may be read from a file holding one per
+line, where blank lines and those starting with # are skipped:
+
+	# garage sensors keep a year
+	garage*=garage
+	/^energy[A-Z]/=energy
+
+Reads are routed the same way, so a Router is a homehub.Reader and
+homehub.Aggregator as long as the backends it routes to are.*/
+package router
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/npotts/homehub"
+)
+
+/*ErrNoRoute is returned for a table no route matches, when there is no default*/
+var ErrNoRoute = errors.New("No route for table")
+
+/*Route sends the tables matching Pattern to the backend named Backend*/
+type Route struct {
+	Pattern string //glob, or a regular expression between slashes
+	Backend string
+}
+
+/*String returns the route as pattern=backend*/
+func (r Route) String() string {
+	return r.Pattern + "=" + r.Backend
+}
+
+/*ParseRoute parses a route written as pattern=backend*/
+func ParseRoute(s string) (Route, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 1 || i == len(s)-1 {
+		return Route{}, fmt.Errorf("Route %q is not like pattern=backend", s)
+	}
+	r := Route{Pattern: strings.TrimSpace(s[:i]), Backend: strings.TrimSpace(s[i+1:])}
+	_, err := r.matcher()
+	return r, err
+}
+
+/*ReadRoutes reads routes from r, one per line*/
+func ReadRoutes(r io.Reader) ([]Route, error) {
+	routes, scanner := []Route{}, bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		route, err := ParseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, scanner.Err()
+}
+
+/*matcher returns a function reporting if a table matches the route's pattern*/
+func (r Route) matcher() (func(string) bool, error) {
+	if len(r.Pattern) > 1 && strings.HasPrefix(r.Pattern, "/") && strings.HasSuffix(r.Pattern, "/") {
+		re, err := regexp.Compile(r.Pattern[1 : len(r.Pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("Bad pattern %q: %v", r.Pattern, err)
+	}
+	return func(table string) bool {
+		ok, _ := path.Match(r.Pattern, table)
+		return ok
+	}, nil
+}
+
+/*Config holds the settings for a Router*/
+type Config struct {
+	Backends map[string]homehub.Backend //the backends routed to, by name
+	Routes   []Route                    //tried in order
+	Default  string                     //backend for tables no route matches.  Empty means they are refused
+}
+
+/*route is a Route ready for use*/
+type route struct {
+	match   func(string) bool
+	backend string
+}
+
+/*Router is a homehub.Backend that sends each table to one of its backends*/
+type Router struct {
+	backends map[string]homehub.Backend
+	routes   []route
+	def      string
+	once     sync.Once
+
+	mu    sync.RWMutex
+	cache map[homehub.Alphabetic]string //backend each table has been routed to
+}
+
+/*New returns a Router configured by cfg, or a non-nil error*/
+func New(cfg Config) (*Router, error) {
+	if _, ok := cfg.Backends[cfg.Default]; cfg.Default != "" && !ok {
+		return nil, fmt.Errorf("Default backend %q is not known", cfg.Default)
+	}
+	r := &Router{backends: cfg.Backends, def: cfg.Default, cache: map[homehub.Alphabetic]string{}}
+	for _, rt := range cfg.Routes {
+		if _, ok := cfg.Backends[rt.Backend]; !ok {
+			return nil, fmt.Errorf("Route %v is to an unknown backend", rt)
+		}
+		match, err := rt.matcher()
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, route{match: match, backend: rt.Backend})
+	}
+	return r, nil
+}
+
+/*Route returns the name of the backend table is routed to, or ErrNoRoute*/
+func (r *Router) Route(table homehub.Alphabetic) (string, error) {
+	r.mu.RLock()
+	name, ok := r.cache[table]
+	r.mu.RUnlock()
+	if ok {
+		return name, nil
+	}
+
+	name = r.def
+	for _, rt := range r.routes {
+		if rt.match(string(table)) {
+			name = rt.backend
+			break
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("%w %q", ErrNoRoute, table)
+	}
+	r.mu.Lock()
+	r.cache[table] = name
+	r.mu.Unlock()
+	return name, nil
+}
+
+/*backend returns the backend table is routed to, and its name*/
+func (r *Router) backend(table homehub.Alphabetic) (string, homehub.Backend, error) {
+	name, err := r.Route(table)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, r.backends[name], nil
+}
+
+/*Register conforms to the homehub.Backend interface*/
+func (r *Router) Register(datam homehub.Datam) error {
+	name, be, err := r.backend(datam.Table)
+	if err != nil {
+		return err
+	}
+	if err = be.Register(datam); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+/*Store conforms to the homehub.Backend interface*/
+func (r *Router) Store(datam homehub.Datam) error {
+	name, be, err := r.backend(datam.Table)
+	if err != nil {
+		return err
+	}
+	if err = be.Store(datam); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+/*Stop stops every backend*/
+func (r *Router) Stop() {
+	r.once.Do(func() {
+		for _, be := range r.backends {
+			be.Stop()
+		}
+	})
+}
+
+/*reader returns the homehub.Reader for table*/
+func (r *Router) reader(table homehub.Alphabetic) (homehub.Reader, error) {
+	name, be, err := r.backend(table)
+	if err != nil {
+		return nil, homehub.ErrUnknownTable
+	}
+	var rd homehub.Reader
+	if !homehub.As(be, &rd) {
+		return nil, fmt.Errorf("Backend %q cannot read back data", name)
+	}
+	return rd, nil
+}
+
+/*Tables conforms to the homehub.Reader interface, returning the tables of every
+backend that can read, which are routed to it*/
+func (r *Router) Tables() ([]homehub.Alphabetic, error) {
+	tables := []homehub.Alphabetic{}
+	for name, be := range r.backends {
+		var rd homehub.Reader
+		if !homehub.As(be, &rd) {
+			continue
+		}
+		all, err := rd.Tables()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, table := range all {
+			if routed, err := r.Route(table); err == nil && routed == name {
+				tables = append(tables, table)
+			}
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i] < tables[j] })
+	return tables, nil
+}
+
+/*Schema conforms to the homehub.Reader interface*/
+func (r *Router) Schema(table homehub.Alphabetic) ([]homehub.Column, error) {
+	rd, err := r.reader(table)
+	if err != nil {
+		return nil, err
+	}
+	return rd.Schema(table)
+}
+
+/*Rows conforms to the homehub.Reader interface*/
+func (r *Router) Rows(q homehub.Query) ([]homehub.Datam, error) {
+	rd, err := r.reader(q.Table)
+	if err != nil {
+		return nil, err
+	}
+	return rd.Rows(q)
+}
+
+/*Aggregate conforms to the homehub.Aggregator interface*/
+func (r *Router) Aggregate(q homehub.AggregateQuery) ([]homehub.Bucket, error) {
+	name, be, err := r.backend(q.Table)
+	if err != nil {
+		return nil, homehub.ErrUnknownTable
+	}
+	var ag homehub.Aggregator
+	if !homehub.As(be, &ag) {
+		return nil, fmt.Errorf("Backend %q cannot aggregate data", name)
+	}
+	return ag.Aggregate(q)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package router
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/internal/backendtest"
+)
+
+/*reader is a backendtest.Memory that can read back the tables registered with it,
+and those in more*/
+type reader struct {
+	backendtest.Memory
+	more []homehub.Alphabetic
+}
+
+func (r *reader) Tables() ([]homehub.Alphabetic, error) {
+	return append(backendtest.Tables(r.Registered()), r.more...), nil
+}
+func (r *reader) Schema(table homehub.Alphabetic) ([]homehub.Column, error) {
+	return nil, nil
+}
+func (r *reader) Rows(q homehub.Query) ([]homehub.Datam, error) {
+	return []homehub.Datam{{Table: q.Table}}, nil
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := map[string]Route{
+		"garage*=garage":       {"garage*", "garage"},
+		" /^a=b$/ = energy ":   {"/^a=b$/", "energy"},
+		"/^energy[A-Z]/=meter": {"/^energy[A-Z]/", "meter"},
+	}
+	for s, want := range tests {
+		if got, err := ParseRoute(s); err != nil || got != want {
+			t.Errorf("%q: got %+v %v", s, got, err)
+		}
+	}
+	for _, bad := range []string{"garage", "=garage", "garage=", "[=x", "/(/=x"} {
+		if _, err := ParseRoute(bad); err == nil {
+			t.Errorf("%q: should not parse", bad)
+		}
+	}
+
+	routes, err := ReadRoutes(strings.NewReader("# comment\n\ngarage*=garage\n  /^energy/=meter\n"))
+	if err != nil || !reflect.DeepEqual(routes, []Route{{"garage*", "garage"}, {"/^energy/", "meter"}}) {
+		t.Errorf("Unexpected routes: %+v %v", routes, err)
+	}
+	if _, err := ReadRoutes(strings.NewReader("garage*=garage\nnonsense\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Should say which line is bad: %v", err)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	garage, meter, main := &reader{}, &backendtest.Memory{}, &reader{}
+	backends := map[string]homehub.Backend{"garage": garage, "meter": meter, "main": main}
+	routes := []Route{{"garage*", "garage"}, {"/^energy[A-Z0-9]/", "meter"}, {"*Door", "garage"}}
+	for _, cfg := range []Config{
+		{Backends: backends, Default: "nowhere"},
+		{Backends: backends, Routes: []Route{{"x", "nowhere"}}},
+		{Backends: backends, Routes: []Route{{"[", "main"}}},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%+v: should not be accepted", cfg)
+		}
+	}
+
+	r, err := New(Config{Backends: backends, Routes: routes})
+	if err != nil {
+		t.Fatalf("Unable to create: %v", err)
+	}
+	var _ homehub.Backend = r
+	if err := r.Store(homehub.Datam{Table: "attic"}); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Should refuse unrouted tables without a default: %v", err)
+	}
+
+	r, _ = New(Config{Backends: backends, Routes: routes, Default: "main"})
+	for _, table := range []homehub.Alphabetic{"garageTemp", "energyMain", "frontDoor", "attic", "energy", "garageTemp"} {
+		datam := homehub.Datam{Table: table}
+		if r.Register(datam) != nil || r.Store(datam) != nil {
+			t.Errorf("%s: should be stored", table)
+		}
+	}
+	want := map[*backendtest.Memory][]homehub.Alphabetic{
+		&garage.Memory: {"garageTemp", "frontDoor", "garageTemp"},
+		meter:          {"energyMain"},
+		&main.Memory:   {"attic", "energy"},
+	}
+	for mem, tables := range want {
+		if got := backendtest.Tables(mem.Stored()); !reflect.DeepEqual(got, tables) {
+			t.Errorf("Routed wrongly: got %v, wanted %v", got, tables)
+		}
+	}
+	if err := r.Register(homehub.Datam{Table: "full"}); err == nil || !strings.HasPrefix(err.Error(), "main: ") {
+		t.Errorf("Should name the backend that failed: %v", err)
+	}
+
+	//reads go where the table is routed
+	main.more = append(main.more, "garageOld") //routed to garage now, so not main's to report
+	tables, err := r.Tables()
+	if err != nil || !reflect.DeepEqual(tables, []homehub.Alphabetic{"attic", "energy", "frontDoor", "garageTemp", "garageTemp"}) {
+		t.Errorf("Unexpected tables: %v %v", tables, err)
+	}
+	if rows, err := r.Rows(homehub.Query{Table: "frontDoor"}); err != nil || len(rows) != 1 {
+		t.Errorf("Should read from the routed backend: %v %v", rows, err)
+	}
+	if _, err := r.Rows(homehub.Query{Table: "energyMain"}); err == nil {
+		t.Errorf("Should fail if the routed backend cannot read")
+	}
+	if _, err := r.Aggregate(homehub.AggregateQuery{Query: homehub.Query{Table: "attic"}}); err == nil {
+		t.Errorf("Should fail if the routed backend cannot aggregate")
+	}
+	var rd homehub.Reader
+	if !homehub.As(r, &rd) {
+		t.Errorf("Should be a Reader")
+	}
+
+	r.Stop()
+	r.Stop()
+	if garage.Stopped() != 1 || meter.Stopped() != 1 || main.Stopped() != 1 {
+		t.Errorf("Should stop every backend once")
+	}
+}
@@ -0,0 +1,569 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package spool provides a backend that writes ahead to disk, so that readings are
+kept while the real backend (eg postgres) is away.
+
+Spool wraps another homehub.Backend.  Each Register and Store is appended to a log
+and synced to disk before it is acknowledged, and a goroutine then hands what was
+logged to the wrapped backend in order, retrying with exponential backoff while it
+fails.  Stores without a Timestamp are given the time they were logged,
+so they are not recorded as taken when the backend returned.
+
+The log is a directory of numbered segments, each holding records framed by their
+length and CRC-32, and a commit file holding how far the wrapped backend has got.
+A segment is removed once it has been handed on, and when the log would grow past
+its limit, new records are refused with ErrFull.  After a restart whatever had not
+been committed is handed on again; as the commit is written after the record is
+handed on, a crash between the two hands that record on twice.
+
+Errors are retried for as long as they last, as the wrapped backend may be away
+for any length of time.  Records refused as invalid, as conflicting with a table's
+schema, or as naming a table or field that was never registered will never succeed
+though, and would hold up those behind them.  Such records are set aside, appended
+to the rejected file as JSON lines along with the error, and the next is handed on.*/
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/npotts/homehub"
+)
+
+/*ErrFull is returned when a record would take the log past its limit*/
+var ErrFull = errors.New("Spool is full")
+
+/*ErrStopped is returned once the spool has been stopped*/
+var ErrStopped = errors.New("Spool is stopped")
+
+/*defaults for the Config*/
+const (
+	DefaultSegmentSize = 4 << 20
+	DefaultMaxBytes    = 1 << 30
+	DefaultMinBackoff  = 100 * time.Millisecond
+	DefaultMaxBackoff  = time.Minute
+)
+
+/*headerSize is the size of a record's frame: its length and CRC-32*/
+const headerSize = 8
+
+/*commitFile holds the segment and offset of the next record to hand on*/
+const commitFile = "commit"
+
+/*rejectedFile holds the records set aside*/
+const rejectedFile = "rejected"
+
+/*operations a record holds*/
+const (
+	opRegister = 'R'
+	opStore    = 'S'
+	opBatch    = 'B'
+)
+
+/*Config holds the settings for a Spool*/
+type Config struct {
+	Dir         string          //directory the log is kept in, created if need be
+	SegmentSize int64           //size segments are rotated at.  Defaults to DefaultSegmentSize
+	MaxBytes    int64           //most the log may take on disk.  Defaults to DefaultMaxBytes
+	NoSync      bool            //skip syncing each record; faster, but a power cut may lose the last few
+	MinBackoff  time.Duration   //first wait after the wrapped backend fails.  Defaults to DefaultMinBackoff
+	MaxBackoff  time.Duration   //longest wait.  Defaults to DefaultMaxBackoff
+	OnError     func(err error) //if set, told of every failure to hand a record on
+}
+
+/*Spool is a homehub.Backend that logs what it is given to disk, then hands it on to
+the Backend it wraps*/
+type Spool struct {
+	homehub.Backend
+	cfg     Config
+	wake    chan struct{} //signalled when a record is appended
+	stop    chan struct{}
+	done    chan struct{} //closed once the drain has exited
+	once    sync.Once
+	dropped uint64
+
+	mu      sync.Mutex
+	stopped bool
+	sizes   map[uint64]int64 //size of each segment, by number
+	total   int64            //bytes in every segment
+	w       *os.File         //segment being appended to
+	wseq    uint64
+	r       *os.File //segment being handed on
+	rseq    uint64
+	roff    int64
+}
+
+/*segmentName returns the file name of segment seq*/
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%016d.log", seq)
+}
+
+/*New returns be wrapped in a Spool configured by cfg, or a non-nil error.  Anything
+logged but not handed on when last stopped is handed on first.  If be is a
+homehub.BatchBackend, so is what is returned, and each batch is logged as one record.*/
+func New(be homehub.Backend, cfg Config) (homehub.Backend, error) {
+	s, err := open(be, cfg)
+	if err != nil {
+		return nil, err
+	}
+	go s.drain()
+	if _, ok := be.(homehub.BatchBackend); ok {
+		return &BatchSpool{s}, nil
+	}
+	return s, nil
+}
+
+/*open opens the log in cfg.Dir, recovering from any torn write at its end*/
+func open(be homehub.Backend, cfg Config) (*Spool, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("No directory to spool to")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	//what has been handed on is only freed a segment at a time, so the limit must
+	//hold at least two
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = DefaultSegmentSize
+		if cfg.SegmentSize > cfg.MaxBytes/2 {
+			cfg.SegmentSize = cfg.MaxBytes / 2
+		}
+	}
+	if cfg.SegmentSize > cfg.MaxBytes/2 {
+		return nil, fmt.Errorf("Spool limit of %d bytes must hold two segments of %d", cfg.MaxBytes, cfg.SegmentSize)
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		Backend: be,
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		sizes:   map[uint64]int64{},
+	}
+
+	names, err := filepath.Glob(filepath.Join(cfg.Dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	seqs := []uint64{}
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	//start from the commit, removing segments already handed on
+	s.rseq, s.roff = 1, 0
+	if len(seqs) > 0 {
+		s.rseq = seqs[0]
+	}
+	if raw, err := os.ReadFile(filepath.Join(cfg.Dir, commitFile)); err == nil {
+		var seq uint64
+		var off int64
+		if _, err := fmt.Sscanf(string(raw), "%d %d", &seq, &off); err == nil && seq >= s.rseq {
+			s.rseq, s.roff = seq, off
+		}
+	}
+	for _, seq := range seqs {
+		if seq < s.rseq {
+			os.Remove(filepath.Join(cfg.Dir, segmentName(seq)))
+			continue
+		}
+		info, err := os.Stat(filepath.Join(cfg.Dir, segmentName(seq)))
+		if err != nil {
+			return nil, err
+		}
+		s.sizes[seq] = info.Size()
+		s.total += info.Size()
+		s.wseq = seq
+	}
+	if s.wseq < s.rseq {
+		s.wseq, s.roff = s.rseq, 0 //every segment has been handed on
+	}
+
+	//append to the last segment, after any torn record
+	if s.w, err = os.OpenFile(filepath.Join(cfg.Dir, segmentName(s.wseq)), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	good, err := valid(s.w)
+	if err != nil {
+		s.w.Close()
+		return nil, err
+	}
+	if good < s.sizes[s.wseq] {
+		if err = s.w.Truncate(good); err != nil {
+			s.w.Close()
+			return nil, err
+		}
+	}
+	if _, err = s.w.Seek(good, io.SeekStart); err != nil {
+		s.w.Close()
+		return nil, err
+	}
+	s.total += good - s.sizes[s.wseq]
+	s.sizes[s.wseq] = good
+	if s.roff > good && s.rseq == s.wseq {
+		s.roff = good
+	}
+	if s.r, err = os.Open(filepath.Join(cfg.Dir, segmentName(s.rseq))); err != nil {
+		s.w.Close()
+		return nil, err
+	}
+	s.signal()
+	return s, nil
+}
+
+/*valid returns the length of the run of intact records at the start of f*/
+func valid(f *os.File) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r, good := bufio.NewReader(f), int64(0)
+	for {
+		payload, err := readRecord(r)
+		if err != nil {
+			return good, nil
+		}
+		good += headerSize + int64(len(payload))
+	}
+}
+
+/*frame returns payload framed as a record*/
+func frame(payload []byte) []byte {
+	rec := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(rec, uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	return append(rec, payload...)
+}
+
+var errCorrupt = errors.New("Corrupt record")
+
+/*readRecord reads a record's payload from r*/
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header)
+	if n < 1 || n > 1<<30 {
+		return nil, errCorrupt
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errCorrupt
+	}
+	return payload, nil
+}
+
+/*signal wakes the drain*/
+func (s *Spool) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*append logs a record holding op and v*/
+func (s *Spool) append(op byte, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	rec := frame(append([]byte{op}, raw...))
+	size := int64(len(rec))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	if s.total+size > s.cfg.MaxBytes {
+		return ErrFull
+	}
+	if s.sizes[s.wseq] > 0 && s.sizes[s.wseq]+size > s.cfg.SegmentSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err = s.w.Write(rec); err != nil {
+		s.w.Truncate(s.sizes[s.wseq]) //do not leave a partial record for the next to follow
+		s.w.Seek(s.sizes[s.wseq], io.SeekStart)
+		return err
+	}
+	if !s.cfg.NoSync {
+		if err = s.w.Sync(); err != nil {
+			s.w.Truncate(s.sizes[s.wseq]) //the record is refused, so must not be handed on
+			s.w.Seek(s.sizes[s.wseq], io.SeekStart)
+			return err
+		}
+	}
+	s.sizes[s.wseq] += size
+	s.total += size
+	s.signal()
+	return nil
+}
+
+/*rotate starts a new segment to append to*/
+func (s *Spool) rotate() error {
+	w, err := os.OpenFile(filepath.Join(s.cfg.Dir, segmentName(s.wseq+1)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.w.Close()
+	s.w, s.wseq = w, s.wseq+1
+	s.sizes[s.wseq] = 0
+	return nil
+}
+
+/*Dropped returns how many records were set aside as the wrapped backend would not take them*/
+func (s *Spool) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+/*Pending returns how many bytes of the log have yet to be handed on*/
+func (s *Spool) Pending() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total - s.roff
+}
+
+/*next returns the next record to hand on and the offset following it, or false if
+there is none yet*/
+func (s *Spool) next() ([]byte, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.roff < s.sizes[s.rseq] {
+			if _, err := s.r.Seek(s.roff, io.SeekStart); err == nil {
+				payload, err := readRecord(io.LimitReader(s.r, s.sizes[s.rseq]-s.roff))
+				if err == nil {
+					return payload, s.roff + headerSize + int64(len(payload)), true
+				}
+			}
+			if s.rseq == s.wseq {
+				return nil, 0, false //a write failed part way; wait for the next
+			}
+			s.roff = s.sizes[s.rseq] //skip the rest of a damaged segment
+		}
+		if s.rseq == s.wseq {
+			return nil, 0, false
+		}
+
+		//this segment has been handed on: move to the next
+		r, err := os.Open(filepath.Join(s.cfg.Dir, segmentName(s.rseq+1)))
+		if err != nil {
+			return nil, 0, false
+		}
+		s.r.Close()
+		os.Remove(filepath.Join(s.cfg.Dir, segmentName(s.rseq)))
+		s.total -= s.sizes[s.rseq]
+		delete(s.sizes, s.rseq)
+		s.r, s.rseq, s.roff = r, s.rseq+1, 0
+		s.commit()
+	}
+}
+
+/*commit records how far the wrapped backend has got, to resume from after a restart*/
+func (s *Spool) commit() {
+	tmp := filepath.Join(s.cfg.Dir, commitFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.rseq, s.roff)), 0644); err == nil {
+		os.Rename(tmp, filepath.Join(s.cfg.Dir, commitFile))
+	}
+}
+
+/*apply hands the record in payload on to the wrapped backend*/
+func (s *Spool) apply(payload []byte) error {
+	var err error
+	switch payload[0] {
+	case opRegister, opStore:
+		datam := homehub.Datam{}
+		if err = json.Unmarshal(payload[1:], &datam); err != nil {
+			break
+		}
+		if payload[0] == opRegister {
+			return s.Backend.Register(datam)
+		}
+		return s.Backend.Store(datam)
+	case opBatch:
+		batch := homehub.DatamBatch{}
+		if err = json.Unmarshal(payload[1:], &batch); err != nil {
+			break
+		}
+		return s.Backend.(homehub.BatchBackend).StoreBatch(batch)
+	default:
+		err = fmt.Errorf("Unknown operation %q", payload[0])
+	}
+	return fmt.Errorf("%w: %v", errCorrupt, err)
+}
+
+/*permanent returns true if err will not go away by retrying*/
+func permanent(err error) bool {
+	var conflict *homehub.SchemaConflictError
+	return errors.Is(err, homehub.ErrInvalid) || errors.As(err, &conflict) || errors.Is(err, errCorrupt) ||
+		errors.Is(err, homehub.ErrUnknownTable) || errors.Is(err, homehub.ErrUnknownField)
+}
+
+/*rejected is a record set aside, as written to the rejected file*/
+type rejected struct {
+	Op     string          `json:"op"`
+	Error  string          `json:"error"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+/*setAside appends the record in payload to the rejected file*/
+func (s *Spool) setAside(payload []byte, cause error) {
+	atomic.AddUint64(&s.dropped, 1)
+	rej := rejected{Op: string(payload[:1]), Error: cause.Error()}
+	if json.Valid(payload[1:]) {
+		rej.Record = payload[1:]
+	}
+	line, err := json.Marshal(rej)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(s.cfg.Dir, rejectedFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+/*drain hands records on until stopped, backing off while the wrapped backend fails*/
+func (s *Spool) drain() {
+	defer close(s.done)
+	for {
+		payload, off, ok := s.next()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+		for backoff := s.cfg.MinBackoff; ; backoff *= 2 {
+			err := s.apply(payload)
+			if err == nil {
+				break
+			}
+			if s.cfg.OnError != nil {
+				s.cfg.OnError(err)
+			}
+			if permanent(err) {
+				s.setAside(payload, err)
+				break
+			}
+			if backoff > s.cfg.MaxBackoff {
+				backoff = s.cfg.MaxBackoff
+			}
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return
+			}
+		}
+		s.mu.Lock()
+		s.roff = off
+		s.commit()
+		s.mu.Unlock()
+	}
+}
+
+/*Register conforms to the homehub.Backend interface.  datam is validated, logged,
+and registered later.*/
+func (s *Spool) Register(datam homehub.Datam) error {
+	if err := datam.Validate(); err != nil {
+		return err
+	}
+	return s.append(opRegister, datam)
+}
+
+/*stamp sets datam's Timestamp to now, if it has none*/
+func stamp(datam homehub.Datam) homehub.Datam {
+	if datam.Timestamp == nil {
+		datam.Timestamp = &homehub.Timestamp{Time: time.Now().UTC()}
+	}
+	return datam
+}
+
+/*Store conforms to the homehub.Backend interface.  datam is validated, logged, and
+stored later.*/
+func (s *Spool) Store(datam homehub.Datam) error {
+	if err := datam.Validate(); err != nil {
+		return err
+	}
+	return s.append(opStore, stamp(datam))
+}
+
+/*Stop stops handing records on, leaving what remains for next time, then stops the
+wrapped Backend*/
+func (s *Spool) Stop() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.stopped = true
+		s.mu.Unlock()
+		close(s.stop)
+		<-s.done
+		s.w.Close()
+		s.r.Close()
+		s.Backend.Stop()
+	})
+}
+
+/*Unwrap conforms to the homehub.Wrapper interface*/
+func (s *Spool) Unwrap() homehub.Backend {
+	return s.Backend
+}
+
+/*BatchSpool is a Spool around a homehub.BatchBackend*/
+type BatchSpool struct {
+	*Spool
+}
+
+/*StoreBatch conforms to the homehub.BatchBackend interface.  The batch is logged as
+one record, and stored later as one batch.*/
+func (s *BatchSpool) StoreBatch(batch homehub.DatamBatch) error {
+	stamped := make(homehub.DatamBatch, len(batch))
+	for i, datam := range batch {
+		if err := datam.Validate(); err != nil {
+			return err
+		}
+		stamped[i] = stamp(datam)
+	}
+	return s.append(opBatch, stamped)
+}
@@ -0,0 +1,327 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package spool
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/npotts/homehub"
+	"github.com/npotts/homehub/backends/sql"
+)
+
+/*flaky is a backend that fails while down, with err or else errDown*/
+type flaky struct {
+	mu         sync.Mutex
+	down       bool
+	err        error
+	calls      int
+	registered []homehub.Alphabetic
+	stored     []homehub.Datam
+	batches    int
+	stopped    bool
+}
+
+var errDown = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+func (f *flaky) fail() error {
+	f.calls++
+	if f.down && f.err != nil {
+		return f.err
+	}
+	if f.down {
+		return errDown
+	}
+	return nil
+}
+func (f *flaky) Register(datam homehub.Datam) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail(); err != nil {
+		return err
+	}
+	if datam.Table == "conflict" {
+		return &homehub.SchemaConflictError{Table: datam.Table}
+	}
+	f.registered = append(f.registered, datam.Table)
+	return nil
+}
+func (f *flaky) Store(datam homehub.Datam) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail(); err != nil {
+		return err
+	}
+	f.stored = append(f.stored, datam)
+	return nil
+}
+func (f *flaky) Stop() { f.stopped = true }
+
+func (f *flaky) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flaky) count() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.stored), f.calls
+}
+
+type batchFlaky struct {
+	flaky
+}
+
+func (f *batchFlaky) StoreBatch(batch homehub.DatamBatch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail(); err != nil {
+		return err
+	}
+	f.batches++
+	f.stored = append(f.stored, batch...)
+	return nil
+}
+
+/*wait waits up to a few seconds for cond to become true*/
+func wait(t *testing.T, what string, cond func() bool) {
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func sample(table homehub.Alphabetic) homehub.Datam {
+	datam := homehub.GoodSample
+	datam.Table = table
+	return datam
+}
+
+func TestSpool(t *testing.T) {
+	if _, err := New(&flaky{}, Config{}); err == nil {
+		t.Errorf("Should need a directory")
+	}
+	dir := t.TempDir()
+	be := &flaky{down: true}
+	reported := 0
+	s, err := New(be, Config{Dir: dir, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, OnError: func(error) { reported++ }})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	if _, ok := s.(homehub.BatchBackend); ok {
+		t.Errorf("Should not be a BatchBackend unless what it wraps is")
+	}
+	if w, ok := s.(homehub.Wrapper); !ok || w.Unwrap() != be {
+		t.Errorf("Should unwrap to the wrapped backend")
+	}
+	if err := s.Store(sample("bad table")); !errors.Is(err, homehub.ErrInvalid) {
+		t.Errorf("Should refuse invalid Datam straight away: %v", err)
+	}
+
+	//acknowledged while the backend is down, and handed on in order once it is back
+	for _, table := range []homehub.Alphabetic{"attic", "conflict", "garage"} {
+		if s.Register(sample(table)) != nil || s.Store(sample(table)) != nil {
+			t.Errorf("%s: should be logged", table)
+		}
+	}
+	wait(t, "retries", func() bool { _, calls := be.count(); return calls > 3 })
+	if s.(*Spool).Pending() == 0 {
+		t.Errorf("Should have records pending")
+	}
+	be.setDown(false)
+	wait(t, "draining", func() bool { return s.(*Spool).Pending() == 0 })
+	if len(be.registered) != 2 || len(be.stored) != 3 || be.stored[2].Table != "garage" {
+		t.Errorf("Should hand everything on in order: %v %+v", be.registered, be.stored)
+	}
+	if be.stored[0].Timestamp == nil || time.Since(be.stored[0].Timestamp.Time) > time.Minute {
+		t.Errorf("Should timestamp stores when logged: %+v", be.stored[0])
+	}
+	if s.(*Spool).Dropped() != 1 || reported < 4 {
+		t.Errorf("Should drop what can never be registered: %d %d", s.(*Spool).Dropped(), reported)
+	}
+
+	s.Stop()
+	s.Stop()
+	if !be.stopped {
+		t.Errorf("Should stop the wrapped backend")
+	}
+	if err := s.Store(sample("attic")); err != ErrStopped {
+		t.Errorf("Should refuse once stopped: %v", err)
+	}
+}
+
+func TestSpool_replay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(&flaky{down: true}, Config{Dir: dir, SegmentSize: 256})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.Store(sample("attic")); err != nil {
+			t.Fatalf("Unable to log: %v", err)
+		}
+	}
+	s.Stop()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) < 2 {
+		t.Errorf("Should rotate segments: %v", segments)
+	}
+
+	//a torn write at the end is dropped
+	f, _ := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+
+	be := &flaky{}
+	s, err = New(be, Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("Unable to restart: %v", err)
+	}
+	wait(t, "replaying", func() bool { stored, _ := be.count(); return stored == 5 })
+	if err := s.Store(sample("garage")); err != nil {
+		t.Errorf("Should append after a torn write: %v", err)
+	}
+	wait(t, "draining", func() bool { stored, _ := be.count(); return stored == 6 })
+	s.Stop()
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.log")); len(segments) != 1 {
+		t.Errorf("Should remove segments once handed on: %v", segments)
+	}
+
+	//nothing is handed on twice
+	be = &flaky{}
+	s, err = New(be, Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("Unable to restart: %v", err)
+	}
+	s.Store(sample("porch"))
+	wait(t, "draining", func() bool { stored, _ := be.count(); return stored == 1 })
+	s.Stop()
+	if be.stored[0].Table != "porch" {
+		t.Errorf("Should not replay what was committed: %+v", be.stored)
+	}
+}
+
+func TestSpool_full(t *testing.T) {
+	be := &batchFlaky{flaky{down: true}}
+	s, err := New(be, Config{Dir: t.TempDir(), SegmentSize: 512, MaxBytes: 1024, NoSync: true, MinBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer s.Stop()
+	bs, ok := s.(homehub.BatchBackend)
+	if !ok {
+		t.Fatalf("Should be a BatchBackend if what it wraps is")
+	}
+	if err := bs.StoreBatch(homehub.DatamBatch{sample("attic"), sample("bad table")}); !errors.Is(err, homehub.ErrInvalid) {
+		t.Errorf("Should refuse invalid batches straight away: %v", err)
+	}
+	if err := bs.StoreBatch(homehub.DatamBatch{sample("attic"), sample("attic")}); err != nil {
+		t.Errorf("Should log a batch: %v", err)
+	}
+	n := 0
+	for ; n < 100; n++ {
+		if err = s.Store(sample("garage")); err != nil {
+			break
+		}
+	}
+	if err != ErrFull || n == 0 {
+		t.Errorf("Should refuse records past the limit: %d %v", n, err)
+	}
+
+	be.setDown(false)
+	wait(t, "draining", func() bool { stored, _ := be.count(); return stored == n+2 })
+	if be.batches != 1 {
+		t.Errorf("Should store batches as one: %d", be.batches)
+	}
+	if err := s.Store(sample("garage")); err != nil {
+		t.Errorf("Should take more once drained: %v", err)
+	}
+}
+
+func TestSpool_sql(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.New("sqlite3", filepath.Join(dir, "spool.db"))
+	if err != nil {
+		t.Fatalf("Unable to open the database: %v", err)
+	}
+	s, err := New(db, Config{Dir: filepath.Join(dir, "spool"), MinBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer s.Stop()
+
+	//a store to a table never registered fails for good, and must not hold up the rest
+	for _, err := range []error{s.Store(sample("never")), s.Register(sample("attic")), s.Store(sample("attic"))} {
+		if err != nil {
+			t.Fatalf("Unable to log: %v", err)
+		}
+	}
+	wait(t, "draining", func() bool { return s.(*BatchSpool).Pending() == 0 })
+	if rows, err := db.Rows(homehub.Query{Table: "attic"}); err != nil || len(rows) != 1 {
+		t.Errorf("Should store what follows a bad record: %v %v", rows, err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "spool", rejectedFile))
+	if err != nil || s.(*BatchSpool).Dropped() != 1 || !strings.Contains(string(raw), `"table":"never"`) {
+		t.Errorf("Should set the bad record aside: %v %s", err, raw)
+	}
+}
+
+func TestSpool_outage(t *testing.T) {
+	//what postgres says while it restarts is no net.Error, but passes all the same
+	be := &flaky{down: true, err: errors.New("pq: the database system is shutting down")}
+	s, err := New(be, Config{Dir: t.TempDir(), MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer s.Stop()
+	if err := s.Store(sample("attic")); err != nil {
+		t.Fatalf("Unable to log: %v", err)
+	}
+	wait(t, "retries", func() bool { _, calls := be.count(); return calls > 20 })
+	if s.(*Spool).Dropped() != 0 || s.(*Spool).Pending() == 0 {
+		t.Errorf("Should keep retrying an error not known to be permanent: %d", s.(*Spool).Dropped())
+	}
+	be.setDown(false)
+	wait(t, "draining", func() bool { return s.(*Spool).Pending() == 0 })
+	if stored, _ := be.count(); stored != 1 || s.(*Spool).Dropped() != 0 {
+		t.Errorf("Should store the record once the backend is back: %d %d", stored, s.(*Spool).Dropped())
+	}
+}
+
+func TestSpool_limits(t *testing.T) {
+	if _, err := New(&flaky{}, Config{Dir: t.TempDir(), SegmentSize: 4096, MaxBytes: 4096}); err == nil {
+		t.Errorf("Should need room for two segments")
+	}
+
+	//the default segment shrinks to fit a small limit, so drained segments are freed
+	be := &flaky{}
+	s, err := New(be, Config{Dir: t.TempDir(), MaxBytes: 4096, NoSync: true})
+	if err != nil {
+		t.Fatalf("Unable to start: %v", err)
+	}
+	defer s.Stop()
+	for i := 0; i < 200; i++ {
+		if err := s.Store(sample("attic")); err != nil {
+			wait(t, "draining", func() bool { return s.(*Spool).Pending() == 0 })
+			if err = s.Store(sample("attic")); err != nil {
+				t.Fatalf("Should take more once drained: %d %v", i, err)
+			}
+		}
+	}
+}
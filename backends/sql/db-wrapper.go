@@ -9,18 +9,27 @@ This file is part of the HomeHub project
 package sql
 
 import (
-	_ "github.com/go-sql-driver/mysql" //mysql support
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql" //mysql support
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"           //postgres support
-	_ "github.com/mattn/go-sqlite3" //sqlite3  support
+	"github.com/lib/pq"           //postgres support
+	"github.com/mattn/go-sqlite3" //sqlite3  support
 
 	"github.com/npotts/homehub"
 )
 
 /*SQLBackend wraps a database and functions as a homehub.Backend*/
 type SQLBackend struct {
-	dialect string
-	db      *sqlx.DB //database backend
+	dialect  string          //name of the homehub.Dialect
+	sqld     homehub.Dialect //how to speak to db
+	db       *sqlx.DB        //database backend
+	keysMu   sync.Mutex      //guards keysMade
+	keysMade bool            //keysTable is known to exist
 }
 
 /*Backend returns a backend and nil error if successful*/
@@ -28,41 +37,130 @@ func Backend(driver, source string) (homehub.Backend, error) {
 	return New(driver, source)
 }
 
-/*New returns an intialized Brianiac or a non-nil error*/
+/*New returns an intialized Brianiac or a non-nil error.  The homehub.Dialect
+registered under the driver name is used to form SQL statements.*/
 func New(driver, source string) (*SQLBackend, error) {
+	return NewDialect(driver, driver, source)
+}
+
+/*NewDialect is like New, but uses the named homehub.Dialect rather than the one
+registered under the driver name.  This allows eg a CockroachDB dialect to
+be used over the postgres driver.*/
+func NewDialect(dialect, driver, source string) (*SQLBackend, error) {
+	sqld, err := homehub.LookupDialect(dialect)
+	if err != nil {
+		return nil, err
+	}
 	db, err := sqlx.Connect(driver, source)
 	if err != nil {
 		return nil, err
 	}
-	return &SQLBackend{dialect: driver, db: db}, nil
+	return &SQLBackend{dialect: dialect, sqld: sqld, db: db}, nil
 }
 
 /*Register attempts to register the passed piece of data
-into the database - usually this means creating a table*/
+into the database - usually this means creating a table.  If the table
+already exists, any new fields are added to it as columns.*/
 func (q *SQLBackend) Register(datam homehub.Datam) error {
 	sql, err := datam.SqlCreate(q.dialect)
 	if err != nil {
 		return err
 	}
-	//convert ?'s to whatever is natively used
-	sql = q.db.Rebind(sql)
-	_, err = q.db.Exec(sql)
-	return err
+	if _, err = q.db.Exec(sql); err != nil {
+		return err
+	}
+
+	existing, err := q.columns(datam.Table)
+	if err != nil {
+		return err
+	}
+	alters, err := datam.SqlAlter(q.dialect, existing)
+	if err != nil {
+		return err
+	}
+	for _, alter := range alters {
+		if _, err = q.db.Exec(alter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*columns returns the columns of table mapped to their type*/
+func (q *SQLBackend) columns(table homehub.Alphabetic) (map[string]string, error) {
+	query, args := q.sqld.ColumnsQuery(string(table))
+	rows := []struct {
+		Name string `db:"name"`
+		Type string `db:"type"`
+	}{}
+	if err := q.db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	columns := map[string]string{}
+	for _, row := range rows {
+		columns[row.Name] = row.Type
+	}
+	return columns, nil
 }
 
 /*Store attempts to store the passed piece of data
 into the database*/
 func (q *SQLBackend) Store(datam homehub.Datam) error {
-	query, args, err := datam.NamedExec()
+	query, args, err := datam.SqlInsert(q.dialect)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.Exec(query, args...)
+	return missing(err)
+}
+
+/*StoreBatch stores every datam in batch within a single transaction, so either
+all of them are stored or none are*/
+func (q *SQLBackend) StoreBatch(batch homehub.DatamBatch) error {
+	tx, err := q.db.Beginx()
 	if err != nil {
 		return err
 	}
-	//convert ? -> whatever is natively used
-	query = q.db.Rebind(query)
-	_, err = q.db.NamedExec(query, args)
+	for i, datam := range batch {
+		query, args, err := datam.SqlInsert(q.dialect)
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("batch entry %d: %w", i, missing(err))
+		}
+	}
+	return tx.Commit()
+}
+
+/*missing wraps err with homehub.ErrUnknownTable or homehub.ErrUnknownField if the
+database refused it for naming a table or column it does not have, which no
+amount of retrying will fix*/
+func missing(err error) error {
+	var pqerr *pq.Error
+	var myerr *mysql.MySQLError
+	var liteerr sqlite3.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &pqerr) && pqerr.Code == "42P01",
+		errors.As(err, &myerr) && myerr.Number == 1146,
+		errors.As(err, &liteerr) && strings.HasPrefix(liteerr.Error(), "no such table"):
+		return fmt.Errorf("%w: %w", homehub.ErrUnknownTable, err)
+	case errors.As(err, &pqerr) && pqerr.Code == "42703",
+		errors.As(err, &myerr) && myerr.Number == 1054,
+		errors.As(err, &liteerr) && strings.Contains(liteerr.Error(), "has no column named"):
+		return fmt.Errorf("%w: %w", homehub.ErrUnknownField, err)
+	}
 	return err
 }
 
+/*DBStats returns the statistics of the database's connection pool*/
+func (q *SQLBackend) DBStats() sql.DBStats {
+	return q.db.Stats()
+}
+
 /*Stop shuts down the database*/
 func (q *SQLBackend) Stop() {
 	q.db.Close()
@@ -9,7 +9,11 @@ This file is part of the HomeHub project
 package sql
 
 import (
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/npotts/homehub"
 )
@@ -32,6 +36,16 @@ func Test_New(t *testing.T) {
 	} else {
 		nn.Stop()
 	}
+
+	if _, err := NewDialect("no idea", "sqlite3", ":memory:"); err == nil {
+		t.Errorf("Should error out with an unregistered dialect")
+	}
+	homehub.RegisterDialect("lite", homehub.SQLite3)
+	if d, err := NewDialect("lite", "sqlite3", ":memory:"); err != nil {
+		t.Errorf("Should be able to use a registered dialect: %v", err)
+	} else {
+		d.Stop()
+	}
 }
 
 func TestSQLBackend_RegisterStore(t *testing.T) {
@@ -57,3 +71,337 @@ func TestSQLBackend_RegisterStore(t *testing.T) {
 	}
 
 }
+
+func TestSQLBackend_StoreTimestamp(t *testing.T) {
+	q, e := New("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Couldnt start instance: %v", e)
+	}
+	defer q.Stop()
+
+	datam := homehub.Datam{}
+	if e := json.Unmarshal([]byte(`{"table": "buffered", "timestamp": "2016-10-13T19:14:56Z", "data": {"temp": 21.5}}`), &datam); e != nil {
+		t.Fatalf("Unable to decode: %v", e)
+	}
+	if e := q.Register(datam); e != nil {
+		t.Fatalf("Unable to register: %v", e)
+	}
+	if e := q.Store(datam); e != nil {
+		t.Fatalf("Unable to store: %v", e)
+	}
+
+	var created time.Time
+	if e := q.db.Get(&created, "SELECT created FROM buffered"); e != nil {
+		t.Fatalf("Unable to read back: %v", e)
+	}
+	if !created.Equal(datam.Timestamp.Time) {
+		t.Errorf("Stored time does not match supplied timestamp: %v", created)
+	}
+}
+
+func TestSQLBackend_StoreBatch(t *testing.T) {
+	q, e := New("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Couldnt start instance: %v", e)
+	}
+	defer q.Stop()
+	if e := q.Register(homehub.GoodSample); e != nil {
+		t.Fatalf("Unable to register: %v", e)
+	}
+
+	count := func() (n int) {
+		q.db.Get(&n, "SELECT count(*) FROM test")
+		return
+	}
+
+	good := homehub.DatamBatch{homehub.GoodSample, homehub.GoodSample}
+	if e := q.StoreBatch(good); e != nil || count() != 2 {
+		t.Errorf("Unable to store batch: %v", e)
+	}
+
+	bad := homehub.DatamBatch{homehub.GoodSample, homehub.Datam{}}
+	if e := q.StoreBatch(bad); e == nil || count() != 2 {
+		t.Errorf("Bad batch should be rolled back as a whole: %v", e)
+	}
+
+	if errs := homehub.StoreBatch(q, good); errs[0] != nil || errs[1] != nil || count() != 4 {
+		t.Errorf("homehub.StoreBatch should use the transaction path: %v", errs)
+	}
+}
+
+func TestSQLBackend_RegisterEvolves(t *testing.T) {
+	q, e := New("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Couldnt start instance: %v", e)
+	}
+	defer q.Stop()
+
+	decode := func(j string) (datam homehub.Datam) {
+		if e := json.Unmarshal([]byte(j), &datam); e != nil {
+			t.Fatalf("Unable to decode %s: %v", j, e)
+		}
+		return
+	}
+
+	older := decode(`{"table": "device", "data": {"temp": 21.5}}`)
+	newer := decode(`{"table": "device", "data": {"temp": 21.5, "humidity": 40, "label": "attic"}}`)
+	if e := q.Register(older); e != nil {
+		t.Fatalf("Unable to register: %v", e)
+	}
+	if e := q.Store(newer); !errors.Is(e, homehub.ErrUnknownField) {
+		t.Fatalf("Should not be able to store before the new fields are registered: %v", e)
+	}
+	if e := q.StoreBatch(homehub.DatamBatch{decode(`{"table": "nowhere", "data": {"temp": 1}}`)}); !errors.Is(e, homehub.ErrUnknownTable) {
+		t.Errorf("Should tell a table that was never registered: %v", e)
+	}
+	if e := q.Register(newer); e != nil {
+		t.Fatalf("Unable to register new fields: %v", e)
+	}
+	if e := q.Store(newer); e != nil {
+		t.Errorf("Unable to store after registering new fields: %v", e)
+	}
+	if e := q.Register(older); e != nil {
+		t.Errorf("Registering a subset of fields should be fine: %v", e)
+	}
+
+	e = q.Register(decode(`{"table": "device", "data": {"temp": "warm"}}`))
+	if _, ok := e.(*homehub.SchemaConflictError); !ok {
+		t.Errorf("Expected a schema conflict, got %v", e)
+	}
+}
+
+func TestSQLBackend_Keys(t *testing.T) {
+	q, e := New("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Couldnt start instance: %v", e)
+	}
+	defer q.Stop()
+
+	//the keys table is only made with the first key
+	if _, e := q.LookupKey("nope"); e != homehub.ErrUnknownKey {
+		t.Errorf("No key should be known before the first is made: %v", e)
+	}
+	if keys, e := q.ListKeys(); e != nil || len(keys) != 0 {
+		t.Errorf("Should list no keys before the first is made: %v %v", keys, e)
+	}
+	if e := q.RevokeKey("garage"); e != homehub.ErrUnknownKey {
+		t.Errorf("Should revoke nothing before the first key is made: %v", e)
+	}
+
+	if _, e := q.CreateKey(homehub.APIKey{Device: "garage"}); e == nil {
+		t.Errorf("Should not create a key without tables or permissions")
+	}
+	first, e := q.CreateKey(homehub.APIKey{Device: "garage", Tables: []string{"garage*", "door"}, Perms: homehub.PermStore})
+	if e != nil {
+		t.Fatalf("Unable to create key: %v", e)
+	}
+	key, e := q.LookupKey(first)
+	if e != nil || key.Device != "garage" || len(key.Tables) != 2 || key.Perms != homehub.PermStore {
+		t.Errorf("Unable to lookup key: %+v %v", key, e)
+	}
+
+	second, e := q.CreateKey(homehub.APIKey{Device: "garage", Tables: []string{"garage"}, Perms: homehub.PermBoth})
+	if e != nil {
+		t.Fatalf("Unable to reissue key: %v", e)
+	}
+	if _, e := q.LookupKey(first); e != homehub.ErrUnknownKey {
+		t.Errorf("Reissuing should replace the old token: %v", e)
+	}
+	if key, e := q.LookupKey(second); e != nil || key.Perms != homehub.PermBoth {
+		t.Errorf("Unable to lookup reissued key: %+v %v", key, e)
+	}
+	if key, e := q.DeviceKey("garage"); e != nil || key.Tables[0] != "garage" {
+		t.Errorf("Unable to lookup key by device: %+v %v", key, e)
+	}
+	if _, e := q.DeviceKey("nope"); e != homehub.ErrUnknownKey {
+		t.Errorf("Unknown device should have no key: %v", e)
+	}
+
+	q.CreateKey(homehub.APIKey{Device: "attic", Tables: []string{"attic"}, Perms: homehub.PermRegister})
+	if keys, e := q.ListKeys(); e != nil || len(keys) != 2 || keys[0].Device != "attic" {
+		t.Errorf("Unable to list keys: %+v %v", keys, e)
+	}
+
+	if e := q.RevokeKey("garage"); e != nil {
+		t.Errorf("Unable to revoke: %v", e)
+	}
+	if e := q.RevokeKey("garage"); e != homehub.ErrUnknownKey {
+		t.Errorf("Revoking twice should fail: %v", e)
+	}
+	if _, e := q.LookupKey(second); e != homehub.ErrUnknownKey {
+		t.Errorf("Revoked key should be unknown: %v", e)
+	}
+}
+
+func TestSQLBackend_Reader(t *testing.T) {
+	q, e := New("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Couldnt start instance: %v", e)
+	}
+	defer q.Stop()
+	var _ homehub.Reader = q
+
+	decode := func(j string) (datam homehub.Datam) {
+		if e := json.Unmarshal([]byte(j), &datam); e != nil {
+			t.Fatalf("Unable to decode %s: %v", j, e)
+		}
+		return
+	}
+	for i, j := range []string{
+		`{"table": "attic", "timestamp": "2016-01-01T00:00:00Z", "data": {"temp": 20.5, "count": 1, "open": true, "label": "a"}}`,
+		`{"table": "attic", "timestamp": "2016-01-02T00:00:00Z", "data": {"temp": 21.5, "count": 2, "open": false, "label": null}}`,
+		`{"table": "attic", "timestamp": "2016-01-03T00:00:00Z", "data": {"temp": 22.5, "count": 3, "open": true, "label": "c"}}`,
+	} {
+		datam := decode(j)
+		if i == 0 {
+			if e := q.Register(datam); e != nil {
+				t.Fatalf("Unable to register: %v", e)
+			}
+		}
+		if e := q.Store(datam); e != nil {
+			t.Fatalf("Unable to store: %v", e)
+		}
+	}
+	q.Register(homehub.GoodSample)
+	q.CreateKey(homehub.APIKey{Device: "attic", Tables: []string{"attic"}, Perms: homehub.PermStore})
+
+	if tables, e := q.Tables(); e != nil || len(tables) != 2 || tables[0] != "attic" || tables[1] != "test" {
+		t.Errorf("Unexpected tables: %v %v", tables, e)
+	}
+
+	schema, e := q.Schema("attic")
+	names := []string{}
+	for _, column := range schema {
+		names = append(names, column.Name)
+	}
+	if e != nil || strings.Join(names, ",") != "rowid,created,count,label,open,temp" || schema[2].Mode != homehub.ModeInt || schema[5].Mode != homehub.ModeFloat {
+		t.Errorf("Unexpected schema: %+v %v", schema, e)
+	}
+	if _, e := q.Schema("nothere"); e != homehub.ErrUnknownTable {
+		t.Errorf("Expected an unknown table: %v", e)
+	}
+
+	rows, e := q.Rows(homehub.Query{Table: "attic"})
+	if e != nil || len(rows) != 3 {
+		t.Fatalf("Unable to read rows: %v %v", rows, e)
+	}
+	first := rows[0]
+	if !first.Timestamp.Equal(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)) || first.Data["temp"].Value != 20.5 ||
+		first.Data["count"].Value != int64(1) || first.Data["open"].Value != true || first.Data["label"].Value != "a" {
+		t.Errorf("Unexpected first row: %+v %v", first, first.Timestamp)
+	}
+	if rows[1].Data["label"].Mode() != homehub.ModeNull {
+		t.Errorf("Null should read back as null: %+v", rows[1])
+	}
+
+	rows, e = q.Rows(homehub.Query{
+		Table:  "attic",
+		From:   time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC),
+		To:     time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC),
+		Fields: []homehub.Alphabetic{"temp"},
+	})
+	if e != nil || len(rows) != 1 || len(rows[0].Data) != 1 || rows[0].Data["temp"].Value != 21.5 {
+		t.Errorf("Unexpected bounded rows: %+v %v", rows, e)
+	}
+	if rows, e = q.Rows(homehub.Query{Table: "attic", Limit: 2}); e != nil || len(rows) != 2 {
+		t.Errorf("Limit not applied: %v %v", len(rows), e)
+	}
+	if _, e = q.Rows(homehub.Query{Table: "attic", Fields: []homehub.Alphabetic{"nothere"}}); !errors.Is(e, homehub.ErrUnknownField) {
+		t.Errorf("Expected an unknown field: %v", e)
+	}
+}
+
+/*folding folds names to lower case as the postgres dialect does, over sqlite3,
+which already matches names regardless of case*/
+type folding struct {
+	homehub.Dialect
+}
+
+func (folding) Fold(identifier string) string { return strings.ToLower(identifier) }
+
+func TestSQLBackend_ReaderFolds(t *testing.T) {
+	homehub.RegisterDialect("folding", folding{homehub.SQLite3})
+	q, e := NewDialect("folding", "sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Couldnt start instance: %v", e)
+	}
+	defer q.Stop()
+
+	//the column is kept under its folded name, as postgres does
+	folded, datam := homehub.Datam{}, homehub.Datam{}
+	json.Unmarshal([]byte(`{"table": "porch", "data": {"outsidetemp": 4.5}}`), &folded)
+	if e := json.Unmarshal([]byte(`{"table": "porch", "data": {"outsideTemp": 4.5}}`), &datam); e != nil {
+		t.Fatalf("Unable to decode: %v", e)
+	}
+	if e := q.Register(folded); e != nil {
+		t.Fatalf("Unable to register: %v", e)
+	}
+	if e := q.Store(datam); e != nil {
+		t.Fatalf("Unable to store: %v", e)
+	}
+	rows, e := q.Rows(homehub.Query{Table: "porch", Fields: []homehub.Alphabetic{"outsideTemp"}})
+	if e != nil || len(rows) != 1 || rows[0].Data["outsideTemp"].Value != 4.5 {
+		t.Errorf("Should find a camelCase field the database folded: %+v %v", rows, e)
+	}
+	buckets, e := q.Aggregate(homehub.AggregateQuery{Query: homehub.Query{Table: "porch", Fields: []homehub.Alphabetic{"outsideTemp"}}, Bucket: time.Hour, Functions: []homehub.Aggregate{homehub.AggMax}})
+	if e != nil || len(buckets) != 1 || buckets[0].Data["outsideTemp"][homehub.AggMax].Value != 4.5 {
+		t.Errorf("Should aggregate a camelCase field the database folded: %+v %v", buckets, e)
+	}
+}
+
+func TestSQLBackend_Aggregate(t *testing.T) {
+	q, e := New("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Couldnt start instance: %v", e)
+	}
+	defer q.Stop()
+	var _ homehub.Aggregator = q
+
+	for i, j := range []string{
+		`{"table": "attic", "timestamp": "2016-01-01T00:10:00Z", "data": {"temp": 20, "open": true, "label": "a"}}`,
+		`{"table": "attic", "timestamp": "2016-01-01T00:50:00Z", "data": {"temp": 22, "open": false, "label": null}}`,
+		`{"table": "attic", "timestamp": "2016-01-01T02:30:00Z", "data": {"temp": 30, "open": true, "label": "c"}}`,
+	} {
+		datam := homehub.Datam{}
+		json.Unmarshal([]byte(j), &datam)
+		if i == 0 {
+			q.Register(datam)
+		}
+		if e := q.Store(datam); e != nil {
+			t.Fatalf("Unable to store: %v", e)
+		}
+	}
+
+	buckets, e := q.Aggregate(homehub.AggregateQuery{
+		Query:     homehub.Query{Table: "attic", Fields: []homehub.Alphabetic{"temp", "label"}},
+		Bucket:    time.Hour,
+		Functions: []homehub.Aggregate{homehub.AggMin, homehub.AggMax, homehub.AggCount, homehub.AggLast},
+	})
+	if e != nil || len(buckets) != 2 {
+		t.Fatalf("Unable to aggregate: %+v %v", buckets, e)
+	}
+	first := buckets[0]
+	if !first.Start.Equal(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)) || first.Data["temp"]["min"].Value != int64(20) ||
+		first.Data["temp"]["max"].Value != int64(22) || first.Data["temp"]["last"].Value != int64(22) ||
+		first.Data["label"]["count"].Value != int64(1) || first.Data["label"]["last"].Value != "a" {
+		t.Errorf("Unexpected first bucket: %+v", first)
+	}
+	if !buckets[1].Start.Equal(time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)) || buckets[1].Data["temp"]["last"].Value != int64(30) {
+		t.Errorf("Unexpected second bucket: %+v", buckets[1])
+	}
+
+	//with no fields, only those a mean can summarize
+	buckets, e = q.Aggregate(homehub.AggregateQuery{
+		Query:     homehub.Query{Table: "attic", From: time.Date(2016, 1, 1, 1, 0, 0, 0, time.UTC)},
+		Bucket:    24 * time.Hour,
+		Functions: []homehub.Aggregate{homehub.AggMean},
+	})
+	if e != nil || len(buckets) != 1 || len(buckets[0].Data) != 1 || buckets[0].Data["temp"]["mean"].Value != 30.0 {
+		t.Errorf("Unexpected bounded buckets: %+v %v", buckets, e)
+	}
+
+	_, e = q.Aggregate(homehub.AggregateQuery{Query: homehub.Query{Table: "attic", Fields: []homehub.Alphabetic{"open"}}, Bucket: time.Hour, Functions: []homehub.Aggregate{homehub.AggMean}})
+	if !errors.Is(e, homehub.ErrInvalidQuery) {
+		t.Errorf("Should not take the mean of a bool: %v", e)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package sql
+
+import (
+	dbsql "database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/npotts/homehub"
+)
+
+/*keysTable holds the API keys.  The underscore keeps it from colliding with
+any table a Datam could name.*/
+const keysTable = "homehub_keys"
+
+var keyColumns = []homehub.Column{
+	{Name: "rowid", Mode: homehub.ModePrimaryKey},
+	{Name: "created", Mode: homehub.ModeDateTime},
+	{Name: "device", Mode: homehub.ModeString},
+	{Name: "hash", Mode: homehub.ModeString},
+	{Name: "tables", Mode: homehub.ModeString},
+	{Name: "perms", Mode: homehub.ModeInt},
+}
+
+/*keyRow is how an APIKey is kept in keysTable*/
+type keyRow struct {
+	Device string `db:"device"`
+	Tables string `db:"tables"`
+	Perms  int    `db:"perms"`
+}
+
+func (k keyRow) key() homehub.APIKey {
+	return homehub.APIKey{Device: k.Device, Tables: strings.Split(k.Tables, ","), Perms: homehub.Permission(k.Perms)}
+}
+
+/*keysSQL forms a statement against keysTable, replacing {device}, {hash}, etc with
+quoted column names and {1}, {2}, etc with placeholders*/
+func (q *SQLBackend) keysSQL(statement string) string {
+	pairs := []string{"{table}", q.sqld.Quote(keysTable)}
+	for _, column := range keyColumns {
+		pairs = append(pairs, "{"+column.Name+"}", q.sqld.Quote(column.Name))
+	}
+	for i := 1; i <= 4; i++ {
+		pairs = append(pairs, fmt.Sprintf("{%d}", i), q.sqld.Placeholder(i))
+	}
+	return strings.NewReplacer(pairs...).Replace(statement)
+}
+
+/*ensureKeys creates keysTable the first time a key is created.  Until then the
+lookups find no such table, which noKeys takes to mean there are no keys.*/
+func (q *SQLBackend) ensureKeys() error {
+	q.keysMu.Lock()
+	defer q.keysMu.Unlock()
+	if q.keysMade {
+		return nil
+	}
+	create, err := q.sqld.CreateTable(keysTable, keyColumns)
+	if err != nil {
+		return err
+	}
+	if _, err = q.db.Exec(create); err == nil {
+		q.keysMade = true
+	}
+	return err
+}
+
+/*noKeys returns true if err says keysTable was never created*/
+func noKeys(err error) bool {
+	return errors.Is(missing(err), homehub.ErrUnknownTable)
+}
+
+/*CreateKey conforms to the homehub.KeyStore interface*/
+func (q *SQLBackend) CreateKey(key homehub.APIKey) (string, error) {
+	if key.Device == "" || len(key.Tables) == 0 || key.Perms&homehub.PermBoth == 0 {
+		return "", fmt.Errorf("An API key needs a device, at least one table pattern and a permission")
+	}
+	for _, pattern := range key.Tables {
+		if pattern == "" || strings.Contains(pattern, ",") {
+			return "", fmt.Errorf("Invalid table pattern %q", pattern)
+		}
+	}
+	token, err := homehub.NewToken()
+	if err != nil {
+		return "", err
+	}
+	if err = q.ensureKeys(); err != nil {
+		return "", err
+	}
+
+	tx, err := q.db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec(q.keysSQL(`DELETE FROM {table} WHERE {device} = {1};`), key.Device); err == nil {
+		_, err = tx.Exec(q.keysSQL(`INSERT INTO {table} ({device}, {hash}, {tables}, {perms}) VALUES ({1}, {2}, {3}, {4});`),
+			key.Device, homehub.HashToken(token), strings.Join(key.Tables, ","), int(key.Perms))
+	}
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+/*findKey returns the key whose column matches value, or homehub.ErrUnknownKey*/
+func (q *SQLBackend) findKey(column, value string) (homehub.APIKey, error) {
+	row := keyRow{}
+	err := q.db.Get(&row, q.keysSQL(`SELECT {device} AS device, {tables} AS tables, {perms} AS perms FROM {table} WHERE {`+column+`} = {1};`), value)
+	if err == dbsql.ErrNoRows || noKeys(err) {
+		return homehub.APIKey{}, homehub.ErrUnknownKey
+	}
+	if err != nil {
+		return homehub.APIKey{}, err
+	}
+	return row.key(), nil
+}
+
+/*LookupKey conforms to the homehub.KeyStore interface*/
+func (q *SQLBackend) LookupKey(token string) (homehub.APIKey, error) {
+	return q.findKey("hash", homehub.HashToken(token))
+}
+
+/*DeviceKey conforms to the homehub.KeyStore interface*/
+func (q *SQLBackend) DeviceKey(device string) (homehub.APIKey, error) {
+	return q.findKey("device", device)
+}
+
+/*RevokeKey conforms to the homehub.KeyStore interface*/
+func (q *SQLBackend) RevokeKey(device string) error {
+	result, err := q.db.Exec(q.keysSQL(`DELETE FROM {table} WHERE {device} = {1};`), device)
+	if noKeys(err) {
+		return homehub.ErrUnknownKey
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return homehub.ErrUnknownKey
+	}
+	return nil
+}
+
+/*ListKeys conforms to the homehub.KeyStore interface*/
+func (q *SQLBackend) ListKeys() ([]homehub.APIKey, error) {
+	rows := []keyRow{}
+	err := q.db.Select(&rows, q.keysSQL(`SELECT {device} AS device, {tables} AS tables, {perms} AS perms FROM {table} ORDER BY {device};`))
+	if err != nil && !noKeys(err) {
+		return nil, err
+	}
+	keys := make([]homehub.APIKey, len(rows))
+	for i, row := range rows {
+		keys[i] = row.key()
+	}
+	return keys, nil
+}
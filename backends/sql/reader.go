@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package sql
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/npotts/homehub"
+)
+
+/*timeFormats are the ways a driver may hand back a DATETIME as text*/
+var timeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+/*scanTime converts a 'created' value read from the database into a time*/
+func scanTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC(), nil
+	case []byte:
+		value = string(v)
+	}
+	if s, ok := value.(string); ok {
+		for _, format := range timeFormats {
+			if t, err := time.Parse(format, s); err == nil {
+				return t.UTC(), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("Cannot convert %T %v to a time", value, value)
+}
+
+/*Tables conforms to the homehub.Reader interface.  Tables that a Datam could
+not name, such as the API keys, are left out.*/
+func (q *SQLBackend) Tables() ([]homehub.Alphabetic, error) {
+	names := []string{}
+	if err := q.db.Select(&names, q.sqld.TablesQuery()); err != nil {
+		return nil, err
+	}
+	tables := []homehub.Alphabetic{}
+	for _, name := range names {
+		if table := homehub.Alphabetic(name); table.Valid() {
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
+
+/*Schema conforms to the homehub.Reader interface.  The 'rowid' and 'created'
+columns come first, followed by the fields sorted by name.*/
+func (q *SQLBackend) Schema(table homehub.Alphabetic) ([]homehub.Column, error) {
+	if !table.Valid() {
+		return nil, homehub.ErrUnknownTable
+	}
+	existing, err := q.columns(table)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return nil, homehub.ErrUnknownTable
+	}
+	order := map[string]int{"rowid": -2, "created": -1}
+	columns := []homehub.Column{}
+	for name, coltype := range existing {
+		columns = append(columns, homehub.Column{Name: name, Mode: q.sqld.ColumnMode(coltype)})
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		oi, oj := order[columns[i].Name], order[columns[j].Name]
+		if oi != oj {
+			return oi < oj
+		}
+		return columns[i].Name < columns[j].Name
+	})
+	return columns, nil
+}
+
+/*fields fills in query.Fields with every field of the table if it is empty, and
+returns the mode of each of them.  Fields are matched to columns as the dialect
+folds names, so they keep the case they were asked for in.*/
+func (q *SQLBackend) fields(query *homehub.Query) (map[homehub.Alphabetic]homehub.FieldMode, error) {
+	schema, err := q.Schema(query.Table)
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]homehub.FieldMode{}
+	fields := []homehub.Alphabetic{}
+	for _, column := range schema {
+		if column.Name == "rowid" || column.Name == "created" {
+			continue
+		}
+		columns[column.Name] = column.Mode
+		fields = append(fields, homehub.Alphabetic(column.Name))
+	}
+	if len(query.Fields) == 0 {
+		query.Fields = fields
+	}
+	modes := map[homehub.Alphabetic]homehub.FieldMode{}
+	for _, field := range query.Fields {
+		mode, ok := columns[q.sqld.Fold(string(field))]
+		if !ok {
+			return nil, fmt.Errorf("%w %q in table %q", homehub.ErrUnknownField, field, query.Table)
+		}
+		modes[field] = mode
+	}
+	return modes, nil
+}
+
+/*Rows conforms to the homehub.Reader interface.  Null values are returned as
+null Fields.*/
+func (q *SQLBackend) Rows(query homehub.Query) ([]homehub.Datam, error) {
+	modes, err := q.fields(&query)
+	if err != nil {
+		return nil, err
+	}
+	if len(query.Fields) == 0 { //table without any fields yet
+		return []homehub.Datam{}, nil
+	}
+
+	statement, args, err := query.SqlSelect(q.dialect)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.db.Queryx(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := []homehub.Datam{}
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return nil, err
+		}
+		created, err := scanTime(values[0])
+		if err != nil {
+			return nil, err
+		}
+		datam := homehub.Datam{Table: query.Table, Data: map[homehub.Alphabetic]homehub.Field{}, Timestamp: &homehub.Timestamp{Time: created}}
+		for i, field := range query.Fields {
+			if datam.Data[field], err = homehub.NewField(modes[field], values[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		data = append(data, datam)
+	}
+	return data, rows.Err()
+}
+
+/*Aggregate conforms to the homehub.Aggregator interface.  With no Fields, every
+field the Functions can summarize is used.*/
+func (q *SQLBackend) Aggregate(query homehub.AggregateQuery) ([]homehub.Bucket, error) {
+	if len(query.Functions) == 0 {
+		return nil, fmt.Errorf("%w: no aggregate functions given", homehub.ErrInvalidQuery)
+	}
+	all := len(query.Fields) == 0
+	modes, err := q.fields(&query.Query)
+	if err != nil {
+		return nil, err
+	}
+	fields := []homehub.Alphabetic{}
+	for _, field := range query.Fields {
+		accepted := true
+		for _, agg := range query.Functions {
+			accepted = accepted && agg.Accepts(modes[field])
+		}
+		switch {
+		case accepted:
+			fields = append(fields, field)
+		case !all:
+			return nil, fmt.Errorf("%w: cannot take the %v of %v field %q", homehub.ErrInvalidQuery, query.Functions, modes[field], field)
+		}
+	}
+	query.Fields = fields
+	if len(query.Fields) == 0 {
+		return []homehub.Bucket{}, nil
+	}
+
+	statement, args, err := query.SqlAggregate(q.dialect)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.db.Queryx(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []homehub.Bucket{}
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return nil, err
+		}
+		start, err := homehub.NewField(homehub.ModeInt, values[0])
+		if err == nil && start.Mode() != homehub.ModeInt {
+			err = fmt.Errorf("Bucket without a start time")
+		}
+		if err != nil {
+			return nil, err
+		}
+		bucket := homehub.Bucket{Start: time.Unix(start.Value.(int64), 0).UTC(), Data: map[homehub.Alphabetic]map[homehub.Aggregate]homehub.Field{}}
+		values = values[1:]
+		for _, field := range query.Fields {
+			bucket.Data[field] = map[homehub.Aggregate]homehub.Field{}
+			for _, agg := range query.Functions {
+				if bucket.Data[field][agg], err = homehub.NewField(agg.Mode(modes[field]), values[0]); err != nil {
+					return nil, err
+				}
+				values = values[1:]
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
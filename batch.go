@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+/*DatamBatch is a number of Datam delivered together, either as a JSON array or
+as newline delimited JSON (one Datam per line)*/
+type DatamBatch []Datam
+
+var errBatchFormat = fmt.Errorf("Batch must be a JSON array or newline delimited JSON")
+
+/*IsBatch returns true if data looks like a DatamBatch rather than a single Datam:
+either a JSON array, or more than one line where the first is a complete JSON value.*/
+func IsBatch(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return true
+	}
+	if i := bytes.IndexByte(data, '\n'); i > 0 {
+		return json.Valid(data[:i])
+	}
+	return false
+}
+
+/*DecodeBatch decodes data as a DatamBatch.  errs is index aligned with batch and holds
+the reason an individual entry could not be decoded or is not valid (a *ValidationError);
+such entries are left as the zero Datam.  A non-nil err means data is not a batch at all.*/
+func DecodeBatch(data []byte) (batch DatamBatch, errs []error, err error) {
+	raws := []json.RawMessage{}
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		if err = json.Unmarshal(data, &raws); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				raws = append(raws, json.RawMessage(line))
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(raws) == 0 {
+		return nil, nil, errBatchFormat
+	}
+
+	batch, errs = make(DatamBatch, len(raws)), make([]error, len(raws))
+	for i, raw := range raws {
+		datam := Datam{}
+		if datam, errs[i] = DecodeDatam(raw); errs[i] == nil {
+			batch[i] = datam
+		}
+	}
+	return batch, errs, nil
+}
+
+/*RegisterBatch registers every Datam in batch with be, returning the error (if any) for each entry*/
+func RegisterBatch(be Backend, batch DatamBatch) []error {
+	errs := make([]error, len(batch))
+	for i, datam := range batch {
+		errs[i] = be.Register(datam)
+	}
+	return errs
+}
+
+/*StoreBatch stores every Datam in batch with be, returning the error (if any) for each entry.
+If be is a BatchBackend, the whole batch is handed over at once and either every entry
+is stored or none are.*/
+func StoreBatch(be Backend, batch DatamBatch) []error {
+	errs := make([]error, len(batch))
+	if bb, ok := be.(BatchBackend); ok {
+		if err := bb.StoreBatch(batch); err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+	for i, datam := range batch {
+		errs[i] = be.Store(datam)
+	}
+	return errs
+}
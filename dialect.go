@@ -0,0 +1,318 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*Column is a single named and typed column of a table*/
+type Column struct {
+	Name string    `json:"name"`
+	Mode FieldMode `json:"mode"`
+}
+
+/*A Dialect knows how to speak to a particular flavor of SQL database.  The
+sqlite3, postgres and mysql dialects are built in, and others may be added
+with RegisterDialect.*/
+type Dialect interface {
+	ColumnType(FieldMode) (string, error)                                     //column type used to create a column of FieldMode
+	ColumnMode(coltype string) FieldMode                                      //inverse of ColumnType, from the type the database reports
+	Fold(identifier string) string                                            //the name the database keeps a table or column under
+	Quote(identifier string) string                                           //quotes a table or column name
+	Placeholder(n int) string                                                 //the n'th (starting at 1) bind parameter
+	CreateTable(table string, columns []Column) (string, error)               //creates table if it does not exist
+	AddColumn(table string, column Column) (string, error)                    //adds column to an existing table
+	Upsert(table string, columns []Column, conflict []string) (string, error) //inserts columns, updating the rest of a row that conflicts on the conflict columns
+	ColumnsQuery(table string) (string, []interface{})                        //lists the name and type of each column in table
+	TablesQuery() string                                                      //lists the name of each table
+	TimeValue(t time.Time) interface{}                                        //t as a bind parameter that compares correctly with a DateTime column
+	Bucket(column string, width int64) string                                 //start, in Unix seconds, of the width second bucket holding a DateTime column
+}
+
+/*sqlDialect is a table driven Dialect that covers the built in databases.
+
+Identifiers are always quoted, so names that are reserved words work.  Before they
+were, Postgres folded every table and column name to lower case, so its dialect folds
+names itself to keep finding the tables made then.  Names differing only in case are
+therefore the same table or column on Postgres, as they always have been.*/
+type sqlDialect struct {
+	types      map[FieldMode]string //column type for each FieldMode
+	modes      map[string]FieldMode //FieldMode for each (lower case) column type reported by the database
+	quote      string               //identifier quote character
+	fold       bool                 //identifiers are folded to lower case before quoting
+	numbered   bool                 //placeholders are $1, $2... rather than ?
+	duplicate  bool                 //upserts use ON DUPLICATE KEY rather than ON CONFLICT
+	columnsSQL string               //query listing name and type of each column, given the table name
+	tablesSQL  string               //query listing the name of each table
+	timeFormat string               //if set, times are bound as strings in this format rather than as time.Time
+	bucketSQL  string               //Bucket expression, given the column (%[1]s) and width (%[2]d)
+}
+
+/*ColumnType conforms to the Dialect interface*/
+func (s *sqlDialect) ColumnType(f FieldMode) (string, error) {
+	if t, ok := s.types[f]; ok {
+		return t, nil
+	}
+	return "", errSQLType
+}
+
+/*ColumnMode conforms to the Dialect interface*/
+func (s *sqlDialect) ColumnMode(coltype string) FieldMode {
+	if i := strings.IndexByte(coltype, '('); i > 0 { //drop any width, eg tinyint(1)
+		coltype = coltype[:i]
+	}
+	if mode, ok := s.modes[strings.ToLower(strings.TrimSpace(coltype))]; ok {
+		return mode
+	}
+	return ModeInvalid
+}
+
+/*Fold conforms to the Dialect interface*/
+func (s *sqlDialect) Fold(identifier string) string {
+	if s.fold {
+		return strings.ToLower(identifier)
+	}
+	return identifier
+}
+
+/*Quote conforms to the Dialect interface*/
+func (s *sqlDialect) Quote(identifier string) string {
+	identifier = s.Fold(identifier)
+	return s.quote + strings.Replace(identifier, s.quote, s.quote+s.quote, -1) + s.quote
+}
+
+/*Placeholder conforms to the Dialect interface*/
+func (s *sqlDialect) Placeholder(n int) string {
+	if s.numbered {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+/*CreateTable conforms to the Dialect interface*/
+func (s *sqlDialect) CreateTable(table string, columns []Column) (string, error) {
+	defs := []string{}
+	for _, column := range columns {
+		coltype, err := s.ColumnType(column.Mode)
+		if err != nil {
+			return "", err
+		}
+		defs = append(defs, s.Quote(column.Name)+" "+coltype)
+	}
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s);`, s.Quote(table), strings.Join(defs, ", ")), nil
+}
+
+/*AddColumn conforms to the Dialect interface*/
+func (s *sqlDialect) AddColumn(table string, column Column) (string, error) {
+	coltype, err := s.ColumnType(column.Mode)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, s.Quote(table), s.Quote(column.Name), coltype), nil
+}
+
+/*Upsert conforms to the Dialect interface*/
+func (s *sqlDialect) Upsert(table string, columns []Column, conflict []string) (string, error) {
+	if len(columns) == 0 || len(conflict) == 0 {
+		return "", fmt.Errorf("Upsert into %q needs columns and the columns it conflicts on", table)
+	}
+	quoted, holders, updates, known := make([]string, len(columns)), make([]string, len(columns)), []string{}, map[string]bool{}
+	for _, name := range conflict {
+		known[name] = false
+	}
+	for i, column := range columns {
+		if _, err := s.ColumnType(column.Mode); err != nil {
+			return "", err
+		}
+		quoted[i], holders[i] = s.Quote(column.Name), s.Placeholder(i+1)
+		if _, ok := known[column.Name]; ok {
+			known[column.Name] = true
+			continue
+		}
+		if s.duplicate {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", quoted[i], quoted[i]))
+		} else {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", quoted[i], quoted[i]))
+		}
+	}
+	keys := make([]string, len(conflict))
+	for i, name := range conflict {
+		if !known[name] {
+			return "", fmt.Errorf("Upsert into %q conflicts on %q, which is not one of its columns", table, name)
+		}
+		keys[i] = s.Quote(name)
+	}
+
+	r := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, s.Quote(table), strings.Join(quoted, ", "), strings.Join(holders, ", "))
+	switch {
+	case s.duplicate && len(updates) == 0:
+		return `INSERT IGNORE` + r[len("INSERT"):] + ";", nil
+	case s.duplicate:
+		return fmt.Sprintf(`%s ON DUPLICATE KEY UPDATE %s;`, r, strings.Join(updates, ", ")), nil
+	case len(updates) == 0:
+		return fmt.Sprintf(`%s ON CONFLICT (%s) DO NOTHING;`, r, strings.Join(keys, ", ")), nil
+	}
+	return fmt.Sprintf(`%s ON CONFLICT (%s) DO UPDATE SET %s;`, r, strings.Join(keys, ", "), strings.Join(updates, ", ")), nil
+}
+
+/*ColumnsQuery conforms to the Dialect interface*/
+func (s *sqlDialect) ColumnsQuery(table string) (string, []interface{}) {
+	return s.columnsSQL, []interface{}{s.Fold(table)}
+}
+
+/*TablesQuery conforms to the Dialect interface*/
+func (s *sqlDialect) TablesQuery() string {
+	return s.tablesSQL
+}
+
+/*TimeValue conforms to the Dialect interface*/
+func (s *sqlDialect) TimeValue(t time.Time) interface{} {
+	if s.timeFormat != "" {
+		return t.UTC().Format(s.timeFormat)
+	}
+	return t.UTC()
+}
+
+/*Bucket conforms to the Dialect interface*/
+func (s *sqlDialect) Bucket(column string, width int64) string {
+	return fmt.Sprintf(s.bucketSQL, column, width)
+}
+
+var (
+	/*SQLite3 is the built in dialect for "sqlite3"*/
+	SQLite3 Dialect = &sqlDialect{
+		types: map[FieldMode]string{
+			ModeBool:       "BOOL",
+			ModeInt:        "INT",
+			ModeFloat:      "FLOAT",
+			ModeString:     "TEXT",
+			ModePrimaryKey: "INTEGER PRIMARY KEY ASC ON CONFLICT REPLACE AUTOINCREMENT",
+			ModeDateTime:   "DATETIME DEFAULT CURRENT_TIMESTAMP",
+		},
+		modes: map[string]FieldMode{
+			"bool":     ModeBool,
+			"boolean":  ModeBool,
+			"int":      ModeInt,
+			"integer":  ModeInt,
+			"bigint":   ModeInt,
+			"float":    ModeFloat,
+			"real":     ModeFloat,
+			"double":   ModeFloat,
+			"text":     ModeString,
+			"varchar":  ModeString,
+			"datetime": ModeDateTime,
+		},
+		quote:      `"`,
+		columnsSQL: `SELECT name, type FROM pragma_table_info(?)`,
+		tablesSQL:  `SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`,
+		//sqlite3 compares DATETIMEs as text, and both CURRENT_TIMESTAMP and the
+		//driver's own format start out like this
+		timeFormat: "2006-01-02 15:04:05.999999999",
+		bucketSQL:  `(CAST(strftime('%%s', %[1]s) AS INTEGER) / %[2]d * %[2]d)`,
+	}
+
+	/*Postgres is the built in dialect for "postgres"*/
+	Postgres Dialect = &sqlDialect{
+		types: map[FieldMode]string{
+			ModeBool:       "BOOLEAN",
+			ModeInt:        "BIGINT",
+			ModeFloat:      "FLOAT8",
+			ModeString:     "TEXT",
+			ModePrimaryKey: "BIGSERIAL PRIMARY KEY",
+			ModeDateTime:   "TIMESTAMP WITH TIME ZONE DEFAULT (now() at time zone 'utc')",
+		},
+		modes: map[string]FieldMode{
+			"boolean":                  ModeBool,
+			"bigint":                   ModeInt,
+			"integer":                  ModeInt,
+			"smallint":                 ModeInt,
+			"int8":                     ModeInt,
+			"double precision":         ModeFloat,
+			"float8":                   ModeFloat,
+			"real":                     ModeFloat,
+			"numeric":                  ModeFloat,
+			"text":                     ModeString,
+			"character varying":        ModeString,
+			"timestamp with time zone": ModeDateTime,
+		},
+		quote:      `"`,
+		fold:       true,
+		numbered:   true,
+		columnsSQL: `SELECT column_name AS name, data_type AS type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1`,
+		tablesSQL:  `SELECT table_name AS name FROM information_schema.tables WHERE table_schema = current_schema() ORDER BY table_name`,
+		bucketSQL:  `CAST(FLOOR(EXTRACT(EPOCH FROM %[1]s) / %[2]d) * %[2]d AS BIGINT)`,
+	}
+
+	/*MySQL is the built in dialect for "mysql"*/
+	MySQL Dialect = &sqlDialect{
+		types: map[FieldMode]string{
+			ModeBool:       "BOOLEAN",
+			ModeInt:        "BIGINT",
+			ModeFloat:      "DOUBLE",
+			ModeString:     "TEXT",
+			ModePrimaryKey: "INTEGER PRIMARY KEY NOT NULL AUTO_INCREMENT",
+			ModeDateTime:   "DATETIME DEFAULT CURRENT_TIMESTAMP",
+		},
+		modes: map[string]FieldMode{
+			"tinyint":    ModeBool,
+			"bool":       ModeBool,
+			"boolean":    ModeBool,
+			"bigint":     ModeInt,
+			"int":        ModeInt,
+			"integer":    ModeInt,
+			"smallint":   ModeInt,
+			"mediumint":  ModeInt,
+			"double":     ModeFloat,
+			"float":      ModeFloat,
+			"decimal":    ModeFloat,
+			"text":       ModeString,
+			"varchar":    ModeString,
+			"mediumtext": ModeString,
+			"longtext":   ModeString,
+			"datetime":   ModeDateTime,
+		},
+		quote:      "`",
+		duplicate:  true,
+		columnsSQL: `SELECT column_name AS name, data_type AS type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?`,
+		tablesSQL:  `SELECT table_name AS name FROM information_schema.tables WHERE table_schema = DATABASE() ORDER BY table_name`,
+		//TIMESTAMPDIFF rather than UNIX_TIMESTAMP, which would apply the session time zone
+		bucketSQL: `(TIMESTAMPDIFF(SECOND, '1970-01-01 00:00:00', %[1]s) DIV %[2]d * %[2]d)`,
+	}
+)
+
+var (
+	dialectsMu sync.RWMutex
+	dialects   = map[string]Dialect{
+		"sqlite3":  SQLite3,
+		"postgres": Postgres,
+		"mysql":    MySQL,
+	}
+)
+
+/*RegisterDialect makes a Dialect available under name, usually the name of the
+database/sql driver it is used with.  Registering an existing name replaces it.*/
+func RegisterDialect(name string, dialect Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	dialects[name] = dialect
+}
+
+/*LookupDialect returns the Dialect registered as name*/
+func LookupDialect(name string) (Dialect, error) {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	if dialect, ok := dialects[name]; ok {
+		return dialect, nil
+	}
+	return nil, fmt.Errorf("Unknown SQL dialect %q", name)
+}
@@ -9,7 +9,11 @@ This file is part of the HomeHub project
 package homehub
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"regexp"
 	"sort"
 	"strconv"
@@ -35,150 +39,345 @@ func (a Alphabetic) Valid() bool {
 	return realph.MatchString(string(a))
 }
 
-type fieldmode int
+/*FieldMode is the type of value held by a Field*/
+type FieldMode int
 
 const (
-	fmInvalid fieldmode = iota
-	fmNull
-	fmBool
-	fmInt
-	fmFloat
-	fmString
+	ModeInvalid FieldMode = iota
+	ModeNull
+	ModeBool
+	ModeInt
+	ModeFloat
+	ModeString
 	//the rest are not defined for importing via JSON, but are used internally
-	fmPrimaryKey
-	fmDateTime
+	ModePrimaryKey
+	ModeDateTime
 )
 
-var errSQLType = fmt.Errorf("Unknown SQL Type")
+var modeNames = map[FieldMode]string{
+	ModeInvalid:    "invalid",
+	ModeNull:       "null",
+	ModeBool:       "bool",
+	ModeInt:        "int",
+	ModeFloat:      "float",
+	ModeString:     "string",
+	ModePrimaryKey: "primarykey",
+	ModeDateTime:   "datetime",
+}
 
-/*sqltype is functionally a look up table for known dialects to sql create types*/
-func (f fieldmode) sqltype(dialect string) (string, error) {
-	switch dialect {
-	case "sqlite3":
-		switch f {
-		case fmBool:
-			return "BOOL", nil
-		case fmInt:
-			return "INT", nil
-		case fmFloat:
-			return "FLOAT", nil
-		case fmString:
-			return "TEXT", nil
-		case fmPrimaryKey:
-			return "INTEGER PRIMARY KEY ASC ON CONFLICT REPLACE AUTOINCREMENT", nil
-		case fmDateTime:
-			return "DATETIME DEFAULT CURRENT_TIMESTAMP", nil
-		default:
-			return "", errSQLType
-		}
-	case "postgres":
-		switch f {
-		case fmBool:
-			return "BOOLEAN", nil
-		case fmInt:
-			return "BIGINT", nil
-		case fmFloat:
-			return "FLOAT8", nil
-		case fmString:
-			return "TEXT", nil
-		case fmPrimaryKey:
-			return "BIGSERIAL PRIMARY KEY", nil
-		case fmDateTime:
-			return "TIMESTAMP WITH TIME ZONE DEFAULT (now() at time zone 'utc')", nil
-		default:
-			return "", errSQLType
-		}
-	case "mysql":
-		switch f {
-		case fmBool:
-			return "BOOLEAN", nil
-		case fmInt:
-			return "BIGINT", nil
-		case fmFloat:
-			return "DOUBLE", nil
-		case fmString:
-			return "TEXT", nil
-		case fmPrimaryKey:
-			return "INTEGER PRIMARY KEY NOT NULL AUTO_INCREMENT", nil
-		case fmDateTime:
-			return "DATETIME DEFAULT CURRENT_TIMESTAMP", nil
-		default:
-			return "", errSQLType
-		}
-	default:
-		return "", errSQLType
+/*String conforms to the fmt.Stringer interface*/
+func (f FieldMode) String() string {
+	if name, ok := modeNames[f]; ok {
+		return name
 	}
+	return modeNames[ModeInvalid]
+}
 
+/*MarshalText conforms to the encoding.TextMarshaler interface, so modes appear by name in JSON*/
+func (f FieldMode) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
 }
 
+/*UnmarshalText conforms to the encoding.TextUnmarshaler interface*/
+func (f *FieldMode) UnmarshalText(text []byte) error {
+	for mode, name := range modeNames {
+		if name == string(text) {
+			*f = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown field mode %q", text)
+}
+
+var errSQLType = fmt.Errorf("Unknown SQL Type")
+
+/*createdColumn holds when a row was observed, either from Datam.Timestamp or the database default*/
+const createdColumn = "created"
+
 /*Field is a JSON parsable*/
 type Field struct {
-	mode  fieldmode
+	mode  FieldMode
 	Value interface{}
 }
 
 /*Valid returns true if the field captured is valid*/
 func (f Field) Valid() bool {
-	return f.mode != fmInvalid
+	return f.mode != ModeInvalid
 }
 
-var (
-	reNull    = regexp.MustCompile("^null$")
-	reInt     = regexp.MustCompile(`^-?(0|[1-9])+[0-9]*$`)
-	reBool    = regexp.MustCompile(`^true|false$`)
-	reNumber  = regexp.MustCompile(`^-?(?:0|[1-9]\d*)(?:\.\d+)?(?:[eE][+-]?\d+)?`)
-	reString  = regexp.MustCompile(`^".*"$`)
-	errFormat = fmt.Errorf("Unable to convert to a Field Value")
-)
-
-/*UnmarshalJSON conforms to the json.Unmarshaller interface*/
-func (f *Field) UnmarshalJSON(incoming []byte) (err error) {
-	raws := string(incoming)
+/*Mode returns the type of value held by the field*/
+func (f Field) Mode() FieldMode {
+	return f.mode
+}
 
-	if reNull.Match(incoming) { //null check
-		f.mode, f.Value = fmNull, nil
-		return
+/*NewField converts a value read back from a database into a Field of the given
+mode.  Drivers differ in what they return (eg mysql returns []byte for most
+columns, and sqlite3 integers for bools), so a few conversions are made.
+A nil value is always a null Field.*/
+func NewField(mode FieldMode, value interface{}) (Field, error) {
+	if value == nil {
+		return Field{mode: ModeNull}, nil
+	}
+	if raw, ok := value.([]byte); ok {
+		value = string(raw)
 	}
 
-	if reBool.Match(incoming) { //bool check
-		f.mode = fmBool
-		f.Value, err = strconv.ParseBool(raws)
-		return
+	var err error
+	switch mode {
+	case ModeBool:
+		switch v := value.(type) {
+		case bool:
+			return Field{mode: mode, Value: v}, nil
+		case int64:
+			return Field{mode: mode, Value: v != 0}, nil
+		case string:
+			var b bool
+			if b, err = strconv.ParseBool(v); err == nil {
+				return Field{mode: mode, Value: b}, nil
+			}
+		}
+	case ModeInt, ModePrimaryKey:
+		switch v := value.(type) {
+		case int64:
+			return Field{mode: ModeInt, Value: v}, nil
+		case string:
+			var i int64
+			if i, err = strconv.ParseInt(v, 10, 64); err == nil {
+				return Field{mode: ModeInt, Value: i}, nil
+			}
+		}
+	case ModeFloat:
+		switch v := value.(type) {
+		case float64:
+			return Field{mode: mode, Value: v}, nil
+		case int64:
+			return Field{mode: mode, Value: float64(v)}, nil
+		case string:
+			var f float64
+			if f, err = strconv.ParseFloat(v, 64); err == nil {
+				return Field{mode: mode, Value: f}, nil
+			}
+		}
+	case ModeString:
+		if v, ok := value.(string); ok {
+			return Field{mode: mode, Value: v}, nil
+		}
 	}
-	if reInt.Match(incoming) {
-		f.mode = fmInt
-		f.Value, err = strconv.ParseInt(raws, 10, 64)
-		return
+	return Field{}, fmt.Errorf("Cannot convert %T %v to a %v Field", value, value, mode)
+}
+
+var errFormat = fmt.Errorf("Unable to convert to a Field Value")
+
+/*FieldError describes why a JSON value could not be converted into a Field.
+It matches errFormat via errors.Is.*/
+type FieldError struct {
+	Value  string //offending JSON, possibly truncated
+	Reason string
+}
+
+/*Error conforms to the error interface*/
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: %s: %s", errFormat, e.Reason, e.Value)
+}
+
+/*Is allows errors.Is(err, errFormat) to match any FieldError*/
+func (e *FieldError) Is(target error) bool {
+	return target == errFormat
+}
+
+/*fieldError forms a FieldError for incoming*/
+func fieldError(incoming []byte, reason string, args ...interface{}) error {
+	value := string(incoming)
+	if len(value) > 32 {
+		value = value[:32] + "..."
 	}
+	return &FieldError{Value: value, Reason: fmt.Sprintf(reason, args...)}
+}
 
-	if reNumber.Match(incoming) { //floatting point
-		f.mode = fmFloat
-		f.Value, err = strconv.ParseFloat(raws, 64)
-		return
+/*UnmarshalJSON conforms to the json.Unmarshaller interface.  Numbers without a
+fraction or exponent are exact 64 bit integers, all others are 64 bit floats.*/
+func (f *Field) UnmarshalJSON(incoming []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(incoming))
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return fieldError(incoming, "%v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fieldError(incoming, "arrays and objects are not supported")
 	}
 
-	if reString.Match(incoming) {
-		f.mode = fmString
-		f.Value = raws[1 : len(raws)-1]
-		return
+	switch v := tok.(type) {
+	case nil:
+		f.mode, f.Value = ModeNull, nil
+	case bool:
+		f.mode, f.Value = ModeBool, v
+	case string:
+		f.mode, f.Value = ModeString, v
+	case json.Number:
+		if strings.ContainsAny(string(v), ".eE") {
+			val, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				return fieldError(incoming, "number out of range for a 64 bit float")
+			}
+			f.mode, f.Value = ModeFloat, val
+			break
+		}
+		val, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fieldError(incoming, "integer out of range for a 64 bit integer")
+		}
+		f.mode, f.Value = ModeInt, val
+	default:
+		return fieldError(incoming, "unsupported JSON token")
 	}
+	return nil
+}
 
-	return errFormat
+/*MarshalJSON conforms to the json.Marshaller interface.  Floats are always written
+with a fraction or exponent so they decode back into floats.*/
+func (f Field) MarshalJSON() ([]byte, error) {
+	switch f.mode {
+	case ModeNull:
+		return []byte("null"), nil
+	case ModeFloat:
+		var val float64
+		switch v := f.Value.(type) {
+		case float64:
+			val = v
+		case float32:
+			val = float64(v)
+		default:
+			return nil, fmt.Errorf("Float field holds a %T", f.Value)
+		}
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil, fmt.Errorf("Cannot represent %v in JSON", val)
+		}
+		raw := strconv.FormatFloat(val, 'g', -1, 64)
+		if !strings.ContainsAny(raw, ".eE") {
+			raw += ".0"
+		}
+		return []byte(raw), nil
+	case ModeBool, ModeInt, ModeString:
+		return json.Marshal(f.Value)
+	}
+	return nil, errFormat
 }
 
 /*Datam is what all insertable things should map to*/
 type Datam struct {
-	Table Alphabetic           `json:"table"`
-	Data  map[Alphabetic]Field `json:"data"`
+	Table     Alphabetic           `json:"table"`
+	Data      map[Alphabetic]Field `json:"data"`
+	Timestamp *Timestamp           `json:"timestamp,omitempty"` //optional observation time
 }
 
 /*Valid is true if the fields in Datam are valid*/
 func (d Datam) Valid() bool {
-	ok := d.Table.Valid()
-	for label, value := range d.Data {
-		ok = ok && label.Valid() && value.Valid()
+	return d.Validate() == nil
+}
+
+/*ErrInvalid is matched by errors.Is for every ValidationError*/
+var ErrInvalid = fmt.Errorf("Invalid JSON Structure")
+
+/*ValidationProblem is a single reason a Datam is not valid*/
+type ValidationProblem struct {
+	Table  Alphabetic  `json:"table,omitempty"`
+	Field  Alphabetic  `json:"field,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+	Reason string      `json:"reason"`
+}
+
+/*ValidationError lists every problem found with a Datam*/
+type ValidationError struct {
+	Problems []ValidationProblem `json:"problems"`
+}
+
+/*Error conforms to the error interface*/
+func (v *ValidationError) Error() string {
+	msgs := []string{}
+	for _, p := range v.Problems {
+		switch {
+		case p.Field != "":
+			msgs = append(msgs, fmt.Sprintf("field %q: %s", p.Field, p.Reason))
+		default:
+			msgs = append(msgs, fmt.Sprintf("table %q: %s", p.Table, p.Reason))
+		}
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalid, strings.Join(msgs, "; "))
+}
+
+/*Is allows errors.Is(err, ErrInvalid) to match any ValidationError*/
+func (v *ValidationError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+/*Validate returns a *ValidationError listing every bad table name, field name and value
+in the Datam, or nil if it is valid*/
+func (d Datam) Validate() error {
+	verr := &ValidationError{}
+	if !d.Table.Valid() {
+		verr.Problems = append(verr.Problems, ValidationProblem{Table: d.Table, Reason: "table names must be letters, optionally followed by one digit"})
+	}
+	labels := sort.StringSlice{}
+	for label := range d.Data {
+		labels = append(labels, string(label))
 	}
-	return ok
+	labels.Sort()
+	for _, label := range labels {
+		field := d.Data[Alphabetic(label)]
+		if !Alphabetic(label).Valid() {
+			verr.Problems = append(verr.Problems, ValidationProblem{Table: d.Table, Field: Alphabetic(label), Reason: "field names must be letters, optionally followed by one digit"})
+		}
+		if !field.Valid() {
+			verr.Problems = append(verr.Problems, ValidationProblem{Table: d.Table, Field: Alphabetic(label), Value: field.Value, Reason: "value must be null, a bool, number or string"})
+		}
+	}
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+/*DecodeDatam decodes data as a Datam.  Unlike json.Unmarshal, a field whose value cannot
+be converted does not stop decoding: it is left out of the Datam, and reported under its
+name in a *ValidationError along with everything else Validate finds.  Any other error
+means data is not a Datam at all.*/
+func DecodeDatam(data []byte) (Datam, error) {
+	raw := struct {
+		Table     Alphabetic                     `json:"table"`
+		Data      map[Alphabetic]json.RawMessage `json:"data"`
+		Timestamp *Timestamp                     `json:"timestamp,omitempty"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Datam{}, err
+	}
+
+	d, failed := Datam{Table: raw.Table, Timestamp: raw.Timestamp}, []ValidationProblem{}
+	if raw.Data != nil {
+		d.Data = make(map[Alphabetic]Field, len(raw.Data))
+	}
+	for label, value := range raw.Data {
+		field := Field{}
+		if err := field.UnmarshalJSON(value); err != nil {
+			problem := ValidationProblem{Table: d.Table, Field: label, Value: string(value), Reason: err.Error()}
+			if ferr, ok := err.(*FieldError); ok {
+				problem.Value, problem.Reason = ferr.Value, ferr.Reason
+			}
+			failed = append(failed, problem)
+			continue
+		}
+		d.Data[label] = field
+	}
+	if len(failed) == 0 {
+		return d, d.Validate()
+	}
+
+	verr := &ValidationError{Problems: failed}
+	if invalid, ok := d.Validate().(*ValidationError); ok {
+		verr.Problems = append(verr.Problems, invalid.Problems...)
+	}
+	sort.SliceStable(verr.Problems, func(i, j int) bool { return verr.Problems[i].Field < verr.Problems[j].Field })
+	return d, verr
 }
 
 /*Equal returns true if a is the same as d*/
@@ -195,47 +394,96 @@ func (d *Datam) Equal(a *Datam) bool {
 	return same
 }
 
-/*SQLCreate forms a SQL statement to store the datam into somde database. It will
-prepend a primary key 'rowid' key, timestamp as createdat and any additional data.
-Dialect should be one of the following:
- - "sqlite3"
- - "postgres"
-Others have yet to be defined, but should be added to fieldmode.sqltype()
-*/
-func (d *Datam) SqlCreate(dialect string) (r string, err error) {
-	pk, err1 := fmPrimaryKey.sqltype(dialect)
-	date, err2 := fmDateTime.sqltype(dialect)
-	if err1 != nil || err2 != nil || !d.Valid() {
-		return "", fmt.Errorf("Cannot form SqlCreate")
-	}
-
-	//fetch labels and sort them
+/*columns returns the columns needed to store the datam: a primary key 'rowid', timestamp as
+'created', and the fields sorted by name.  Fields without a type (nulls) are skipped.*/
+func (d *Datam) columns() []Column {
+	columns := []Column{{Name: "rowid", Mode: ModePrimaryKey}, {Name: createdColumn, Mode: ModeDateTime}}
 	labels := sort.StringSlice{}
 	for label, val := range d.Data {
-		if txpt, err := val.mode.sqltype(dialect); err == nil {
-			labels = append(labels, fmt.Sprintf("%s %s", label, txpt))
+		if val.mode != ModeNull {
+			labels = append(labels, string(label))
 		}
 	}
 	labels.Sort()
-
-	r = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (rowid %s, created %s, %s);`, d.Table, pk, date, strings.Join(labels, ", "))
-	return r, nil
+	for _, label := range labels {
+		columns = append(columns, Column{Name: label, Mode: d.Data[Alphabetic(label)].mode})
+	}
+	return columns
 }
 
-/*NamedExec returns a SQL statement can be be fed into a sqlx.NamedExec along with a set of matching values,
-and a non-nil error if it cannot form such a statement.*/
-func (d *Datam) NamedExec() (r string, vals map[string]interface{}, err error) {
+/*values returns the sorted column names and matching values to insert.  If the Datam
+carries a Timestamp, it is stored in the 'created' column in place of the database default.*/
+func (d *Datam) values() (labels []string, vals map[string]interface{}, err error) {
 	if !d.Valid() || len(d.Data) == 0 {
-		return "", nil, fmt.Errorf("Cannot insert invalid data")
+		return nil, nil, fmt.Errorf("Cannot insert invalid data")
 	}
 	vals = map[string]interface{}{}
-	//fetch labels and sort them
-	labels := []string{}
 	for label, value := range d.Data {
 		vals[string(label)] = value.Value
 		labels = append(labels, string(label))
 	}
+	if d.Timestamp != nil {
+		if _, ok := vals[createdColumn]; ok {
+			return nil, nil, fmt.Errorf("Cannot supply both a timestamp and a %q field", createdColumn)
+		}
+		vals[createdColumn] = d.Timestamp.UTC()
+		labels = append(labels, createdColumn)
+	}
+	sort.Strings(labels)
+	return labels, vals, nil
+}
 
-	r = fmt.Sprintf(`INSERT INTO %s (%s) VALUES (:%s);`, d.Table, strings.Join(labels, ","), strings.Join(labels, ",:"))
+/*SqlCreate forms a SQL statement to store the datam into somde database. It will
+prepend a primary key 'rowid' key, timestamp as createdat and any additional data.
+Dialect should be one of the following:
+ - "sqlite3"
+ - "postgres"
+ - "mysql"
+or a name passed to RegisterDialect.
+*/
+func (d *Datam) SqlCreate(dialect string) (r string, err error) {
+	sqld, err := LookupDialect(dialect)
+	if err != nil || !d.Valid() {
+		return "", fmt.Errorf("Cannot form SqlCreate")
+	}
+	return sqld.CreateTable(string(d.Table), d.columns())
+}
+
+/*SqlInsert forms a SQL INSERT statement for the datam in the given dialect, along with
+the values matching its placeholders, or a non-nil error if it cannot form such a statement.*/
+func (d *Datam) SqlInsert(dialect string) (r string, args []interface{}, err error) {
+	sqld, err := LookupDialect(dialect)
+	if err != nil {
+		return "", nil, err
+	}
+	labels, vals, err := d.values()
+	if err != nil {
+		return "", nil, err
+	}
+	quoted, holders := make([]string, len(labels)), make([]string, len(labels))
+	for i, label := range labels {
+		quoted[i], holders[i] = sqld.Quote(label), sqld.Placeholder(i+1)
+		args = append(args, vals[label])
+	}
+	r = fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s);`, sqld.Quote(string(d.Table)), strings.Join(quoted, ", "), strings.Join(holders, ", "))
+	return r, args, nil
+}
+
+/*NamedExec returns a SQL statement in the named dialect that can be be fed into a sqlx.NamedExec
+along with a set of matching values, and a non-nil error if it cannot form such a statement.*/
+func (d *Datam) NamedExec(dialect string) (r string, vals map[string]interface{}, err error) {
+	sqld, err := LookupDialect(dialect)
+	if err != nil {
+		return "", nil, err
+	}
+	labels, vals, err := d.values()
+	if err != nil {
+		return "", nil, err
+	}
+	quoted := make([]string, len(labels))
+	for i, label := range labels {
+		quoted[i] = sqld.Quote(label)
+	}
+	r = fmt.Sprintf(`INSERT INTO %s (%s) VALUES (:%s);`, sqld.Quote(string(d.Table)), strings.Join(quoted, ", "), strings.Join(labels, ", :"))
 	return r, vals, nil
 }
@@ -10,8 +10,12 @@ package homehub
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/davecgh/go-spew/spew"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAlphabetic_Valid(t *testing.T) {
@@ -30,23 +34,35 @@ func TestAlphabetic_Valid(t *testing.T) {
 	}
 }
 
-func TestFieldMode_SqlType(t *testing.T) {
-	ok := map[string][]fieldmode{
-		"sqlite3":  []fieldmode{fmBool, fmInt, fmFloat, fmString, fmPrimaryKey, fmDateTime},
-		"postgres": []fieldmode{fmBool, fmInt, fmFloat, fmString, fmPrimaryKey, fmDateTime},
+func TestDialect_ColumnType(t *testing.T) {
+	ok := map[string][]FieldMode{
+		"sqlite3":  []FieldMode{ModeBool, ModeInt, ModeFloat, ModeString, ModePrimaryKey, ModeDateTime},
+		"postgres": []FieldMode{ModeBool, ModeInt, ModeFloat, ModeString, ModePrimaryKey, ModeDateTime},
+		"mysql":    []FieldMode{ModeBool, ModeInt, ModeFloat, ModeString, ModePrimaryKey, ModeDateTime},
 	}
-	errord := map[string][]fieldmode{
-		"sqlite3":  []fieldmode{fmInvalid},
-		"postgres": []fieldmode{fmInvalid},
-		"unknown":  []fieldmode{fmInvalid},
+	errord := map[string][]FieldMode{
+		"sqlite3":  []FieldMode{ModeInvalid},
+		"postgres": []FieldMode{ModeInvalid},
+		"unknown":  []FieldMode{ModeInvalid},
 	}
 
-	run := func(tests map[string][]fieldmode, err error) {
+	run := func(tests map[string][]FieldMode, err error) {
 		for dialect, defined := range tests {
+			sqld, e := LookupDialect(dialect)
+			if e != nil {
+				if err == nil {
+					t.Errorf("Unable to find dialect %q: %v", dialect, e)
+				}
+				continue
+			}
 			for _, fm := range defined {
-				if _, e := fm.sqltype(dialect); e != err {
+				coltype, e := sqld.ColumnType(fm)
+				if e != err {
 					t.Errorf("Faied testing for %q:%v:  Wanted %v, got %v", dialect, fm, err, e)
 				}
+				if e == nil && sqld.ColumnMode(coltype) != fm && fm <= ModeString {
+					t.Errorf("ColumnMode(%q) is not the inverse of ColumnType(%v) for %q", coltype, fm, dialect)
+				}
 			}
 		}
 	}
@@ -63,12 +79,15 @@ func TestField_UnmarshalJSON(t *testing.T) {
 	}
 
 	tests := map[string]x{
-		"fmNull":      x{v: true, e: nil, j: `{"table": "ntable", "data": {"null": null}}`, d: &Datam{Table: "ntable", Data: map[Alphabetic]Field{Alphabetic("null"): Field{Value: nil, mode: fmNull}}}},
-		"fmBool":      x{v: true, e: nil, j: `{"table": "btable", "data": {"bool": false}}`, d: &Datam{Table: "btable", Data: map[Alphabetic]Field{Alphabetic("bool"): Field{Value: false, mode: fmBool}}}},
-		"fmInt":       x{v: true, e: nil, j: `{"table": "itable", "data": {"int": 1}}`, d: &Datam{Table: "itable", Data: map[Alphabetic]Field{Alphabetic("int"): Field{Value: int64(1), mode: fmInt}}}},
-		"fmFloat":     x{v: true, e: nil, j: `{"table": "ftable", "data": {"float": 1.0}}`, d: &Datam{Table: "ftable", Data: map[Alphabetic]Field{Alphabetic("float"): Field{Value: 1.0, mode: fmFloat}}}},
-		"fmString":    x{v: true, e: nil, j: `{"table": "stable", "data": {"string": "str"}}`, d: &Datam{Table: "stable", Data: map[Alphabetic]Field{Alphabetic("string"): Field{Value: "str", mode: fmString}}}},
-		"shortString": x{v: true, e: nil, j: `{"table": "stable", "data": {"string": ""}}`, d: &Datam{Table: "stable", Data: map[Alphabetic]Field{Alphabetic("string"): Field{Value: "", mode: fmString}}}},
+		"fmNull":      x{v: true, e: nil, j: `{"table": "ntable", "data": {"null": null}}`, d: &Datam{Table: "ntable", Data: map[Alphabetic]Field{Alphabetic("null"): Field{Value: nil, mode: ModeNull}}}},
+		"fmBool":      x{v: true, e: nil, j: `{"table": "btable", "data": {"bool": false}}`, d: &Datam{Table: "btable", Data: map[Alphabetic]Field{Alphabetic("bool"): Field{Value: false, mode: ModeBool}}}},
+		"fmInt":       x{v: true, e: nil, j: `{"table": "itable", "data": {"int": 1}}`, d: &Datam{Table: "itable", Data: map[Alphabetic]Field{Alphabetic("int"): Field{Value: int64(1), mode: ModeInt}}}},
+		"fmFloat":     x{v: true, e: nil, j: `{"table": "ftable", "data": {"float": 1.0}}`, d: &Datam{Table: "ftable", Data: map[Alphabetic]Field{Alphabetic("float"): Field{Value: 1.0, mode: ModeFloat}}}},
+		"fmString":    x{v: true, e: nil, j: `{"table": "stable", "data": {"string": "str"}}`, d: &Datam{Table: "stable", Data: map[Alphabetic]Field{Alphabetic("string"): Field{Value: "str", mode: ModeString}}}},
+		"shortString": x{v: true, e: nil, j: `{"table": "stable", "data": {"string": ""}}`, d: &Datam{Table: "stable", Data: map[Alphabetic]Field{Alphabetic("string"): Field{Value: "", mode: ModeString}}}},
+		"boolString":  x{v: true, e: nil, j: `{"table": "stable", "data": {"string": "is false"}}`, d: &Datam{Table: "stable", Data: map[Alphabetic]Field{Alphabetic("string"): Field{Value: "is false", mode: ModeString}}}},
+		"bigInt":      x{v: false, e: errFormat, j: `{"table": "bad", "data": {"int": 9223372036854775808}}`},
+		"bigFloat":    x{v: false, e: errFormat, j: `{"table": "bad", "data": {"float": 1e400}}`},
 		//some error varieties
 		"array": x{v: false, e: errFormat, j: `{"table": "bad", "data": {"array": [1,2,3]}}`},
 		"obj":   x{v: false, e: errFormat, j: `{"table": "bad", "data": {"obj": {}}}`},
@@ -78,11 +97,11 @@ func TestField_UnmarshalJSON(t *testing.T) {
 			d: &Datam{
 				Table: "table",
 				Data: map[Alphabetic]Field{
-					Alphabetic("float"):  Field{Value: 1.0, mode: fmFloat},
-					Alphabetic("string"): Field{Value: "str", mode: fmString},
-					Alphabetic("int"):    Field{Value: 1, mode: fmInt},
-					Alphabetic("bool"):   Field{Value: false, mode: fmBool},
-					Alphabetic("null"):   Field{Value: nil, mode: fmNull},
+					Alphabetic("float"):  Field{Value: 1.0, mode: ModeFloat},
+					Alphabetic("string"): Field{Value: "str", mode: ModeString},
+					Alphabetic("int"):    Field{Value: 1, mode: ModeInt},
+					Alphabetic("bool"):   Field{Value: false, mode: ModeBool},
+					Alphabetic("null"):   Field{Value: nil, mode: ModeNull},
 				},
 			},
 		},
@@ -91,7 +110,7 @@ func TestField_UnmarshalJSON(t *testing.T) {
 	for name, x := range tests {
 		t.Logf("Running checks on %q", name)
 		datam := &Datam{}
-		if e := json.Unmarshal([]byte(x.j), datam); e != x.e {
+		if e := json.Unmarshal([]byte(x.j), datam); (e == nil) != (x.e == nil) || (e != nil && !errors.Is(e, x.e)) {
 			t.Errorf("Returned error does not match expected.  Got %v want %v", e, x.e)
 		}
 		if x.e != nil { //invalid JSON should return an error - no need to check the values
@@ -122,14 +141,14 @@ func TestDatam_SqlCreate(t *testing.T) {
 		x{d: Datam{
 			Table: "test",
 			Data: map[Alphabetic]Field{
-				Alphabetic("float"):  Field{Value: 1.0, mode: fmFloat},
-				Alphabetic("string"): Field{Value: "str", mode: fmString},
-				Alphabetic("int"):    Field{Value: 1, mode: fmInt},
-				Alphabetic("bool"):   Field{Value: false, mode: fmBool},
+				Alphabetic("float"):  Field{Value: 1.0, mode: ModeFloat},
+				Alphabetic("string"): Field{Value: "str", mode: ModeString},
+				Alphabetic("int"):    Field{Value: 1, mode: ModeInt},
+				Alphabetic("bool"):   Field{Value: false, mode: ModeBool},
 			},
 		},
 			dialect: "sqlite3", inerror: false,
-			expect: `CREATE TABLE IF NOT EXISTS "test" (rowid INTEGER PRIMARY KEY ASC ON CONFLICT REPLACE AUTOINCREMENT, created DATETIME DEFAULT CURRENT_TIMESTAMP, bool BOOL, float FLOAT, int INT, string TEXT);`,
+			expect: `CREATE TABLE IF NOT EXISTS "test" ("rowid" INTEGER PRIMARY KEY ASC ON CONFLICT REPLACE AUTOINCREMENT, "created" DATETIME DEFAULT CURRENT_TIMESTAMP, "bool" BOOL, "float" FLOAT, "int" INT, "string" TEXT);`,
 		},
 	}
 
@@ -161,16 +180,25 @@ func TestDatam_NamedExec(t *testing.T) {
 		x{d: Datam{
 			Table: "test",
 			Data: map[Alphabetic]Field{
-				Alphabetic("float"): Field{Value: 1.0, mode: fmFloat},
+				Alphabetic("float"): Field{Value: 1.0, mode: ModeFloat},
 			},
 		},
 			dialect: "sqlite3", inerror: false,
-			expect: `INSERT INTO "test" (float) VALUES (:float);`,
+			expect: `INSERT INTO "test" ("float") VALUES (:float);`,
+		},
+		x{d: Datam{
+			Table: "test",
+			Data: map[Alphabetic]Field{
+				Alphabetic("float"): Field{Value: 1.0, mode: ModeFloat},
+			},
+		},
+			dialect: "mysql", inerror: false,
+			expect: "INSERT INTO `test` (`float`) VALUES (:float);",
 		},
 	}
 
 	for i, x := range tests {
-		r, vals, e := x.d.NamedExec()
+		r, vals, e := x.d.NamedExec(x.dialect)
 		t.Logf("Running test #%d: %v", i, vals)
 		if (x.inerror && e == nil) || (!x.inerror && e != nil) {
 			t.Logf("Want an error: %v Got Error: %v", x.inerror, e)
@@ -184,6 +212,304 @@ func TestDatam_NamedExec(t *testing.T) {
 	}
 }
 
+func TestTimestamp_UnmarshalJSON(t *testing.T) {
+	want := time.Date(2016, 10, 13, 19, 14, 56, 0, time.UTC)
+	tests := map[string]time.Time{
+		`"2016-10-13T19:14:56Z"`:      want,
+		`"2016-10-13T13:14:56-06:00"`: want,
+		`1476386096`:                  want,
+		`1476386096000`:               want,
+		`1476386096123`:               want.Add(123 * time.Millisecond),
+		`1476386096.5`:                want.Add(500 * time.Millisecond),
+	}
+	for j, expect := range tests {
+		ts := Timestamp{}
+		if e := json.Unmarshal([]byte(j), &ts); e != nil {
+			t.Errorf("Unable to parse %s: %v", j, e)
+			continue
+		}
+		if !ts.Equal(expect) {
+			t.Errorf("With %s, expected %v, got %v", j, expect, ts.Time)
+		}
+	}
+
+	for _, j := range []string{`"yesterday"`, `true`, `{}`, `"1476386096"`, `9223372036854775807`, `-9223372036854775`, `1e300`} {
+		ts := Timestamp{}
+		if e := json.Unmarshal([]byte(j), &ts); e == nil {
+			t.Errorf("Should not be able to parse %s", j)
+		}
+	}
+
+	datam := Datam{}
+	if e := json.Unmarshal([]byte(`{"table": "t", "timestamp": 1476386096, "data": {"int": 1}}`), &datam); e != nil || datam.Timestamp == nil {
+		t.Fatalf("Timestamp not carried into Datam: %v", e)
+	}
+	_, vals, e := datam.NamedExec("sqlite3")
+	if e != nil || vals["created"] != want {
+		t.Errorf("Timestamp not passed to NamedExec: %v %v", vals, e)
+	}
+	datam.Data["created"] = Field{Value: 1, mode: ModeInt}
+	if _, _, e := datam.NamedExec("sqlite3"); e == nil {
+		t.Errorf("Should not allow both a timestamp and a created field")
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	array := `[{"table": "a", "data": {"int": 1}}, {"table": "bad table", "data": {"int": 1}}, {"table": "b", "data": {"int": [1]}}]`
+	ndjson := "{\"table\": \"a\", \"data\": {\"int\": 1}}\n\n{\"table\": \"b\", \"data\": {\"float\": 1.0}}\n"
+
+	if !IsBatch([]byte(array)) || !IsBatch([]byte(ndjson)) {
+		t.Errorf("Should recognize arrays and newline delimited JSON as batches")
+	}
+	for _, single := range []string{`{"table": "a", "data": {"int": 1}}`, "{\n\"table\": \"a\",\n\"data\": {\"int\": 1}\n}\n", ""} {
+		if IsBatch([]byte(single)) {
+			t.Errorf("Should not treat %q as a batch", single)
+		}
+	}
+
+	batch, errs, e := DecodeBatch([]byte(array))
+	if e != nil || len(batch) != 3 || len(errs) != 3 {
+		t.Fatalf("Unable to decode array: %v", e)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] == nil || batch[0].Table != "a" {
+		t.Errorf("Per entry errors do not match: %v", errs)
+	}
+
+	batch, errs, e = DecodeBatch([]byte(ndjson))
+	if e != nil || len(batch) != 2 || errs[0] != nil || errs[1] != nil || batch[1].Table != "b" {
+		t.Errorf("Unable to decode newline delimited JSON: %v %v", e, errs)
+	}
+
+	for _, bad := range []string{``, `[not json]`, "\n\n"} {
+		if _, _, e := DecodeBatch([]byte(bad)); e == nil {
+			t.Errorf("Should not decode %q", bad)
+		}
+	}
+}
+
+func TestDatam_SqlAlter(t *testing.T) {
+	d := Datam{
+		Table: "test",
+		Data: map[Alphabetic]Field{
+			Alphabetic("float"):  Field{Value: 1.0, mode: ModeFloat},
+			Alphabetic("int"):    Field{Value: 1, mode: ModeInt},
+			Alphabetic("newer"):  Field{Value: "str", mode: ModeString},
+			Alphabetic("null"):   Field{Value: nil, mode: ModeNull},
+			Alphabetic("widens"): Field{Value: 1, mode: ModeInt},
+		},
+	}
+	existing := map[string]string{"rowid": "INTEGER", "created": "DATETIME", "FLOAT": "FLOAT", "int": "INT", "widens": "FLOAT"}
+	alters, e := d.SqlAlter("sqlite3", existing)
+	if e != nil || len(alters) != 1 || alters[0] != `ALTER TABLE "test" ADD COLUMN "newer" TEXT;` {
+		t.Errorf("Did not get the ALTER I expected: %v %v", alters, e)
+	}
+
+	existing = map[string]string{"float": "double precision", "int": "boolean", "newer": "text", "widens": "bigint"}
+	_, e = d.SqlAlter("postgres", existing)
+	conflict, ok := e.(*SchemaConflictError)
+	if !ok || len(conflict.Conflicts) != 1 || conflict.Conflicts[0].Field != "int" {
+		t.Errorf("Expected a conflict on int: %v", e)
+	}
+
+	existing = map[string]string{"float": "double", "int": "bigint", "newer": "varchar", "widens": "tinyint"}
+	if _, e = d.SqlAlter("mysql", existing); e == nil {
+		t.Errorf("Storing an int in a mysql BOOLEAN should conflict")
+	}
+
+	if _, e := (&Datam{}).SqlAlter("sqlite3", nil); e == nil {
+		t.Errorf("Should not alter with an invalid datam")
+	}
+}
+
+func TestDatam_SqlInsert(t *testing.T) {
+	d := Datam{
+		Table: "test",
+		Data: map[Alphabetic]Field{
+			Alphabetic("int"):   Field{Value: 1, mode: ModeInt},
+			Alphabetic("float"): Field{Value: 1.0, mode: ModeFloat},
+		},
+	}
+	tests := map[string]string{
+		"sqlite3":  `INSERT INTO "test" ("float", "int") VALUES (?, ?);`,
+		"postgres": `INSERT INTO "test" ("float", "int") VALUES ($1, $2);`,
+		"mysql":    "INSERT INTO `test` (`float`, `int`) VALUES (?, ?);",
+	}
+	for dialect, expect := range tests {
+		r, args, e := d.SqlInsert(dialect)
+		if e != nil || r != expect || len(args) != 2 || args[0] != 1.0 || args[1] != 1 {
+			t.Errorf("%s: got %v %v %v", dialect, r, args, e)
+		}
+	}
+	if _, _, e := d.SqlInsert("no idea"); e == nil {
+		t.Errorf("Should not insert with an unknown dialect")
+	}
+}
+
+type upperDialect struct {
+	Dialect
+}
+
+func (upperDialect) Quote(identifier string) string {
+	return "[" + identifier + "]"
+}
+
+func TestRegisterDialect(t *testing.T) {
+	if _, e := LookupDialect("upper"); e == nil {
+		t.Fatalf("Should not find an unregistered dialect")
+	}
+	RegisterDialect("upper", upperDialect{SQLite3})
+	sqld, e := LookupDialect("upper")
+	if e != nil || sqld.Quote("a") != "[a]" || sqld.Placeholder(2) != "?" {
+		t.Errorf("Did not get the registered dialect: %v", e)
+	}
+	if r, _, e := GoodSample.SqlInsert("upper"); e != nil || r != `INSERT INTO [test] ([bool], [float], [int], [string]) VALUES (?, ?, ?, ?);` {
+		t.Errorf("Registered dialect not used: %v %v", r, e)
+	}
+
+	columns := []Column{{Name: "k", Mode: ModeString}, {Name: "v", Mode: ModeFloat}}
+	upserts := map[Dialect]string{
+		SQLite3:  `INSERT INTO "t" ("k", "v") VALUES (?, ?) ON CONFLICT ("k") DO UPDATE SET "v" = EXCLUDED."v";`,
+		Postgres: `INSERT INTO "t" ("k", "v") VALUES ($1, $2) ON CONFLICT ("k") DO UPDATE SET "v" = EXCLUDED."v";`,
+		MySQL:    "INSERT INTO `t` (`k`, `v`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `v` = VALUES(`v`);",
+	}
+	for sqld, expect := range upserts {
+		if r, e := sqld.Upsert("t", columns, []string{"k"}); e != nil || r != expect {
+			t.Errorf("Got upsert %s %v", r, e)
+		}
+	}
+	if r, e := Postgres.Upsert("t", columns[:1], []string{"k"}); e != nil || r != `INSERT INTO "t" ("k") VALUES ($1) ON CONFLICT ("k") DO NOTHING;` {
+		t.Errorf("Got upsert %s %v", r, e)
+	}
+	if r, e := MySQL.Upsert("t", columns[:1], []string{"k"}); e != nil || r != "INSERT IGNORE INTO `t` (`k`) VALUES (?);" {
+		t.Errorf("Got upsert %s %v", r, e)
+	}
+	for _, conflict := range [][]string{nil, {"nope"}} {
+		if _, e := SQLite3.Upsert("t", columns, conflict); e == nil {
+			t.Errorf("Should not upsert conflicting on %v", conflict)
+		}
+	}
+	if _, e := SQLite3.Upsert("t", []Column{{Name: "k", Mode: ModeInvalid}}, []string{"k"}); e == nil {
+		t.Errorf("Should not upsert a column without a type")
+	}
+
+	//postgres folds names, so tables made before names were quoted are still found
+	if r := Postgres.Quote("garageTemp"); r != `"garagetemp"` {
+		t.Errorf("Postgres should fold names to lower case: %s", r)
+	}
+	if _, args := Postgres.ColumnsQuery("garageTemp"); args[0] != "garagetemp" {
+		t.Errorf("Postgres should look up folded table names: %v", args)
+	}
+	if Postgres.Fold("garageTemp") != "garagetemp" || SQLite3.Fold("garageTemp") != "garageTemp" {
+		t.Errorf("Only postgres should fold names")
+	}
+	if r := SQLite3.Quote("garageTemp"); r != `"garageTemp"` {
+		t.Errorf("Only postgres should fold names: %s", r)
+	}
+	if r := MySQL.Quote("a`b"); r != "`a``b`" {
+		t.Errorf("Embedded quotes should be doubled: %s", r)
+	}
+}
+
+func TestField_JSON(t *testing.T) {
+	values := map[string]interface{}{
+		`"a \"quoted\" caf\u00e9"`: "a \"quoted\" café",
+		`"tab\tnewline\n"`:         "tab\tnewline\n",
+		`9223372036854775807`:       int64(9223372036854775807),
+		`-9223372036854775808`:      int64(-9223372036854775808),
+		`1e3`:                       1000.0,
+		`-0.5`:                      -0.5,
+		`true`:                      true,
+		`false`:                     false,
+	}
+	for j, expect := range values {
+		f := Field{}
+		if e := json.Unmarshal([]byte(j), &f); e != nil || f.Value != expect {
+			t.Errorf("With %s, expected %v, got %v (%v)", j, expect, f.Value, e)
+		}
+	}
+
+	f := Field{}
+	e := json.Unmarshal([]byte(`18446744073709551616`), &f)
+	if fe, ok := e.(*FieldError); !ok || fe.Reason == "" || !errors.Is(e, errFormat) {
+		t.Errorf("Expected a descriptive FieldError, got %v", e)
+	}
+
+	in := `{"table": "round", "data": {"float": 1.0, "big": 1e300, "string": "caf\u00e9 \"x\"", "int": 9007199254740993, "bool": true, "null": null}, "timestamp": "2016-10-13T19:14:56.5Z"}`
+	first, second := Datam{}, Datam{}
+	if e := json.Unmarshal([]byte(in), &first); e != nil {
+		t.Fatalf("Unable to decode: %v", e)
+	}
+	out, e := json.Marshal(first)
+	if e != nil {
+		t.Fatalf("Unable to encode: %v", e)
+	}
+	if e := json.Unmarshal(out, &second); e != nil {
+		t.Fatalf("Unable to decode %s: %v", out, e)
+	}
+	if !reflect.DeepEqual(first, second) {
+		spew.Dump(first, second)
+		t.Errorf("Datam did not survive a round trip: %s", out)
+	}
+
+	if _, e := json.Marshal(Field{}); e == nil {
+		t.Errorf("Should not marshal an invalid field")
+	}
+}
+
+func TestDatam_Validate(t *testing.T) {
+	if e := GoodSample.Validate(); e != nil {
+		t.Errorf("GoodSample should be valid: %v", e)
+	}
+
+	bad := Datam{
+		Table: "bad table",
+		Data: map[Alphabetic]Field{
+			Alphabetic("ok"):      Field{Value: 1, mode: ModeInt},
+			Alphabetic("bad key"): Field{Value: 1, mode: ModeInt},
+			Alphabetic("value"):   Field{Value: []int{1}, mode: ModeInvalid},
+		},
+	}
+	e := bad.Validate()
+	verr, ok := e.(*ValidationError)
+	if !ok || !errors.Is(e, ErrInvalid) || bad.Valid() {
+		t.Fatalf("Expected a ValidationError, got %v", e)
+	}
+	if len(verr.Problems) != 3 {
+		t.Fatalf("Expected 3 problems, got %+v", verr.Problems)
+	}
+	if verr.Problems[0].Table != "bad table" || verr.Problems[1].Field != "bad key" || verr.Problems[2].Field != "value" || verr.Problems[2].Value == nil {
+		t.Errorf("Problems do not name the table, fields and values: %+v", verr.Problems)
+	}
+	if msg := e.Error(); !strings.Contains(msg, `"bad table"`) || !strings.Contains(msg, `"bad key"`) {
+		t.Errorf("Error message is not descriptive: %s", msg)
+	}
+}
+
+func TestDecodeDatam(t *testing.T) {
+	d, e := DecodeDatam([]byte(`{"table": "t", "data": {"ok": 1, "big": 9223372036854775808, "bad key": 2, "x": [1]}}`))
+	verr, ok := e.(*ValidationError)
+	if !ok || !errors.Is(e, ErrInvalid) {
+		t.Fatalf("Expected a ValidationError, got %v", e)
+	}
+	fields := []Alphabetic{}
+	for _, p := range verr.Problems {
+		fields = append(fields, p.Field)
+	}
+	if !reflect.DeepEqual(fields, []Alphabetic{"bad key", "big", "x"}) || verr.Problems[2].Reason == "" {
+		t.Errorf("Problems do not name each field: %+v", verr.Problems)
+	}
+	if d.Table != "t" || len(d.Data) != 2 {
+		t.Errorf("Should keep what could be decoded: %+v", d)
+	}
+
+	if d, e = DecodeDatam([]byte(`{"table": "t", "data": {"ok": 1}}`)); e != nil || !d.Equal(&Datam{Table: "t", Data: map[Alphabetic]Field{"ok": {Value: 1, mode: ModeInt}}}) {
+		t.Errorf("Unable to decode: %+v %v", d, e)
+	}
+	if _, e = DecodeDatam([]byte(`{"table": [1]}`)); e == nil || errors.Is(e, ErrInvalid) {
+		t.Errorf("Should fail on what is not a Datam: %v", e)
+	}
+}
+
 /*
 
 
@@ -195,3 +521,406 @@ func TestDatam_NamedExec(t *testing.T) {
 
 
  */
+
+func TestAPIKey_Allows(t *testing.T) {
+	key := APIKey{Device: "garage", Tables: []string{"garage*", "door"}, Perms: PermStore}
+	checks := map[Alphabetic]map[Permission]bool{
+		"garageA": {PermStore: true, PermRegister: false, PermBoth: false},
+		"door":    {PermStore: true, PermRegister: false},
+		"attic":   {PermStore: false},
+	}
+	for table, perms := range checks {
+		for perm, ok := range perms {
+			if key.Allows(table, perm) != ok {
+				t.Errorf("%s on %s: expected %v", perm, table, ok)
+			}
+		}
+	}
+	for _, s := range []string{"register", "store", "both"} {
+		if p, e := ParsePermission(s); e != nil || p.String() != s {
+			t.Errorf("Unable to parse %q: %v %v", s, p, e)
+		}
+	}
+	if _, e := ParsePermission("all"); e == nil {
+		t.Errorf("Should not parse an unknown permission")
+	}
+}
+
+func TestQuery_SqlSelect(t *testing.T) {
+	from, to := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC), time.Date(2016, 2, 2, 3, 4, 5, 0, time.UTC)
+	q := Query{Table: "test", From: from, To: to, Fields: []Alphabetic{"temp", "label"}, Limit: 10}
+	tests := map[string]string{
+		"sqlite3":  `SELECT "created", "temp", "label" FROM "test" WHERE "created" >= ? AND "created" < ? ORDER BY "created", "rowid" LIMIT 10;`,
+		"postgres": `SELECT "created", "temp", "label" FROM "test" WHERE "created" >= $1 AND "created" < $2 ORDER BY "created", "rowid" LIMIT 10;`,
+		"mysql":    "SELECT `created`, `temp`, `label` FROM `test` WHERE `created` >= ? AND `created` < ? ORDER BY `created`, `rowid` LIMIT 10;",
+	}
+	for dialect, expect := range tests {
+		r, args, e := q.SqlSelect(dialect)
+		if e != nil || r != expect || len(args) != 2 {
+			t.Errorf("%s: got %v %v %v", dialect, r, args, e)
+		}
+	}
+	if _, args, _ := q.SqlSelect("sqlite3"); args[0] != "2016-01-02 03:04:05" {
+		t.Errorf("sqlite3 should bind times as text: %v", args)
+	}
+	if _, args, _ := q.SqlSelect("postgres"); args[1] != to {
+		t.Errorf("postgres should bind times as time.Time: %v", args)
+	}
+
+	if r, args, e := (Query{Table: "test", Fields: []Alphabetic{"temp"}}).SqlSelect("sqlite3"); e != nil || len(args) != 0 || r != `SELECT "created", "temp" FROM "test" ORDER BY "created", "rowid";` {
+		t.Errorf("Unbounded query: %v %v %v", r, args, e)
+	}
+	bad := []Query{{Table: "test"}, {Table: "bad table", Fields: []Alphabetic{"a"}}, {Table: "test", Fields: []Alphabetic{"a b"}}}
+	for _, q := range bad {
+		if _, _, e := q.SqlSelect("sqlite3"); e == nil {
+			t.Errorf("Should not form a select for %+v", q)
+		}
+	}
+}
+
+func TestNewField(t *testing.T) {
+	tests := []struct {
+		mode  FieldMode
+		value interface{}
+		want  interface{}
+	}{
+		{ModeBool, true, true},
+		{ModeBool, int64(1), true},
+		{ModeBool, []byte("0"), false},
+		{ModeInt, int64(7), int64(7)},
+		{ModeInt, []byte("-7"), int64(-7)},
+		{ModeFloat, 1.5, 1.5},
+		{ModeFloat, int64(2), 2.0},
+		{ModeFloat, []byte("2.5"), 2.5},
+		{ModeString, "str", "str"},
+		{ModeString, []byte("str"), "str"},
+		{ModeInt, nil, nil},
+	}
+	for _, test := range tests {
+		f, e := NewField(test.mode, test.value)
+		if e != nil || f.Value != test.want {
+			t.Errorf("%v from %T %v: got %v %v", test.mode, test.value, test.value, f.Value, e)
+		}
+	}
+	if f, _ := NewField(ModeInt, nil); f.Mode() != ModeNull {
+		t.Errorf("nil should be a null field")
+	}
+	for _, value := range []interface{}{"seven", 1.5, []byte("maybe")} {
+		if _, e := NewField(ModeInt, value); e == nil {
+			t.Errorf("Should not convert %v to an int", value)
+		}
+	}
+
+	if raw, _ := json.Marshal(Column{Name: "a", Mode: ModeFloat}); string(raw) != `{"name":"a","mode":"float"}` {
+		t.Errorf("Modes should marshal by name: %s", raw)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, s := range []string{"2016-01-02T03:04:05Z", "1451703845", "1451703845000"} {
+		if ts, e := ParseTimestamp(s); e != nil || !ts.Equal(want) {
+			t.Errorf("%s: got %v %v", s, ts, e)
+		}
+	}
+	if _, e := ParseTimestamp("yesterday"); e == nil {
+		t.Errorf("Should not parse yesterday")
+	}
+}
+
+func TestAggregateQuery_SqlAggregate(t *testing.T) {
+	from := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	q := AggregateQuery{
+		Query:     Query{Table: "test", From: from, Fields: []Alphabetic{"temp"}, Limit: 24},
+		Bucket:    time.Hour,
+		Functions: []Aggregate{AggMean, AggLast},
+	}
+	expect := `SELECT b.bucket, AVG(b."temp"), (SELECT l."temp" FROM (SELECT (CAST(strftime('%s', "created") AS INTEGER) / 3600 * 3600) AS bucket, "created", "rowid", "temp" FROM "test" WHERE "created" >= ?) l WHERE l.bucket = b.bucket AND l."temp" IS NOT NULL ORDER BY l."created" DESC, l."rowid" DESC LIMIT 1) ` +
+		`FROM (SELECT (CAST(strftime('%s', "created") AS INTEGER) / 3600 * 3600) AS bucket, "created", "rowid", "temp" FROM "test" WHERE "created" >= ?) b GROUP BY b.bucket ORDER BY b.bucket LIMIT 24;`
+	if r, args, e := q.SqlAggregate("sqlite3"); e != nil || r != expect || len(args) != 2 {
+		t.Errorf("Got %v %v %v", r, args, e)
+	}
+
+	r, args, e := q.SqlAggregate("postgres")
+	if e != nil || len(args) != 2 || !strings.Contains(r, `WHERE "created" >= $1) l`) || !strings.Contains(r, `WHERE "created" >= $2) b`) ||
+		!strings.Contains(r, `CAST(FLOOR(EXTRACT(EPOCH FROM "created") / 3600) * 3600 AS BIGINT)`) {
+		t.Errorf("Placeholders should number on through the subqueries: %v %v %v", r, args, e)
+	}
+	if r, _, e := q.SqlAggregate("mysql"); e != nil || !strings.Contains(r, "(TIMESTAMPDIFF(SECOND, '1970-01-01 00:00:00', `created`) DIV 3600 * 3600)") {
+		t.Errorf("Got %v %v", r, e)
+	}
+
+	bad := []AggregateQuery{
+		{Query: Query{Table: "test", Fields: []Alphabetic{"temp"}}, Bucket: time.Hour},
+		{Query: Query{Table: "test", Fields: []Alphabetic{"temp"}}, Bucket: time.Millisecond, Functions: []Aggregate{AggMin}},
+		{Query: Query{Table: "test", Fields: []Alphabetic{"a b"}}, Bucket: time.Hour, Functions: []Aggregate{AggMin}},
+	}
+	for _, q := range bad {
+		if _, _, e := q.SqlAggregate("sqlite3"); e == nil {
+			t.Errorf("Should not form an aggregate for %+v", q)
+		}
+	}
+
+	if _, e := ParseAggregate("median"); !errors.Is(e, ErrInvalidQuery) {
+		t.Errorf("Should not parse median: %v", e)
+	}
+	if AggMean.Accepts(ModeString) || AggMax.Accepts(ModeBool) || !AggLast.Accepts(ModeBool) || AggCount.Mode(ModeString) != ModeInt {
+		t.Errorf("Unexpected aggregate modes")
+	}
+}
+
+type memory struct {
+	registered int
+	stored     DatamBatch
+	fail       bool
+}
+
+func (m *memory) Register(datam Datam) error { m.registered++; return nil }
+func (m *memory) Store(datam Datam) error {
+	if m.fail {
+		return errors.New("failed")
+	}
+	m.stored = append(m.stored, datam)
+	return nil
+}
+func (m *memory) Stop() {}
+
+type batchMemory struct {
+	memory
+}
+
+func (m *batchMemory) StoreBatch(batch DatamBatch) error {
+	if m.fail {
+		return errors.New("failed")
+	}
+	m.stored = append(m.stored, batch...)
+	return nil
+}
+
+func (m *batchMemory) Tables() ([]Alphabetic, error)             { return nil, nil }
+func (m *batchMemory) Schema(table Alphabetic) ([]Column, error) { return nil, nil }
+func (m *batchMemory) Rows(Query) ([]Datam, error)               { return nil, nil }
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	all, attic := hub.Subscribe(2), hub.Subscribe(10, "attic")
+	for _, table := range []Alphabetic{"attic", "garage", "attic"} {
+		hub.Publish(Datam{Table: table})
+	}
+	if len(attic.C) != 2 || (<-attic.C).Table != "attic" {
+		t.Errorf("Subscription to attic should only see attic")
+	}
+	if all.Dropped() != 1 || (<-all.C).Table != "garage" || (<-all.C).Table != "attic" {
+		t.Errorf("Full subscription should drop the oldest: dropped %d", all.Dropped())
+	}
+
+	all.Close()
+	all.Close()
+	if _, ok := <-all.C; ok {
+		t.Errorf("Closed subscription should close C")
+	}
+	hub.Publish(Datam{Table: "attic"})
+	hub.Close()
+	queued := 0
+	for range attic.C {
+		queued++
+	}
+	if queued != 2 {
+		t.Errorf("Queued datam should survive the hub closing: %d", queued)
+	}
+	if _, ok := <-hub.Subscribe(1).C; ok {
+		t.Errorf("Subscribing to a closed hub should be closed")
+	}
+}
+
+func TestPublishing(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe(10)
+	mem := &memory{}
+	be := Publishing(mem, hub)
+	if _, ok := be.(BatchBackend); ok {
+		t.Errorf("Should not become a BatchBackend")
+	}
+	be.Store(GoodSample)
+	mem.fail = true
+	be.Store(GoodSample)
+	if len(sub.C) != 1 {
+		t.Errorf("Only successful stores should be published: %d", len(sub.C))
+	}
+	<-sub.C
+
+	bmem := &batchMemory{}
+	be = Publishing(bmem, hub)
+	if errs := StoreBatch(be, DatamBatch{GoodSample, GoodSample}); errs[0] != nil || len(sub.C) != 2 || len(bmem.stored) != 2 {
+		t.Errorf("Batches should be stored as one and published: %v", errs)
+	}
+
+	var rd Reader
+	if !As(be, &rd) || rd != Reader(bmem) {
+		t.Errorf("Should find the Reader beneath the wrapper")
+	}
+	var ag Aggregator
+	if As(be, &ag) {
+		t.Errorf("Should not find an Aggregator")
+	}
+}
+
+func TestRegistrar(t *testing.T) {
+	r := &Registrar{}
+	if e := r.Store(GoodSample); e != ErrNoBackend {
+		t.Errorf("Should need a backend: %v", e)
+	}
+
+	mem := &memory{}
+	r.Use(mem)
+	wider := Datam{Table: GoodSample.Table, Data: map[Alphabetic]Field{"added": {Value: 1, mode: ModeInt}}}
+	for _, datam := range []Datam{GoodSample, GoodSample, wider, GoodSample} {
+		if e := r.Store(datam); e != nil {
+			t.Fatalf("Unable to store: %v", e)
+		}
+	}
+	if mem.registered != 2 || len(mem.stored) != 4 {
+		t.Errorf("Should register each set of fields once: %d registered, %d stored", mem.registered, len(mem.stored))
+	}
+
+	//a new backend has seen nothing yet
+	mem = &memory{}
+	r.Use(mem)
+	r.Store(GoodSample)
+	if mem.registered != 1 {
+		t.Errorf("Should register again with a new backend: %d", mem.registered)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := NewStats()
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				s.Record("http", "attic", StatAccepted, 10)
+				s.Record("udp", "attic", StatRejected, 1)
+				s.Record("udp", "garage", StatFailed, 2)
+				s.Record("udp", "", StatRejected, 3)
+				s.Snapshot()
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	snap := s.Snapshot()
+	want := Counts{Accepted: 1000, Rejected: 2000, Failed: 1000, Bytes: 16000}
+	if got := snap.Total; got.Accepted != want.Accepted || got.Rejected != want.Rejected || got.Failed != want.Failed || got.Bytes != want.Bytes {
+		t.Errorf("Totals are wrong: %+v", got)
+	}
+	if got := snap.Tables["attic"]; got.Accepted != 1000 || got.Rejected != 1000 || got.Bytes != 11000 {
+		t.Errorf("attic is wrong: %+v", got)
+	}
+	if _, ok := snap.Tables[""]; ok || len(snap.Tables) != 2 {
+		t.Errorf("Should only have attic and garage: %v", snap.Tables)
+	}
+	udp := snap.Attendants["udp"]
+	if udp.Rejected != 2000 || udp.Failed != 1000 || udp.Tables["garage"].Failed != 1000 || len(udp.Tables) != 2 {
+		t.Errorf("udp is wrong: %+v", udp)
+	}
+	if snap.Attendants["http"].LastSeen.Before(snap.Since) || snap.Total.LastSeen.IsZero() {
+		t.Errorf("Last seen not set: %+v", snap)
+	}
+
+	//snapshots are copies
+	snap.Tables["attic"] = Counts{}
+	if s.Snapshot().Tables["attic"].Accepted != 1000 {
+		t.Errorf("Snapshot shares state with Stats")
+	}
+
+	raw, err := json.Marshal(snap.Attendants["http"])
+	if err != nil || !strings.Contains(string(raw), `"accepted":1000`) || !strings.Contains(string(raw), `"tables":{"attic"`) {
+		t.Errorf("Bad JSON: %s %v", raw, err)
+	}
+
+	if Share(10, 3, 0) != 3 || Share(10, 3, 1) != 3 || Share(10, 3, 2) != 4 || Share(7, 1, 0) != 7 {
+		t.Errorf("Bytes not shared evenly with the remainder last")
+	}
+}
+
+func TestMakeAlphabetic(t *testing.T) {
+	tests := map[string]Alphabetic{
+		"temp":         "temp",
+		"usage_idle":   "usageIdle",
+		"cpu1":         "cpu1",
+		"cpu10":        "cpuOneZero",
+		"temp_2":       "temp2",
+		"ds18b20.temp": "dsOneEightBTwoZeroTemp",
+		"1wire":        "OneWire",
+		"Living Room":  "LivingRoom",
+		"__":           "",
+		"héllo":        "hLlo",
+	}
+	for name, want := range tests {
+		got := MakeAlphabetic(name)
+		if got != want || got.Valid() != (want != "") {
+			t.Errorf("%q: got %q, wanted %q", name, got, want)
+		}
+	}
+}
+
+func TestDecodeLineProtocol(t *testing.T) {
+	data := []byte(`# a comment
+weather,location=us-midwest,sensor\ id=a\,b temperature=82,humidity=71i,ok=t 1465839830100400200
+
+cpu_load,host=server01 value=0.64,state="said \"hi\", then left" 1465839830
+mem free=12u
+bad
+weather temperature=high
+weather,location=here temperature=1 yesterday
+weather location=1,location=2
+weather temp=1,temp_=2
+`)
+	batch, errs, err := DecodeLineProtocol(data, "")
+	if err != nil || len(batch) != 8 || len(errs) != 8 {
+		t.Fatalf("Unable to decode: %v %d %v", err, len(batch), errs)
+	}
+	for i, ok := range []bool{true, true, true, false, false, false, false, false} {
+		if (errs[i] == nil) != ok {
+			t.Errorf("Line %d: unexpected %v", i, errs[i])
+		}
+		if errs[i] != nil && !errors.Is(errs[i], ErrInvalid) {
+			t.Errorf("Line %d: should be ErrInvalid: %v", i, errs[i])
+		}
+	}
+	weather := batch[0]
+	if weather.Table != "weather" || weather.Data["sensorId"].Value != "a,b" || weather.Data["location"].Value != "us-midwest" {
+		t.Errorf("Tags not decoded: %v", spew.Sdump(weather))
+	}
+	if weather.Data["temperature"].Value != 82.0 || weather.Data["humidity"].Value != int64(71) || weather.Data["ok"].Value != true {
+		t.Errorf("Fields not decoded: %v", spew.Sdump(weather))
+	}
+	if weather.Timestamp == nil || !weather.Timestamp.Equal(time.Unix(0, 1465839830100400200)) {
+		t.Errorf("Bad timestamp: %v", weather.Timestamp)
+	}
+	cpu := batch[1]
+	if cpu.Table != "cpuLoad" || cpu.Data["state"].Value != `said "hi", then left` || cpu.Data["host"].Value != "server01" {
+		t.Errorf("Bad cpu: %v", spew.Sdump(cpu))
+	}
+	if batch[2].Data["free"].Value != int64(12) || batch[2].Timestamp != nil {
+		t.Errorf("Bad mem: %v", spew.Sdump(batch[2]))
+	}
+	if le, ok := errs[3].(*LineError); !ok || le.Line != 6 {
+		t.Errorf("Should report the line number: %v", errs[3])
+	}
+
+	//precision
+	batch, _, _ = DecodeLineProtocol([]byte("cpu value=1 1465839830"), "s")
+	if !batch[0].Timestamp.Equal(time.Unix(1465839830, 0)) {
+		t.Errorf("Bad timestamp: %v", batch[0].Timestamp)
+	}
+	if _, _, err := DecodeLineProtocol([]byte("cpu value=1"), "fortnight"); err == nil {
+		t.Errorf("Should reject unknown precision")
+	}
+	if _, _, err := DecodeLineProtocol([]byte("\n# nothing\n"), ""); err == nil {
+		t.Errorf("Should reject no lines")
+	}
+}
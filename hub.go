@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/npotts/homehub/internal/queue"
+)
+
+/*Hub fans out every Datam published to it to its subscribers.  Publishing never
+blocks: each subscriber has a bounded buffer, and when a slow subscriber's buffer
+is full its oldest Datam is dropped to make room.*/
+type Hub struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+/*NewHub returns an empty Hub*/
+func NewHub() *Hub {
+	return &Hub{subs: map[*Subscription]struct{}{}}
+}
+
+/*Subscription receives the Datam published to a Hub on C until it, or the Hub,
+is closed, at which point C is closed.*/
+type Subscription struct {
+	C <-chan Datam
+
+	c       chan Datam
+	hub     *Hub
+	tables  map[Alphabetic]bool //empty means every table
+	dropped uint64
+}
+
+/*Subscribe returns a Subscription to the given tables (or every table if none are
+given) that buffers up to buffer Datam*/
+func (h *Hub) Subscribe(buffer int, tables ...Alphabetic) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	s := &Subscription{c: make(chan Datam, buffer), hub: h, tables: map[Alphabetic]bool{}}
+	s.C = s.c
+	for _, table := range tables {
+		s.tables[table] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(s.c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+/*Close stops the subscription and closes C.  It is safe to call more than once.*/
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+/*Dropped returns how many Datam were dropped because the subscriber fell behind*/
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+/*send queues datam without blocking, dropping the oldest queued Datam if full*/
+func (s *Subscription) send(datam Datam) {
+	if len(s.tables) > 0 && !s.tables[datam.Table] {
+		return
+	}
+	if dropped := queue.Offer(s.c, datam); dropped > 0 {
+		atomic.AddUint64(&s.dropped, dropped)
+	}
+}
+
+/*Publish hands datam to every interested subscriber*/
+func (h *Hub) Publish(datam Datam) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		s.send(datam)
+	}
+}
+
+/*Close closes every subscription.  Later subscriptions are closed straight away.*/
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		delete(h.subs, s)
+		close(s.c)
+	}
+	h.closed = true
+}
+
+/*publisher is a Backend that publishes every Datam it successfully stores*/
+type publisher struct {
+	Backend
+	hub *Hub
+}
+
+/*Store conforms to the Backend interface*/
+func (p *publisher) Store(datam Datam) error {
+	if err := p.Backend.Store(datam); err != nil {
+		return err
+	}
+	p.hub.Publish(datam)
+	return nil
+}
+
+/*Unwrap conforms to the Wrapper interface*/
+func (p *publisher) Unwrap() Backend {
+	return p.Backend
+}
+
+/*batchPublisher is a publisher around a BatchBackend*/
+type batchPublisher struct {
+	publisher
+}
+
+/*StoreBatch conforms to the BatchBackend interface*/
+func (p *batchPublisher) StoreBatch(batch DatamBatch) error {
+	if err := p.Backend.(BatchBackend).StoreBatch(batch); err != nil {
+		return err
+	}
+	for _, datam := range batch {
+		p.hub.Publish(datam)
+	}
+	return nil
+}
+
+/*Publishing wraps be so that every Datam it successfully stores is published to hub*/
+func Publishing(be Backend, hub *Hub) Backend {
+	p := publisher{Backend: be, hub: hub}
+	if _, ok := be.(BatchBackend); ok {
+		return &batchPublisher{p}
+	}
+	return &p
+}
@@ -8,6 +8,8 @@ This file is part of the HomeHub project
 
 package homehub
 
+import "reflect"
+
 /*An Attendant performs the function of listening for data messages and forwarding them to a backend to store*/
 type Attendant interface {
 	Use(Backend) //where do we aim messages
@@ -22,13 +24,59 @@ type Backend interface {
 	Stop()                //cease operations
 }
 
+/*A BatchBackend is a Backend that can store a whole DatamBatch as one unit*/
+type BatchBackend interface {
+	Backend
+	StoreBatch(DatamBatch) error //stores all of the batch, or none of it
+}
+
+/*A Reader reads back what a Backend has stored*/
+type Reader interface {
+	Tables() ([]Alphabetic, error)             //every registered table, by name
+	Schema(table Alphabetic) ([]Column, error) //columns of table, or ErrUnknownTable
+	Rows(Query) ([]Datam, error)               //rows matching the query, with their Timestamp set
+}
+
+/*An Aggregator summarizes what a Backend has stored over buckets of time*/
+type Aggregator interface {
+	Aggregate(AggregateQuery) ([]Bucket, error) //buckets holding at least one matching row, oldest first
+}
+
+/*A Wrapper is a Backend that adds to another Backend, such as by publishing what it stores*/
+type Wrapper interface {
+	Unwrap() Backend //the wrapped backend
+}
+
+/*As finds the first Backend in be's chain of wrapped backends that is assignable to
+the interface pointed to by target, sets target to it and returns true.  It is much like
+errors.As, and lets eg a Reader be found beneath any number of Wrappers.*/
+func As(be Backend, target interface{}) bool {
+	val := reflect.ValueOf(target)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Interface {
+		panic("homehub: target must be a non-nil pointer to an interface")
+	}
+	want := val.Elem().Type()
+	for be != nil {
+		if reflect.TypeOf(be).AssignableTo(want) {
+			val.Elem().Set(reflect.ValueOf(be))
+			return true
+		}
+		w, ok := be.(Wrapper)
+		if !ok {
+			break
+		}
+		be = w.Unwrap()
+	}
+	return false
+}
+
 /*GoodSample is a sample of a good Datam*/
 var GoodSample = Datam{
 	Table: "test",
 	Data: map[Alphabetic]Field{
-		Alphabetic("float"):  Field{Value: 1.0, mode: fmFloat},
-		Alphabetic("string"): Field{Value: "str", mode: fmString},
-		Alphabetic("int"):    Field{Value: 1, mode: fmInt},
-		Alphabetic("bool"):   Field{Value: false, mode: fmBool},
+		Alphabetic("float"):  Field{Value: 1.0, mode: ModeFloat},
+		Alphabetic("string"): Field{Value: "str", mode: ModeString},
+		Alphabetic("int"):    Field{Value: 1, mode: ModeInt},
+		Alphabetic("bool"):   Field{Value: false, mode: ModeBool},
 	},
 }
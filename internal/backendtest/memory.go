@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package backendtest provides a backend for tests to hand to attendants and wrapping
+backends, which records what reaches it so it can be checked afterwards.*/
+package backendtest
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/npotts/homehub"
+)
+
+/*ErrFull is returned for the table "full", and for every table while failing*/
+var ErrFull = errors.New("disk full")
+
+/*Memory is a homehub.Backend that records what is registered and stored with it, and
+how often it is stopped.  It is safe for use by several goroutines at once.  The zero
+value is ready to use.*/
+type Memory struct {
+	mu         sync.Mutex
+	registered []homehub.Datam
+	stored     []homehub.Datam
+	stopped    int
+	failing    bool
+}
+
+/*Fail sets whether Register and Store fail for every table*/
+func (m *Memory) Fail(failing bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failing = failing
+}
+
+/*check returns ErrFull if datam should not be accepted.  m.mu must be held.*/
+func (m *Memory) check(datam homehub.Datam) error {
+	if m.failing || datam.Table == "full" {
+		return ErrFull
+	}
+	return nil
+}
+
+/*Register conforms to homehub.Backend*/
+func (m *Memory) Register(datam homehub.Datam) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(datam); err != nil {
+		return err
+	}
+	m.registered = append(m.registered, datam)
+	return nil
+}
+
+/*Store conforms to homehub.Backend*/
+func (m *Memory) Store(datam homehub.Datam) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(datam); err != nil {
+		return err
+	}
+	m.stored = append(m.stored, datam)
+	return nil
+}
+
+/*Stop conforms to homehub.Backend*/
+func (m *Memory) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped++
+}
+
+/*Registered returns what has been registered, in order*/
+func (m *Memory) Registered() []homehub.Datam {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]homehub.Datam{}, m.registered...)
+}
+
+/*Stored returns what has been stored, in order*/
+func (m *Memory) Stored() []homehub.Datam {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]homehub.Datam{}, m.stored...)
+}
+
+/*Counts returns how many Datam have been registered and stored*/
+func (m *Memory) Counts() (registered, stored int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.registered), len(m.stored)
+}
+
+/*Stopped returns how many times Stop has been called*/
+func (m *Memory) Stopped() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopped
+}
+
+/*Batch is a Memory that is also a homehub.BatchBackend.  A batch is stored whole,
+or not at all if any of it is refused.*/
+type Batch struct {
+	Memory
+}
+
+/*StoreBatch conforms to homehub.BatchBackend*/
+func (b *Batch) StoreBatch(batch homehub.DatamBatch) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, datam := range batch {
+		if err := b.check(datam); err != nil {
+			return err
+		}
+	}
+	b.stored = append(b.stored, batch...)
+	return nil
+}
+
+/*Tables returns the table of each Datam in batch, in order*/
+func Tables(batch []homehub.Datam) []homehub.Alphabetic {
+	tables := make([]homehub.Alphabetic, len(batch))
+	for i, datam := range batch {
+		tables[i] = datam.Table
+	}
+	return tables
+}
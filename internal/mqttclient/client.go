@@ -0,0 +1,52 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package mqttclient holds what the MQTT attendant and the MQTT publishing backend
+share in connecting to a broker.*/
+package mqttclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+/*schemes are the broker urls understood*/
+var schemes = map[string]bool{"tcp": true, "mqtt": true, "ssl": true, "tls": true, "mqtts": true, "ws": true, "wss": true}
+
+/*Options returns the options to connect to broker with as clientID, or a random
+"homehub-" one if empty, logging in as username if set.  Clients made with them keep
+retrying until the broker can be reached, and reconnect whenever the connection is
+lost.  A non-nil error means broker is not a usable url.*/
+func Options(broker, clientID, username, password string) (*paho.ClientOptions, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	if !schemes[u.Scheme] || u.Host == "" {
+		return nil, fmt.Errorf("Unusable broker url %q, must be like tcp://host:1883", broker)
+	}
+	if clientID == "" {
+		id := make([]byte, 6)
+		rand.Read(id)
+		clientID = "homehub-" + hex.EncodeToString(id)
+	}
+	return paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Second).
+		SetMaxReconnectInterval(30 * time.Second), nil
+}
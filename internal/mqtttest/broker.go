@@ -0,0 +1,350 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package mqtttest provides a small MQTT 3.1.1 broker for tests to run against, much
+as net/http/httptest provides servers.  It speaks just enough of the protocol for
+clients to connect, subscribe, and publish at QoS 0 or 1: everything is delivered at
+QoS 0, sessions are not kept, and nothing is authenticated.*/
+package mqtttest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+/*packet types, as found in the top four bits of the first byte of each packet*/
+const (
+	connect     = 1
+	connack     = 2
+	publish     = 3
+	puback      = 4
+	subscribe   = 8
+	suback      = 9
+	unsubscribe = 10
+	unsuback    = 11
+	pingreq     = 12
+	pingresp    = 13
+	disconnect  = 14
+)
+
+var errMalformed = errors.New("mqtttest: malformed packet")
+
+/*Broker is a MQTT broker listening on a local TCP port*/
+type Broker struct {
+	ln   net.Listener
+	done chan struct{} //closed once the accept loop has exited
+
+	mu            sync.Mutex
+	clients       map[*client]struct{}
+	retained      map[string][]byte
+	subscriptions int
+	watchers      []watcher
+}
+
+/*Message is a message published to the broker*/
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+/*watcher is a channel messages on topics matching filter are sent to*/
+type watcher struct {
+	filter string
+	c      chan Message
+}
+
+/*client is a connection to the broker*/
+type client struct {
+	conn    net.Conn
+	mu      sync.Mutex //serializes writes
+	filters []string   //guarded by Broker.mu
+}
+
+/*NewBroker returns a running Broker listening on a free port of 127.0.0.1*/
+func NewBroker() (*Broker, error) {
+	return Listen("127.0.0.1:0")
+}
+
+/*Listen returns a running Broker listening on addr, such as the address of a Broker
+that has been closed, to have its clients reconnect*/
+func Listen(addr string) (*Broker, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		ln:       ln,
+		done:     make(chan struct{}),
+		clients:  map[*client]struct{}{},
+		retained: map[string][]byte{},
+	}
+	go b.accept()
+	return b, nil
+}
+
+/*Addr returns the address listened on, such as "127.0.0.1:41234"*/
+func (b *Broker) Addr() string {
+	return b.ln.Addr().String()
+}
+
+/*URL returns the broker's address as a url, such as "tcp://127.0.0.1:41234"*/
+func (b *Broker) URL() string {
+	return "tcp://" + b.Addr()
+}
+
+/*Watch returns a channel that is sent the messages published to topics matching filter
+from now on.  Up to buffer messages are held for the reader, after which more are dropped.*/
+func (b *Broker) Watch(filter string, buffer int) <-chan Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := watcher{filter: filter, c: make(chan Message, buffer)}
+	b.watchers = append(b.watchers, w)
+	return w.c
+}
+
+/*Retained returns the message retained for topic, if any*/
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+/*Subscriptions returns how many topic filters clients have subscribed to in all*/
+func (b *Broker) Subscriptions() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscriptions
+}
+
+/*Publish sends payload to every client subscribed to topic, as a client publishing
+would.  If retain is true, it is also kept and sent to later subscribers.*/
+func (b *Broker) Publish(topic string, payload []byte, retain bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if retain {
+		b.retained[topic] = payload
+	}
+	for _, w := range b.watchers {
+		if Match(w.filter, topic) {
+			select {
+			case w.c <- Message{Topic: topic, Payload: payload, Retain: retain}:
+			default:
+			}
+		}
+	}
+	for c := range b.clients {
+		for _, filter := range c.filters {
+			if Match(filter, topic) {
+				c.publish(topic, payload, false)
+				break
+			}
+		}
+	}
+}
+
+/*Drop closes every client's connection, as if the network had gone away*/
+func (b *Broker) Drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+/*Close stops listening and drops every client*/
+func (b *Broker) Close() {
+	b.ln.Close()
+	<-b.done
+	b.Drop()
+}
+
+/*Match returns true if topic matches filter, which may hold the + and # wildcards*/
+func Match(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+/*accept serves connections until the listener is closed*/
+func (b *Broker) accept() {
+	defer close(b.done)
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{conn: conn}
+		b.mu.Lock()
+		b.clients[c] = struct{}{}
+		b.mu.Unlock()
+		go b.serve(c)
+	}
+}
+
+/*serve handles the packets a client sends until it disconnects*/
+func (b *Broker) serve(c *client) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		c.conn.Close()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		kind, flags, body, err := read(r)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case connect:
+			c.write(connack<<4, []byte{0, 0})
+		case publish:
+			topic, rest, err := str(body)
+			if err != nil {
+				return
+			}
+			if qos := flags >> 1 & 3; qos > 0 {
+				if len(rest) < 2 {
+					return
+				}
+				if qos == 1 {
+					c.write(puback<<4, rest[:2])
+				}
+				rest = rest[2:]
+			}
+			b.Publish(topic, rest, flags&1 == 1)
+		case subscribe:
+			if err := b.subscribe(c, body); err != nil {
+				return
+			}
+		case unsubscribe:
+			if len(body) < 2 {
+				return
+			}
+			c.write(unsuback<<4, body[:2])
+		case pingreq:
+			c.write(pingresp<<4, nil)
+		case disconnect:
+			return
+		}
+	}
+}
+
+/*subscribe adds the filters in a SUBSCRIBE packet's body to c, acknowledges them and
+sends any retained messages they match*/
+func (b *Broker) subscribe(c *client, body []byte) error {
+	if len(body) < 2 {
+		return errMalformed
+	}
+	ack, rest := append([]byte{}, body[:2]...), body[2:]
+	filters := []string{}
+	for len(rest) > 0 {
+		filter, tail, err := str(rest)
+		if err != nil || len(tail) < 1 {
+			return errMalformed
+		}
+		filters, ack, rest = append(filters, filter), append(ack, 0), tail[1:]
+	}
+	c.write(suback<<4, ack)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c.filters = append(c.filters, filters...)
+	b.subscriptions += len(filters)
+	for topic, payload := range b.retained {
+		for _, filter := range filters {
+			if Match(filter, topic) {
+				c.publish(topic, payload, true)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+/*publish sends a QoS 0 PUBLISH packet to c*/
+func (c *client) publish(topic string, payload []byte, retain bool) {
+	header := byte(publish << 4)
+	if retain {
+		header |= 1
+	}
+	body := make([]byte, 2, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	c.write(header, append(append(body, topic...), payload...))
+}
+
+/*write sends a packet to c; errors are left for the reader to discover*/
+func (c *client) write(header byte, body []byte) {
+	packet := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 128
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(append(packet, body...))
+}
+
+/*read reads a packet, returning its type, flags and body*/
+func read(r *bufio.Reader) (kind, flags byte, body []byte, err error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, shift := 0, uint(0)
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length |= int(digit&127) << shift
+		if digit&128 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, 0, nil, errMalformed
+		}
+	}
+	body = make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 15, body, nil
+}
+
+/*str splits a length prefixed string off the front of data*/
+func str(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errMalformed
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return "", nil, errMalformed
+	}
+	return string(data[2 : 2+n]), data[2+n:], nil
+}
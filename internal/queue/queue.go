@@ -0,0 +1,28 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package queue holds the bounded queue that drops its oldest entries when full,
+shared by the Hub's subscriptions and the MQTT publishing backend.*/
+package queue
+
+/*Offer queues v on c without blocking, dropping the oldest entries queued on c to
+make room if it is full.  It returns how many entries were dropped.*/
+func Offer[T any](c chan T, v T) (dropped uint64) {
+	for {
+		select {
+		case c <- v:
+			return dropped
+		default:
+		}
+		select {
+		case <-c:
+			dropped++
+		default:
+		}
+	}
+}
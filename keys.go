@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+/*Permission is a set of operations an APIKey allows*/
+type Permission int
+
+const (
+	//PermRegister allows registering tables
+	PermRegister Permission = 1 << iota
+	//PermStore allows storing data
+	PermStore
+	//PermBoth allows registering and storing
+	PermBoth = PermRegister | PermStore
+)
+
+/*ParsePermission converts "register", "store" or "both" into a Permission*/
+func ParsePermission(s string) (Permission, error) {
+	switch strings.ToLower(s) {
+	case "register":
+		return PermRegister, nil
+	case "store":
+		return PermStore, nil
+	case "both":
+		return PermBoth, nil
+	}
+	return 0, fmt.Errorf("Unknown permission %q, must be register, store or both", s)
+}
+
+/*String conforms to the fmt.Stringer interface*/
+func (p Permission) String() string {
+	switch p {
+	case PermRegister:
+		return "register"
+	case PermStore:
+		return "store"
+	case PermBoth:
+		return "both"
+	}
+	return "none"
+}
+
+/*APIKey is what a bearer token grants to the device it was issued to*/
+type APIKey struct {
+	Device string     `json:"device"` //name of the device, unique per key
+	Tables []string   `json:"tables"` //path.Match style patterns of tables that may be used, eg "garage*"
+	Perms  Permission `json:"perms"`  //operations allowed
+}
+
+/*Allows returns true if the key permits perm on table*/
+func (k APIKey) Allows(table Alphabetic, perm Permission) bool {
+	if k.Perms&perm != perm {
+		return false
+	}
+	for _, pattern := range k.Tables {
+		if ok, _ := path.Match(pattern, string(table)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*ErrUnknownKey is returned by a KeyStore when a token or device is not known*/
+var ErrUnknownKey = fmt.Errorf("Unknown API key")
+
+/*A KeyStore issues and looks up APIKeys.  Only a hash of each token is kept,
+so a lost token cannot be recovered, only revoked and reissued.*/
+type KeyStore interface {
+	CreateKey(APIKey) (token string, err error) //issues a new token, replacing any existing one for the device
+	LookupKey(token string) (APIKey, error)      //returns the key for token, or ErrUnknownKey
+	DeviceKey(device string) (APIKey, error)     //returns the key issued to device, or ErrUnknownKey
+	RevokeKey(device string) error               //removes the device's key, or returns ErrUnknownKey
+	ListKeys() ([]APIKey, error)                 //every key, by device
+}
+
+/*NewToken returns a new random bearer token*/
+func NewToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+/*HashToken returns the hash of token that a KeyStore keeps*/
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
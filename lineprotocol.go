@@ -0,0 +1,277 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*digitNames spell out digits that Alphabetic cannot hold*/
+var digitNames = [...]string{"Zero", "One", "Two", "Three", "Four", "Five", "Six", "Seven", "Eight", "Nine"}
+
+/*MakeAlphabetic maps an arbitrary name, such as "usage_idle" or "ds18b20.temp", onto
+Alphabetic's rules.  Anything other than an ASCII letter or digit separates words,
+which are joined in camel case ("usageIdle").  A single digit may end the name as
+it is; any other digit is spelled out ("dsOneEightBTwoZeroTemp").  The result is
+empty, and so not Valid, if name has no letters or digits.*/
+func MakeAlphabetic(name string) Alphabetic {
+	isLetter := func(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+
+	last, prev := -1, -1 //index of the last letter or digit, and the one before it
+	for i := 0; i < len(name); i++ {
+		if isLetter(name[i]) || isDigit(name[i]) {
+			last, prev = i, last
+		}
+	}
+
+	out, upper := strings.Builder{}, false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case isLetter(c):
+			if upper && c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			out.WriteByte(c)
+			upper = false
+		case isDigit(c) && i == last && prev >= 0 && isLetter(name[prev]):
+			out.WriteByte(c)
+		case isDigit(c):
+			out.WriteString(digitNames[c-'0'])
+			upper = true
+		default:
+			upper = out.Len() > 0
+		}
+	}
+	return Alphabetic(out.String())
+}
+
+/*precisions are the multiples of a nanosecond that line protocol timestamps may be given in*/
+var precisions = map[string]time.Duration{
+	"": time.Nanosecond, "n": time.Nanosecond, "ns": time.Nanosecond,
+	"u": time.Microsecond, "us": time.Microsecond, "µ": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+/*LineError describes why a line of line protocol could not be decoded*/
+type LineError struct {
+	Line   int    //1 based line number
+	Text   string //offending line, possibly truncated
+	Reason string
+}
+
+/*Error conforms to the error interface*/
+func (e *LineError) Error() string {
+	return fmt.Sprintf("unable to parse line %d '%s': %s", e.Line, e.Text, e.Reason)
+}
+
+/*Is allows errors.Is(err, ErrInvalid) to match any LineError*/
+func (e *LineError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+/*DecodeLineProtocol decodes data as InfluxDB line protocol, one Datam per line.  The
+measurement becomes the table, and fields become Fields: integers ("1i") and unsigned
+integers ("1u") are ints, other numbers floats, and quoted values strings.  Tags are
+kept as string Fields.  Measurement, tag and field names are mapped with MakeAlphabetic.
+Timestamps are in units of precision ("ns", "us", "ms", "s", "m" or "h"; nanoseconds
+if empty).  Blank lines and comments are skipped.
+
+As with DecodeBatch, errs is index aligned with batch and holds the reason (a
+*LineError) an entry could not be decoded; such entries are left as the zero Datam.
+A non-nil err means precision is unknown or there are no lines at all.*/
+func DecodeLineProtocol(data []byte, precision string) (batch DatamBatch, errs []error, err error) {
+	unit, ok := precisions[precision]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown precision %q, must be one of n, u, ms, s, m or h", precision)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		datam, reason := decodeLine(line, unit)
+		if reason != "" {
+			text := line
+			if len(text) > 64 {
+				text = text[:64] + "..."
+			}
+			batch, errs = append(batch, Datam{}), append(errs, &LineError{Line: n, Text: text, Reason: reason})
+			continue
+		}
+		batch, errs = append(batch, datam), append(errs, datam.Validate())
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(batch) == 0 {
+		return nil, nil, fmt.Errorf("No line protocol found")
+	}
+	return batch, errs, nil
+}
+
+/*token reads from line, starting at i, up to the first unescaped byte in stops, and
+returns it unescaped along with the index of the byte it stopped at*/
+func token(line string, i int, stops string) (string, int) {
+	out := strings.Builder{}
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && (line[i+1] == '\\' || strings.IndexByte(stops, line[i+1]) >= 0) {
+			i++
+			out.WriteByte(line[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		out.WriteByte(c)
+	}
+	return out.String(), i
+}
+
+/*quoted reads a double quoted string value starting at line[i], returning it unescaped
+along with the index just past the closing quote, or -1 if there is none*/
+func quoted(line string, i int) (string, int) {
+	out := strings.Builder{}
+	for i++; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+			i++
+			out.WriteByte(line[i])
+			continue
+		}
+		if c == '"' {
+			return out.String(), i + 1
+		}
+		out.WriteByte(c)
+	}
+	return "", -1
+}
+
+/*fieldValue converts a line protocol field value into a Field*/
+func fieldValue(raw string) (Field, bool) {
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return Field{mode: ModeBool, Value: true}, true
+	case "f", "F", "false", "False", "FALSE":
+		return Field{mode: ModeBool, Value: false}, true
+	}
+	switch {
+	case strings.HasSuffix(raw, "i"):
+		if v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64); err == nil {
+			return Field{mode: ModeInt, Value: v}, true
+		}
+	case strings.HasSuffix(raw, "u"):
+		if v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 63); err == nil {
+			return Field{mode: ModeInt, Value: int64(v)}, true
+		}
+	default:
+		if v, err := strconv.ParseFloat(raw, 64); err == nil {
+			return Field{mode: ModeFloat, Value: v}, true
+		}
+	}
+	return Field{}, false
+}
+
+/*decodeLine decodes a single line of line protocol, or returns why it cannot*/
+func decodeLine(line string, unit time.Duration) (Datam, string) {
+	if !utf8.ValidString(line) {
+		return Datam{}, "not valid UTF-8"
+	}
+	datam := Datam{Data: map[Alphabetic]Field{}}
+	measurement, i := token(line, 0, ", ")
+	if datam.Table = MakeAlphabetic(measurement); !datam.Table.Valid() {
+		return Datam{}, fmt.Sprintf("unusable measurement %q", measurement)
+	}
+	add := func(kind, key string, field Field) string {
+		name := MakeAlphabetic(key)
+		if !name.Valid() {
+			return fmt.Sprintf("unusable %s key %q", kind, key)
+		}
+		if _, ok := datam.Data[name]; ok {
+			return fmt.Sprintf("%s key %q is the same as another once mapped to %q", kind, key, name)
+		}
+		datam.Data[name] = field
+		return ""
+	}
+
+	//tag set
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		if key, i = token(line, i+1, ",= "); i >= len(line) || line[i] != '=' || key == "" {
+			return Datam{}, "missing tag key"
+		}
+		if value, i = token(line, i+1, ", "); value == "" {
+			return Datam{}, fmt.Sprintf("missing value for tag %q", key)
+		}
+		if reason := add("tag", key, Field{mode: ModeString, Value: value}); reason != "" {
+			return Datam{}, reason
+		}
+	}
+
+	//field set
+	if i >= len(line) || line[i] != ' ' {
+		return Datam{}, "missing fields"
+	}
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	for {
+		var key, raw string
+		if key, i = token(line, i, ",= "); i >= len(line) || line[i] != '=' || key == "" {
+			return Datam{}, "missing field key"
+		}
+		var field Field
+		if i++; i < len(line) && line[i] == '"' {
+			if raw, i = quoted(line, i); i < 0 {
+				return Datam{}, fmt.Sprintf("unterminated string for field %q", key)
+			}
+			field = Field{mode: ModeString, Value: raw}
+		} else {
+			raw, i = token(line, i, ", ")
+			ok := false
+			if field, ok = fieldValue(raw); !ok {
+				return Datam{}, fmt.Sprintf("invalid value %q for field %q", raw, key)
+			}
+		}
+		if reason := add("field", key, field); reason != "" {
+			return Datam{}, reason
+		}
+		if i >= len(line) || line[i] == ' ' {
+			break
+		}
+		if line[i] != ',' {
+			return Datam{}, fmt.Sprintf("unexpected %q after field %q", line[i], key)
+		}
+		i++
+	}
+
+	//timestamp
+	if rest := strings.TrimSpace(line[i:]); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if limit := int64(math.MaxInt64 / unit); err != nil || ts > limit || ts < -limit {
+			return Datam{}, fmt.Sprintf("invalid timestamp %q", rest)
+		}
+		datam.Timestamp = &Timestamp{time.Unix(0, ts*int64(unit)).UTC()}
+	}
+	return datam, ""
+}
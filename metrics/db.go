@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package metrics
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*dbStats collects a database/sql connection pool's statistics each time it is scraped*/
+type dbStats struct {
+	stats func() sql.DBStats
+
+	maxOpen, open, inUse, idle                  *prometheus.Desc
+	waitCount, waitDuration, idleClosed, closed *prometheus.Desc
+}
+
+/*DBStats returns a Collector of the connection pool statistics returned by stats,
+such as SQLBackend.DBStats, labelled with the database name*/
+func DBStats(name string, stats func() sql.DBStats) prometheus.Collector {
+	desc := func(metric, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db", metric), help, nil, prometheus.Labels{"db": name})
+	}
+	return &dbStats{
+		stats:        stats,
+		maxOpen:      desc("max_open_connections", "Most open connections allowed to the database."),
+		open:         desc("open_connections", "Connections to the database, in use or idle."),
+		inUse:        desc("in_use_connections", "Connections to the database in use."),
+		idle:         desc("idle_connections", "Idle connections to the database."),
+		waitCount:    desc("wait_count_total", "Times a connection to the database was waited for."),
+		waitDuration: desc("wait_duration_seconds_total", "Time spent waiting for connections to the database."),
+		idleClosed:   desc("max_idle_closed_total", "Connections closed as there were too many idle."),
+		closed:       desc("max_lifetime_closed_total", "Connections closed as they reached their maximum lifetime."),
+	}
+}
+
+/*Describe conforms to the prometheus.Collector interface*/
+func (d *dbStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{d.maxOpen, d.open, d.inUse, d.idle, d.waitCount, d.waitDuration, d.idleClosed, d.closed} {
+		ch <- desc
+	}
+}
+
+/*Collect conforms to the prometheus.Collector interface*/
+func (d *dbStats) Collect(ch chan<- prometheus.Metric) {
+	s := d.stats()
+	ch <- prometheus.MustNewConstMetric(d.maxOpen, prometheus.GaugeValue, float64(s.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(d.open, prometheus.GaugeValue, float64(s.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(d.inUse, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(d.idle, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(d.waitCount, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(d.waitDuration, prometheus.CounterValue, s.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(d.idleClosed, prometheus.CounterValue, float64(s.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(d.closed, prometheus.CounterValue, float64(s.MaxLifetimeClosed))
+}
@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+/*Package metrics exposes what homehub is doing in the Prometheus text format.
+
+Attendants and backends update the collectors here as they work, and Handler
+serves everything registered with Registry, usually on /metrics.*/
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/npotts/homehub"
+)
+
+const namespace = "homehub"
+
+/*Registry holds every homehub collector, along with the Go runtime and process ones*/
+var Registry = prometheus.NewRegistry()
+
+var (
+	/*HTTPRequests counts HTTP requests by route template, method and status code*/
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "http", Name: "requests_total",
+		Help: "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	/*HTTPDuration observes how long HTTP requests take by route template and method*/
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	/*BackendDuration observes how long backend operations take by operation and table*/
+	BackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "backend", Name: "duration_seconds",
+		Help:    "Time taken by the backend to register or store a datam, by operation and table.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op", "table"})
+
+	/*BackendErrors counts failed backend operations by operation and table*/
+	BackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "backend", Name: "errors_total",
+		Help: "Backend register or store operations that failed, by operation and table.",
+	}, []string{"op", "table"})
+
+	/*MangosMessages counts messages received over mangos sockets by type of socket and result*/
+	MangosMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "mangos", Name: "messages_total",
+		Help: "Messages received over mangos sockets, by type of socket and result.",
+	}, []string{"socket", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPDuration,
+		BackendDuration, BackendErrors,
+		MangosMessages,
+	)
+}
+
+/*Handler serves everything in Registry in the Prometheus text format*/
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+/*observe records an operation on table that started at start and ended with err*/
+func observe(op string, table homehub.Alphabetic, start time.Time, err error) {
+	BackendDuration.WithLabelValues(op, string(table)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		BackendErrors.WithLabelValues(op, string(table)).Inc()
+	}
+}
+
+/*backend is a homehub.Backend that times and counts the errors of another*/
+type backend struct {
+	homehub.Backend
+}
+
+/*Register conforms to the homehub.Backend interface*/
+func (b *backend) Register(datam homehub.Datam) error {
+	start := time.Now()
+	err := b.Backend.Register(datam)
+	observe("register", datam.Table, start, err)
+	return err
+}
+
+/*Store conforms to the homehub.Backend interface*/
+func (b *backend) Store(datam homehub.Datam) error {
+	start := time.Now()
+	err := b.Backend.Store(datam)
+	observe("store", datam.Table, start, err)
+	return err
+}
+
+/*Unwrap conforms to the homehub.Wrapper interface*/
+func (b *backend) Unwrap() homehub.Backend {
+	return b.Backend
+}
+
+/*batchBackend is a backend around a homehub.BatchBackend*/
+type batchBackend struct {
+	backend
+}
+
+/*StoreBatch conforms to the homehub.BatchBackend interface.  The whole batch is
+timed, and counted against each table it holds.*/
+func (b *batchBackend) StoreBatch(batch homehub.DatamBatch) error {
+	start := time.Now()
+	err := b.Backend.(homehub.BatchBackend).StoreBatch(batch)
+	tables := map[homehub.Alphabetic]bool{}
+	for _, datam := range batch {
+		if !tables[datam.Table] {
+			tables[datam.Table] = true
+			observe("store_batch", datam.Table, start, err)
+		}
+	}
+	return err
+}
+
+/*Backend wraps be so that its Register and Store calls are timed and their errors counted*/
+func Backend(be homehub.Backend) homehub.Backend {
+	b := backend{Backend: be}
+	if _, ok := be.(homehub.BatchBackend); ok {
+		return &batchBackend{b}
+	}
+	return &b
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package metrics
+
+import (
+	"database/sql"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/npotts/homehub"
+)
+
+type fake struct{ err error }
+
+func (f fake) Register(datam homehub.Datam) error { return nil }
+func (f fake) Store(datam homehub.Datam) error    { return f.err }
+func (f fake) Stop()                              {}
+
+type batchFake struct{ fake }
+
+func (f batchFake) StoreBatch(batch homehub.DatamBatch) error { return f.err }
+
+func TestBackend(t *testing.T) {
+	be := Backend(fake{err: errors.New("disk full")})
+	if _, ok := be.(homehub.BatchBackend); ok {
+		t.Errorf("Should not be a BatchBackend")
+	}
+	if w, ok := be.(homehub.Wrapper); !ok || w.Unwrap() == nil {
+		t.Errorf("Should unwrap")
+	}
+	be.Register(homehub.Datam{Table: "metrics_attic"})
+	be.Store(homehub.Datam{Table: "metrics_attic"})
+	be.Store(homehub.Datam{Table: "metrics_attic"})
+	if n := testutil.ToFloat64(BackendErrors.WithLabelValues("store", "metrics_attic")); n != 2 {
+		t.Errorf("Expected 2 store errors, got %v", n)
+	}
+	if n := testutil.ToFloat64(BackendErrors.WithLabelValues("register", "metrics_attic")); n != 0 {
+		t.Errorf("Expected no register errors, got %v", n)
+	}
+
+	bb, ok := Backend(batchFake{fake{err: errors.New("disk full")}}).(homehub.BatchBackend)
+	if !ok {
+		t.Fatalf("Should be a BatchBackend")
+	}
+	bb.StoreBatch(homehub.DatamBatch{{Table: "metrics_garage"}, {Table: "metrics_garage"}, {Table: "metrics_shed"}})
+	if testutil.ToFloat64(BackendErrors.WithLabelValues("store_batch", "metrics_garage")) != 1 ||
+		testutil.ToFloat64(BackendErrors.WithLabelValues("store_batch", "metrics_shed")) != 1 {
+		t.Errorf("Batch errors should be counted once per table")
+	}
+}
+
+func TestDBStats(t *testing.T) {
+	c := DBStats("test", func() sql.DBStats {
+		return sql.DBStats{MaxOpenConnections: 10, OpenConnections: 3, InUse: 1, Idle: 2, WaitCount: 4, WaitDuration: 1500 * time.Millisecond}
+	})
+	want := `
+# HELP homehub_db_open_connections Connections to the database, in use or idle.
+# TYPE homehub_db_open_connections gauge
+homehub_db_open_connections{db="test"} 3
+# HELP homehub_db_wait_duration_seconds_total Time spent waiting for connections to the database.
+# TYPE homehub_db_wait_duration_seconds_total counter
+homehub_db_wait_duration_seconds_total{db="test"} 1.5
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want), "homehub_db_open_connections", "homehub_db_wait_duration_seconds_total"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(c); n != 8 {
+		t.Errorf("Expected 8 metrics, got %d", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	HTTPRequests.WithLabelValues("/stats", "GET", "200").Inc()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{`homehub_http_requests_total{code="200",method="GET",route="/stats"} 1`, "go_goroutines", "process_start_time_seconds"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*ErrUnknownTable is returned by a Reader asked about a table that was never registered*/
+var ErrUnknownTable = fmt.Errorf("Unknown table")
+
+/*ErrUnknownField is matched by errors.Is when a Query names a field its table does not have*/
+var ErrUnknownField = fmt.Errorf("Unknown field")
+
+/*Query selects stored rows of a table, oldest first*/
+type Query struct {
+	Table  Alphabetic
+	From   time.Time    //earliest 'created' time, inclusive.  Zero means no limit
+	To     time.Time    //latest 'created' time, exclusive.  Zero means no limit
+	Fields []Alphabetic //fields to return.  A Reader treats none as all of them
+	Limit  int          //most rows to return.  Zero means no limit
+}
+
+/*where forms the WHERE clause (if any) limiting rows to From and To, and its arguments.
+Placeholders are numbered after the offset already used in the statement.*/
+func (q Query) where(sqld Dialect, offset int) (string, []interface{}) {
+	conds, args := []string{}, []interface{}{}
+	if !q.From.IsZero() {
+		args = append(args, sqld.TimeValue(q.From))
+		conds = append(conds, fmt.Sprintf("%s >= %s", sqld.Quote(createdColumn), sqld.Placeholder(offset+len(args))))
+	}
+	if !q.To.IsZero() {
+		args = append(args, sqld.TimeValue(q.To))
+		conds = append(conds, fmt.Sprintf("%s < %s", sqld.Quote(createdColumn), sqld.Placeholder(offset+len(args))))
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+/*SqlSelect forms a SQL SELECT statement for the query in the given dialect, along with
+the values matching its placeholders.  The 'created' column is selected first, followed
+by Fields in order, which must not be empty.*/
+func (q Query) SqlSelect(dialect string) (r string, args []interface{}, err error) {
+	sqld, err := LookupDialect(dialect)
+	if err != nil {
+		return "", nil, err
+	}
+	if !q.Table.Valid() || len(q.Fields) == 0 {
+		return "", nil, fmt.Errorf("Cannot form SqlSelect")
+	}
+	columns := []string{sqld.Quote(createdColumn)}
+	for _, field := range q.Fields {
+		if !field.Valid() {
+			return "", nil, fmt.Errorf("Invalid field %q", field)
+		}
+		columns = append(columns, sqld.Quote(string(field)))
+	}
+	where, args := q.where(sqld, 0)
+	r = fmt.Sprintf(`SELECT %s FROM %s%s ORDER BY %s, %s`, strings.Join(columns, ", "), sqld.Quote(string(q.Table)), where, sqld.Quote(createdColumn), sqld.Quote("rowid"))
+	if q.Limit > 0 {
+		r += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	return r + ";", args, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*ErrNoBackend is returned by a Registrar that has no backend to use*/
+var ErrNoBackend = fmt.Errorf("No backend in use")
+
+/*Registrar stores Datam to a backend, registering each table first whenever it arrives
+with a set of fields not seen before.  It suits attendants whose senders never register
+on their own.  The zero value is ready to Use.*/
+type Registrar struct {
+	mu         sync.RWMutex
+	backend    Backend
+	registered map[string]bool //signatures of what has been registered
+}
+
+/*Use sets the backend, forgetting what was registered with the last one*/
+func (r *Registrar) Use(be Backend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backend, r.registered = be, map[string]bool{}
+}
+
+/*signature identifies a table and its set of fields*/
+func signature(datam Datam) string {
+	fields := make([]string, 0, len(datam.Data))
+	for name, field := range datam.Data {
+		fields = append(fields, string(name)+":"+field.Mode().String())
+	}
+	sort.Strings(fields)
+	return string(datam.Table) + "|" + strings.Join(fields, ",")
+}
+
+/*Store registers datam if its table has not been seen with its fields before,
+then stores it*/
+func (r *Registrar) Store(datam Datam) error {
+	r.mu.RLock()
+	be, sig := r.backend, signature(datam)
+	known := r.registered[sig]
+	r.mu.RUnlock()
+	if be == nil {
+		return ErrNoBackend
+	}
+	if !known {
+		if err := be.Register(datam); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.registered[sig] = true
+		r.mu.Unlock()
+	}
+	return be.Store(datam)
+}
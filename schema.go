@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*ColumnConflict is a field whose type cannot be stored in an existing column*/
+type ColumnConflict struct {
+	Field    Alphabetic //offending field
+	Existing string     //column type as reported by the database
+	Wanted   string     //column type the field would need
+}
+
+/*SchemaConflictError is returned when a Datam cannot be reconciled with the
+columns of a table that already exists*/
+type SchemaConflictError struct {
+	Table     Alphabetic
+	Conflicts []ColumnConflict
+}
+
+/*Error conforms to the error interface*/
+func (s *SchemaConflictError) Error() string {
+	msgs := []string{}
+	for _, c := range s.Conflicts {
+		msgs = append(msgs, fmt.Sprintf("field %q is %s but column is %s", c.Field, c.Wanted, c.Existing))
+	}
+	return fmt.Sprintf("Schema conflict in table %q: %s", s.Table, strings.Join(msgs, "; "))
+}
+
+/*fits returns true if a field of mode f can be stored in a column of mode col*/
+func (f FieldMode) fits(col FieldMode) bool {
+	return f == col || f == ModeNull || (f == ModeInt && col == ModeFloat)
+}
+
+/*SqlAlter forms the ALTER TABLE statements needed to add any fields in the datam that
+are missing from existing, which maps the (case insensitive) column names of the table
+to their type as reported by the database.  A *SchemaConflictError is returned if a field
+cannot be stored in the column that already exists for it.*/
+func (d *Datam) SqlAlter(dialect string, existing map[string]string) ([]string, error) {
+	sqld, err := LookupDialect(dialect)
+	if err != nil || !d.Valid() {
+		return nil, fmt.Errorf("Cannot form SqlAlter")
+	}
+	columns := map[string]string{}
+	for name, coltype := range existing {
+		columns[strings.ToLower(name)] = coltype
+	}
+
+	alters, conflict := sort.StringSlice{}, &SchemaConflictError{Table: d.Table}
+	for label, val := range d.Data {
+		want, err := sqld.ColumnType(val.mode)
+		if err != nil { //nulls do not carry a type
+			continue
+		}
+		coltype, ok := columns[strings.ToLower(string(label))]
+		if !ok {
+			alter, err := sqld.AddColumn(string(d.Table), Column{Name: string(label), Mode: val.mode})
+			if err != nil {
+				return nil, err
+			}
+			alters = append(alters, alter)
+			continue
+		}
+		if !val.mode.fits(sqld.ColumnMode(coltype)) {
+			conflict.Conflicts = append(conflict.Conflicts, ColumnConflict{Field: label, Existing: coltype, Wanted: want})
+		}
+	}
+	if len(conflict.Conflicts) > 0 {
+		sort.Slice(conflict.Conflicts, func(i, j int) bool { return conflict.Conflicts[i].Field < conflict.Conflicts[j].Field })
+		return nil, conflict
+	}
+	alters.Sort()
+	return alters, nil
+}
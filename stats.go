@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"sync"
+	"time"
+)
+
+/*Outcome is what became of a Datam an attendant received*/
+type Outcome int
+
+const (
+	StatAccepted Outcome = iota //handed to the backend, which registered or stored it
+	StatRejected                //refused as malformed, invalid, too large or not permitted
+	StatFailed                  //valid, but the backend could not register or store it
+)
+
+/*Counts tallies the Datam received, by outcome*/
+type Counts struct {
+	Accepted uint64    `json:"accepted"`
+	Rejected uint64    `json:"rejected"`
+	Failed   uint64    `json:"failed"`
+	Bytes    uint64    `json:"bytes"`     //bytes received, as sent
+	LastSeen time.Time `json:"last_seen"` //when the last Datam was received, whatever became of it
+}
+
+/*add counts a single Datam*/
+func (c *Counts) add(outcome Outcome, bytes int, now time.Time) {
+	switch outcome {
+	case StatAccepted:
+		c.Accepted++
+	case StatRejected:
+		c.Rejected++
+	case StatFailed:
+		c.Failed++
+	}
+	if bytes > 0 {
+		c.Bytes += uint64(bytes)
+	}
+	c.LastSeen = now
+}
+
+/*merge adds o into c*/
+func (c *Counts) merge(o Counts) {
+	c.Accepted, c.Rejected, c.Failed, c.Bytes = c.Accepted+o.Accepted, c.Rejected+o.Rejected, c.Failed+o.Failed, c.Bytes+o.Bytes
+	if o.LastSeen.After(c.LastSeen) {
+		c.LastSeen = o.LastSeen
+	}
+}
+
+/*AttendantStats are the Counts of a single attendant, in total and by table*/
+type AttendantStats struct {
+	Counts
+	Tables map[Alphabetic]Counts `json:"tables"`
+}
+
+/*StatsSnapshot is a copy of the Counts held by Stats at one moment*/
+type StatsSnapshot struct {
+	Since      time.Time                 `json:"since"` //when counting began
+	Total      Counts                    `json:"total"`
+	Tables     map[Alphabetic]Counts     `json:"tables"` //over every attendant
+	Attendants map[string]AttendantStats `json:"attendants"`
+}
+
+/*Stats counts what attendants receive, by attendant and by table.  It is safe for
+concurrent use, and one Stats may be shared by any number of attendants.*/
+type Stats struct {
+	mu     sync.Mutex
+	since  time.Time
+	counts map[string]map[Alphabetic]*Counts //attendant -> table -> counts
+}
+
+/*NewStats returns a Stats with nothing counted*/
+func NewStats() *Stats {
+	return &Stats{since: time.Now(), counts: map[string]map[Alphabetic]*Counts{}}
+}
+
+/*Record counts a Datam received by attendant for table, with what became of it and how
+many bytes it took up.  table may be empty if the Datam was too malformed to tell.*/
+func (s *Stats) Record(attendant string, table Alphabetic, outcome Outcome, bytes int) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tables, ok := s.counts[attendant]
+	if !ok {
+		tables = map[Alphabetic]*Counts{}
+		s.counts[attendant] = tables
+	}
+	c, ok := tables[table]
+	if !ok {
+		c = &Counts{}
+		tables[table] = c
+	}
+	c.add(outcome, bytes, now)
+}
+
+/*Share returns the bytes to Record for entry i of a batch of n entries taking up size
+bytes.  They are shared evenly, with the last entry taking any remainder.*/
+func Share(size, n, i int) int {
+	if i == n-1 {
+		return size - size/n*(n-1)
+	}
+	return size / n
+}
+
+/*Snapshot returns a copy of everything counted so far.  Datam without a table are
+included in the totals, but not under Tables.*/
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := StatsSnapshot{Since: s.since, Tables: map[Alphabetic]Counts{}, Attendants: map[string]AttendantStats{}}
+	for attendant, tables := range s.counts {
+		as := AttendantStats{Tables: map[Alphabetic]Counts{}}
+		for table, c := range tables {
+			as.Counts.merge(*c)
+			snap.Total.merge(*c)
+			if table == "" {
+				continue
+			}
+			as.Tables[table] = *c
+			all := snap.Tables[table]
+			all.merge(*c)
+			snap.Tables[table] = all
+		}
+		snap.Attendants[attendant] = as
+	}
+	return snap
+}
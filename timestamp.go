@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2016 Nick Potts
+Licensed to You under the GNU GPLv3
+See the LICENSE file at github.com/npotts/homehub/LICENSE
+
+This file is part of the HomeHub project
+*/
+
+package homehub
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*Timestamp is an optional time a Datam was observed at.  Devices that buffer
+readings while offline set it so the stored time reflects when the reading was
+taken rather than when it arrived.  It unmarshals from a RFC3339 string, or a
+number of seconds or milliseconds since the Unix epoch.*/
+type Timestamp struct {
+	time.Time
+}
+
+/*msThreshold is the point at which a numeric timestamp is considered to be in
+milliseconds rather than seconds.  1e11 seconds is the year 5138, while 1e11
+milliseconds is early 1973, so there is no realistic overlap.*/
+const msThreshold = 1e11
+
+var errTimestamp = fmt.Errorf("Timestamp must be RFC3339, Unix seconds or Unix milliseconds")
+
+/*UnmarshalJSON conforms to the json.Unmarshaller interface*/
+func (t *Timestamp) UnmarshalJSON(incoming []byte) error {
+	incoming = bytes.TrimSpace(incoming)
+	if len(incoming) > 1 && incoming[0] == '"' {
+		parsed, err := time.Parse(time.RFC3339, string(incoming[1:len(incoming)-1]))
+		if err != nil {
+			return errTimestamp
+		}
+		t.Time = parsed.UTC()
+		return nil
+	}
+
+	if whole, err := strconv.ParseInt(string(incoming), 10, 64); err == nil {
+		if whole >= msThreshold || whole <= -msThreshold {
+			if limit := int64(math.MaxInt64 / time.Millisecond); whole > limit || whole < -limit {
+				return errTimestamp
+			}
+			t.Time = time.Unix(0, whole*int64(time.Millisecond)).UTC()
+			return nil
+		}
+		t.Time = time.Unix(whole, 0).UTC()
+		return nil
+	}
+
+	num, err := strconv.ParseFloat(string(incoming), 64)
+	if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+		return errTimestamp
+	}
+	if math.Abs(num) >= msThreshold {
+		if math.Abs(num) > math.MaxInt64/float64(time.Millisecond) {
+			return errTimestamp
+		}
+		num = num / 1e3
+	}
+	sec, frac := math.Modf(num)
+	t.Time = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	return nil
+}
+
+/*ParseTimestamp parses s as UnmarshalJSON would, but without requiring
+quotes around a RFC3339 time.  It suits query strings and the like.*/
+func ParseTimestamp(s string) (Timestamp, error) {
+	t := Timestamp{}
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		s = strconv.Quote(s)
+	}
+	err := t.UnmarshalJSON([]byte(s))
+	return t, err
+}